@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt"
+	"github.com/jackc/pgconn"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
 )
@@ -16,26 +18,31 @@ func HashPassword(password string) (string, error) {
 
 func DetermineIfAuthenticated(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("token")
-		if err != nil {
-			r = r.WithContext(context.WithValue(r.Context(), "IsAuthenticated", false))
+		// A request presenting an API key is refused if the key is not valid for the endpoint, rather than served as anonymous
+		if key, ok := bearerToken(r); ok {
+			apiKey, status, err := authorizeAPIKey(key, next)
+			if err != nil {
+				w.WriteHeader(status)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), "IsAuthenticated", true))
+			r = r.WithContext(context.WithValue(r.Context(), "username", apiKey.User.Username))
+			r = r.WithContext(context.WithValue(r.Context(), "apiKeyID", apiKey.ID))
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		tknStr := c.Value
-
-		claims := &Claims{}
-
-		tkn, err := jwt.ParseWithClaims(tknStr, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
+		c, err := r.Cookie("token")
 		if err != nil {
 			r = r.WithContext(context.WithValue(r.Context(), "IsAuthenticated", false))
 			next.ServeHTTP(w, r)
 			return
 		}
-		if !tkn.Valid {
+
+		claims, err := parseAccessToken(c.Value)
+		if err != nil {
 			r = r.WithContext(context.WithValue(r.Context(), "IsAuthenticated", false))
 			next.ServeHTTP(w, r)
 			return
@@ -43,12 +50,27 @@ func DetermineIfAuthenticated(next http.Handler) http.Handler {
 
 		r = r.WithContext(context.WithValue(r.Context(), "IsAuthenticated", true))
 		r = r.WithContext(context.WithValue(r.Context(), "username", claims.Username))
+		r = r.WithContext(context.WithValue(r.Context(), "sessionID", claims.SessionID))
 		next.ServeHTTP(w, r)
 	})
 }
 
 func AuthenticateAndReturnUsername(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key, ok := bearerToken(r); ok {
+			apiKey, status, err := authorizeAPIKey(key, next)
+			if err != nil {
+				w.WriteHeader(status)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), "username", apiKey.User.Username))
+			r = r.WithContext(context.WithValue(r.Context(), "apiKeyID", apiKey.ID))
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		c, err := r.Cookie("token")
 		if err != nil {
 			if err == http.ErrNoCookie {
@@ -60,27 +82,18 @@ func AuthenticateAndReturnUsername(next http.Handler) http.Handler {
 			return
 		}
 
-		tknStr := c.Value
-
-		claims := &Claims{}
-
-		tkn, err := jwt.ParseWithClaims(tknStr, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
+		claims, err := parseAccessToken(c.Value)
 		if err != nil {
-			if err == jwt.ErrSignatureInvalid {
+			if err == jwt.ErrSignatureInvalid || err == errTokenInvalid || err == errTokenRevoked {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		if !tkn.Valid {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
 
 		r = r.WithContext(context.WithValue(r.Context(), "username", claims.Username))
+		r = r.WithContext(context.WithValue(r.Context(), "sessionID", claims.SessionID))
 		next.ServeHTTP(w, r)
 	})
 }
@@ -100,6 +113,16 @@ func GetUserGUID(username string) (*string, error) {
 	return &users[0].ID, nil
 }
 
+// GetUserGUIDFromContext returns the ID of the user authenticated by AuthenticateAndReturnUsername or DetermineIfAuthenticated, with a token or an API key
+func GetUserGUIDFromContext(r *http.Request) (*string, error) {
+	username := r.Context().Value("username")
+	if username == nil {
+		return nil, fmt.Errorf("No username in request context")
+	}
+
+	return GetUserGUID(username.(string))
+}
+
 func CheckPasswordHash(password, hash string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
@@ -140,6 +163,12 @@ func GetUsernameForUser(userID string) string {
 	return user.Username
 }
 
+// isUniqueViolation reports whether err is postgres rejecting a row that would break the given unique index
+func isUniqueViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == constraint
+}
+
 func UserExists(users *[]User) bool {
 	if len(*users) > 0 {
 		return true
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 	"log"
 	"net/http"
 	"time"
@@ -11,13 +12,20 @@ import (
 
 type Claims struct {
 	Username string `json:"username"`
+	// Session the token was issued for, see Session
+	SessionID string `json:"sid,omitempty"`
 	jwt.StandardClaims
 }
 
 type User struct {
 	ID       string `gorm:"primaryKey"` // make sure this gets generated automatically
-	Username string `json:"username"`
+	Username string `json:"username" gorm:"uniqueIndex"`
 	Password string `json:"password"`
+	// Storage used by the user's photos, see reserveQuota and releaseQuota
+	UsedBytes  int64 `json:"-" gorm:"default:0"`
+	PhotoCount int64 `json:"-" gorm:"default:0"`
+	// Name of the QuotaTiers entry limiting the user, empty means DefaultQuotaTier
+	QuotaTier string `json:"-"`
 }
 
 func Signup(w http.ResponseWriter, r *http.Request) {
@@ -49,14 +57,23 @@ func Signup(w http.ResponseWriter, r *http.Request) {
 	userGUID := uuid.New().String()
 	u.ID = userGUID
 
-	// Registed user in DB
-	DB.Create(&u)
+	// Registed user in DB, the unique index on usernames catches a user signing up with the same name at the same time
+	if err := DB.Create(&u).Error; err != nil {
+		if isUniqueViolation(err, "idx_users_username") {
+			w.Write([]byte("Username already taken"))
+			w.WriteHeader(400)
+			return
+		}
+
+		w.Write([]byte(err.Error()))
+		w.WriteHeader(500)
+		return
+	}
 
-	// Create GCP bucket for user
-	bkt := Client.Bucket(userGUID)
+	// Create storage bucket for user
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
-	if err := bkt.Create(ctx, GCPProjectID, nil); err != nil {
+	if err := Store.CreateBucket(ctx, userGUID); err != nil {
 		log.Println(err.Error())
 		w.Write([]byte("Unable to register user storage"))
 		w.WriteHeader(500)
@@ -98,128 +115,68 @@ func Authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	expirationTime := time.Now().Add(5 * time.Minute)
-	claims := &Claims{
-		Username: u.Username,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
-	if err != nil {
+	// Start a session, the access token expires quickly while the refresh token keeps the session alive
+	if err := startSession(w, r, (*users)[0]); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Path:     "/",
-		Value:    tokenString,
-		HttpOnly: true,
-		Expires:  expirationTime,
-	})
 	w.Write([]byte("Authentication successful"))
 	w.WriteHeader(200)
 }
 
+// Refresh exchanges the refresh token for a new access token and a new refresh token, the old refresh token stops working
+// Presenting a refresh token that was already exchanged revokes the whole session, as it means the token was stolen
 func Refresh(w http.ResponseWriter, r *http.Request) {
-	c, err := r.Cookie("token")
+	c, err := r.Cookie(refreshTokenCookie)
 	if err != nil {
-		if err == http.ErrNoCookie {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	tknStr := c.Value
-	claims := &Claims{}
-	tkn, err := jwt.ParseWithClaims(tknStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
-
-	if err != nil {
-		if err == jwt.ErrSignatureInvalid {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if !tkn.Valid {
+	session, refreshToken, err := rotateRefreshToken(DB, c.Value, time.Now())
+	if err == errInvalidRefreshToken || err == errRefreshTokenReused {
+		clearTokens(w)
 		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
 		return
 	}
-
-	if time.Unix(claims.ExpiresAt, 0).Sub(time.Now()) > 30*time.Second {
-		w.WriteHeader(http.StatusBadRequest)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	expirationTime := time.Now().Add(5 * time.Minute)
-	claims.ExpiresAt = expirationTime.Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
-	if err != nil {
+	if err := setAccessToken(w, GetUsernameForUser(session.UserID), session.ID); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	setRefreshToken(w, refreshToken, session.ExpiresAt)
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Path:     "/",
-		Value:    tokenString,
-		HttpOnly: true,
-		Expires:  expirationTime,
-	})
+	w.WriteHeader(http.StatusOK)
 }
 
+// Logout revokes the session of the refresh token or of the access token and clears both tokens
+// Access tokens of the session stop being accepted right away, logging out works even after the access token expired
 func Logout(w http.ResponseWriter, r *http.Request) {
-	// logout logic
-	c, err := r.Cookie("token")
-	if err != nil {
-		if err == http.ErrNoCookie {
-			w.WriteHeader(http.StatusUnauthorized)
+	if c, err := r.Cookie(refreshTokenCookie); err == nil {
+		if err := revokeSessionByRefreshToken(c.Value); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		w.WriteHeader(http.StatusBadRequest)
-		return
 	}
 
-	tknStr := c.Value
-	claims := &Claims{}
-	tkn, err := jwt.ParseWithClaims(tknStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
-
-	if err != nil {
-		if err == jwt.ErrSignatureInvalid {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+	if c, err := r.Cookie("token"); err == nil {
+		if claims, err := parseAccessToken(c.Value); err == nil && claims.SessionID != "" {
+			_, err := revokeSessionsNow(func(db *gorm.DB) *gorm.DB {
+				return db.Where(&Session{ID: claims.SessionID})
+			})
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 		}
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if !tkn.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	expirationTime := time.Unix(0, 0)
-	claims.ExpiresAt = expirationTime.Unix()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Path:     "/",
-		Value:    "",
-		HttpOnly: true,
-		Expires:  expirationTime,
-	})
+	clearTokens(w)
+	w.WriteHeader(http.StatusOK)
 }
@@ -1,11 +1,15 @@
 package main
 
 import (
-	"cloud.google.com/go/storage"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -46,26 +50,49 @@ func parsePrivateKey(credsFile io.Reader) []byte {
 	return []byte(creds.PrivateKey)
 }
 
-// GetURLForImage retrieves the url for the image requested
-// If running locally with IsDebug set to true, it will return a normal bucket URL as SignedURLs are difficult to make work with Google Cloud Storage Emulator
-// If running in production with IsDebug set to false, SignedURLs will be returned with a 5 hour expiry
-func GetURLForImage(photo Photo) (string, error) {
-	if IsDebug {
-		return getBucketURLForImage(photo)
+// getEnvOrDefault returns the value of the environment variable, or fallback if it is unset or empty
+func getEnvOrDefault(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// getEnvInt64 parses the environment variable as an integer, or returns fallback if it is unset or empty
+func getEnvInt64(name string, fallback int64) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
 	}
 
-	return getSignedURLForImage(photo)
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// GetURLForImage retrieves the url for the image requested from the storage backend
+// If running locally with IsDebug set to true against the GCS emulator, it will return a normal bucket URL as SignedURLs are difficult to make work with Google Cloud Storage Emulator
+// Otherwise SignedURLs will be returned with a 5 hour expiry
+func GetURLForImage(photo Photo) (string, error) {
+	return GetURLForObject(photo, versionObjectName(photo.ID, photo.Version))
+}
+
+// GetURLForObject retrieves the url for an object stored for the photo, such as one of its renditions
+func GetURLForObject(photo Photo, objectName string) (string, error) {
+	return Store.SignedURL(getBucketForPhoto(photo), objectName, time.Now().Add(5*time.Hour))
 }
 
-func getBucketURLForImage(photo Photo) (string, error) {
-	return "http://localhost:4443/" + getBucketForPhoto(photo) + "/" + photo.ID, nil
+// newOpaqueToken generates a random URL safe token and the hash it is stored under, for tokens such as share links that are looked up by their hash
+func newOpaqueToken() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, hashOpaqueToken(token), nil
 }
 
-func getSignedURLForImage(photo Photo) (string, error) {
-	return storage.SignedURL(getBucketForPhoto(photo), photo.ID, &storage.SignedURLOptions{
-		GoogleAccessID: "cloud-storage-user@shopify-challenge-image-repo.iam.gserviceaccount.com",
-		PrivateKey:     GCPPkey,
-		Method:         "GET",
-		Expires:        time.Now().Add(5 * time.Hour),
-	})
+func hashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -2,8 +2,19 @@ package main
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetPrivateKeyFromGCPCredentialsFile(t *testing.T) {
@@ -33,7 +44,9 @@ func Test_parsePrivateKey(t *testing.T) {
 	// empty private key should panic
 }
 
-func Test_getBucketURLForImage(t *testing.T) {
+func Test_gcsStore_SignedURL_emulator(t *testing.T) {
+	store := &gcsStore{emulator: true}
+
 	user := User{
 		ID:       "6f2fd621-eeb6-4477-86b3-42d986697b43",
 		Username: "testuser",
@@ -46,7 +59,7 @@ func Test_getBucketURLForImage(t *testing.T) {
 		UserID:   user.ID,
 		User:     user,
 	}
-	privateURL, err := getBucketURLForImage(privatePhoto)
+	privateURL, err := store.SignedURL(getBucketForPhoto(privatePhoto), privatePhoto.ID, time.Now().Add(time.Hour))
 	if err != nil {
 		t.Error(err)
 	}
@@ -66,7 +79,7 @@ func Test_getBucketURLForImage(t *testing.T) {
 		UserID:   user.ID,
 		User:     user,
 	}
-	publicURL, err := getBucketURLForImage(publicPhoto)
+	publicURL, err := store.SignedURL(getBucketForPhoto(publicPhoto), publicPhoto.ID, time.Now().Add(time.Hour))
 
 	if publicURL == "" {
 		t.Errorf("url is empty")
@@ -78,6 +91,57 @@ func Test_getBucketURLForImage(t *testing.T) {
 	}
 }
 
-func Test_getSignedURLForImage(t *testing.T) {
+func Test_gcsStore_SignedURL(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := GCPPkey
+	GCPPkey = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	defer func() {
+		GCPPkey = previous
+	}()
+
+	expires := time.Now().Add(time.Hour)
+	signedURL, err := (&gcsStore{}).SignedURL("bucket", "object", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := url.Parse(signedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := parsed.Query()
+	if parsed.Host != "storage.googleapis.com" || parsed.Path != "/bucket/object" || query.Get("GoogleAccessId") == "" || query.Get("Expires") != strconv.FormatInt(expires.Unix(), 10) {
+		t.Fatalf("unexpected signed URL %s", signedURL)
+	}
 
+	// The signature must be a GET of the object until it expires, made with the service account key
+	signature, err := base64.StdEncoding.DecodeString(query.Get("Signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(fmt.Sprintf("GET\n\n\n%d\n/bucket/object", expires.Unix())))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+func Test_newOpaqueToken(t *testing.T) {
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(token) != 43 || tokenHash != hashOpaqueToken(token) || tokenHash == token {
+		t.Errorf("unexpected token %q with hash %q", token, tokenHash)
+	}
+
+	other, _, _ := newOpaqueToken()
+	if other == token {
+		t.Errorf("tokens should not repeat")
+	}
 }
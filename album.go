@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Album is an ordered collection of photos owned by a user
+// A public album can be viewed by anyone, but private photos in it are still only shown to the owner
+type Album struct {
+	ID        string    `json:"AlbumID" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	Title     string    `json:"Title"`
+	// Each album can either be public or private, and is private by default
+	IsPublic bool `json:"IsPublic" gorm:"default:false"`
+	// Each album is owned by a valid user from the users table
+	UserID string       `json:"-" gorm:"index"`
+	User   User         `json:"-"`
+	Photos []AlbumPhoto `json:"-"`
+}
+
+// AlbumPhoto is the membership of a photo in an album, Position orders photos within the album
+type AlbumPhoto struct {
+	AlbumID  string `gorm:"primaryKey"`
+	PhotoID  string `gorm:"primaryKey;index"`
+	Photo    Photo
+	Position int
+}
+
+// AlbumDetails is the response of album endpoints, Items only contains the photos the requesting user may see
+type AlbumDetails struct {
+	Album
+	Username         string     `json:"Username"`
+	IsOwnedByAPIUser bool       `json:"IsOwnedByAPIUser"`
+	Items            []FeedItem `json:"items"`
+}
+
+// albumRequest is the JSON request body of album endpoints, each endpoint only reads the attributes it needs
+type albumRequest struct {
+	ID       string   `json:"AlbumID"`
+	Title    *string  `json:"Title"`
+	IsPublic *bool    `json:"IsPublic"`
+	PhotoIDs []string `json:"PhotoIDs"`
+}
+
+// decodeAlbumRequest decodes the request body, making sure AlbumID is provided unless the album is being created
+func decodeAlbumRequest(r *http.Request, requireID bool) (*albumRequest, error) {
+	var request albumRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return nil, fmt.Errorf("Malformed json")
+	}
+
+	if requireID && request.ID == "" {
+		return nil, fmt.Errorf("AlbumID not provided in request body")
+	}
+
+	if request.Title != nil {
+		title := strings.TrimSpace(*request.Title)
+		if title == "" {
+			return nil, fmt.Errorf("Title must not be empty")
+		}
+		if err := validatePhotoText(title, ""); err != nil {
+			return nil, err
+		}
+		request.Title = &title
+	}
+
+	return &request, nil
+}
+
+// getAlbumOwnedBy retrieves the album with the given ID, making sure it belongs to the user
+// When an error is returned, status is the HTTP status code to respond with
+func getAlbumOwnedBy(albumID string, userID string) (*Album, int, error) {
+	var albums []Album
+	if result := DB.Where(&Album{ID: albumID}).Find(&albums); result.Error != nil {
+		return nil, http.StatusInternalServerError, result.Error
+	}
+
+	if len(albums) == 0 {
+		return nil, http.StatusNotFound, fmt.Errorf("No albums returned")
+	}
+
+	if albums[0].UserID != userID {
+		return nil, http.StatusBadRequest, fmt.Errorf("album does not belong to user")
+	}
+
+	return &albums[0], http.StatusOK, nil
+}
+
+// writeAlbumDetails responds with the album and the photos in it the requesting user may see, in album order
+func writeAlbumDetails(w http.ResponseWriter, album Album, isOwner bool) {
+	var members []AlbumPhoto
+	query := DB.Preload("Photo.Renditions").Preload("Photo.Tags").Where(&AlbumPhoto{AlbumID: album.ID}).Order("position")
+	if result := query.Find(&members); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	details := AlbumDetails{Album: album, Username: GetUsernameForUser(album.UserID), IsOwnedByAPIUser: isOwner, Items: []FeedItem{}}
+	for _, member := range members {
+		// Photos being uploaded or deleted are not shown
+		if member.Photo.State != PhotoStateActive {
+			continue
+		}
+
+		// A public album never reveals private photos to anyone but the owner
+		if !member.Photo.IsPublic && !isOwner {
+			continue
+		}
+
+		item, err := newFeedItem(member.Photo)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		details.Items = append(details.Items, item)
+	}
+
+	response, err := json.Marshal(details)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// CreateAlbum creates a new empty album owned by the user
+func CreateAlbum(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request, err := decodeAlbumRequest(r, false)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if request.Title == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Title not provided in request body"))
+		return
+	}
+
+	album := Album{ID: uuid.New().String(), Title: *request.Title, UserID: *userID}
+	if request.IsPublic != nil {
+		album.IsPublic = *request.IsPublic
+	}
+
+	if result := DB.Create(&album); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	writeAlbumDetails(w, album, true)
+}
+
+// GetAlbumDetails returns an album and its photos, public albums can be viewed by anyone
+func GetAlbumDetails(w http.ResponseWriter, r *http.Request) {
+	request, err := decodeAlbumRequest(r, true)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var album Album
+	DB.Where(&Album{ID: request.ID}).First(&album)
+	if album.ID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("album with id not found"))
+		return
+	}
+
+	isOwner := false
+	if r.Context().Value("IsAuthenticated").(bool) {
+		userID, err := GetUserGUIDFromContext(r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		isOwner = album.UserID == *userID
+	}
+
+	// Private albums are reported as missing to everyone but the owner
+	if !album.IsPublic && !isOwner {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("album with id not found"))
+		return
+	}
+
+	writeAlbumDetails(w, album, isOwner)
+}
+
+// ListAlbums returns all albums owned by the user, newest first
+func ListAlbums(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	albums := []Album{}
+	if result := DB.Where(&Album{UserID: *userID}).Order("created_at DESC").Find(&albums); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	response, err := json.Marshal(albums)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// EditAlbum allows users to rename their albums and change their visibility
+func EditAlbum(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request, err := decodeAlbumRequest(r, true)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	album, status, err := getAlbumOwnedBy(request.ID, *userID)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if request.Title != nil {
+		album.Title = *request.Title
+	}
+
+	if request.IsPublic != nil {
+		album.IsPublic = *request.IsPublic
+	}
+
+	if result := DB.Model(album).Select("Title", "IsPublic").Updates(album); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	writeAlbumDetails(w, *album, true)
+}
+
+// AddAlbumPhotos appends photos owned by the user to the end of their album, photos already in the album are left where they are
+func AddAlbumPhotos(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request, err := decodeAlbumRequest(r, true)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	album, status, err := getAlbumOwnedBy(request.ID, *userID)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Make sure every photo exists and belongs to user before adding any
+	for _, photoID := range request.PhotoIDs {
+		if _, status, err := getPhotoOwnedBy(photoID, *userID); err != nil {
+			w.WriteHeader(status)
+			w.Write([]byte(photoID + ": " + err.Error()))
+			return
+		}
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		var members []AlbumPhoto
+		if err := tx.Where(&AlbumPhoto{AlbumID: album.ID}).Find(&members).Error; err != nil {
+			return err
+		}
+
+		inAlbum := map[string]bool{}
+		position := 0
+		for _, member := range members {
+			inAlbum[member.PhotoID] = true
+			if member.Position >= position {
+				position = member.Position + 1
+			}
+		}
+
+		for _, photoID := range request.PhotoIDs {
+			if inAlbum[photoID] {
+				continue
+			}
+
+			inAlbum[photoID] = true
+			if err := tx.Create(&AlbumPhoto{AlbumID: album.ID, PhotoID: photoID, Position: position}).Error; err != nil {
+				return err
+			}
+			position++
+		}
+
+		return nil
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeAlbumDetails(w, *album, true)
+}
+
+// RemoveAlbumPhotos removes photos from the user's album, the photos themselves are not deleted
+func RemoveAlbumPhotos(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request, err := decodeAlbumRequest(r, true)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	album, status, err := getAlbumOwnedBy(request.ID, *userID)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if len(request.PhotoIDs) > 0 {
+		if result := DB.Where("album_id = ? AND photo_id IN ?", album.ID, request.PhotoIDs).Delete(&AlbumPhoto{}); result.Error != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(result.Error.Error()))
+			return
+		}
+	}
+
+	writeAlbumDetails(w, *album, true)
+}
+
+// ReorderAlbum sets the order of the photos in the user's album, PhotoIDs must list every photo in the album exactly once
+func ReorderAlbum(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request, err := decodeAlbumRequest(r, true)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	album, status, err := getAlbumOwnedBy(request.ID, *userID)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		var members []AlbumPhoto
+		if err := tx.Where(&AlbumPhoto{AlbumID: album.ID}).Find(&members).Error; err != nil {
+			return err
+		}
+
+		if err := validateAlbumOrder(members, request.PhotoIDs); err != nil {
+			return err
+		}
+
+		for position, photoID := range request.PhotoIDs {
+			if err := tx.Model(&AlbumPhoto{}).Where(&AlbumPhoto{AlbumID: album.ID, PhotoID: photoID}).Update("position", position).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err == errInvalidAlbumOrder {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeAlbumDetails(w, *album, true)
+}
+
+var errInvalidAlbumOrder = fmt.Errorf("PhotoIDs must list every photo in the album exactly once")
+
+// validateAlbumOrder makes sure the new order is a permutation of the photos currently in the album
+func validateAlbumOrder(members []AlbumPhoto, photoIDs []string) error {
+	if len(members) != len(photoIDs) {
+		return errInvalidAlbumOrder
+	}
+
+	remaining := map[string]bool{}
+	for _, member := range members {
+		remaining[member.PhotoID] = true
+	}
+
+	for _, photoID := range photoIDs {
+		if !remaining[photoID] {
+			return errInvalidAlbumOrder
+		}
+		delete(remaining, photoID)
+	}
+
+	return nil
+}
+
+// DeleteAlbum deletes the user's album, the photos in it are not deleted
+func DeleteAlbum(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request, err := decodeAlbumRequest(r, true)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	album, status, err := getAlbumOwnedBy(request.ID, *userID)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where(&AlbumPhoto{AlbumID: album.ID}).Delete(&AlbumPhoto{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Delete(album).Error
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("album deleted"))
+}
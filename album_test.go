@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_validateAlbumOrder(t *testing.T) {
+	members := []AlbumPhoto{{PhotoID: "a", Position: 0}, {PhotoID: "b", Position: 1}, {PhotoID: "c", Position: 2}}
+
+	if err := validateAlbumOrder(members, []string{"c", "a", "b"}); err != nil {
+		t.Errorf("permutation should be accepted, got %v", err)
+	}
+
+	for _, order := range [][]string{{"a", "b"}, {"a", "b", "b"}, {"a", "b", "d"}, {"a", "b", "c", "d"}} {
+		if err := validateAlbumOrder(members, order); err != errInvalidAlbumOrder {
+			t.Errorf("%v should be rejected", order)
+		}
+	}
+}
+
+func Test_decodeAlbumRequest(t *testing.T) {
+	request, err := decodeAlbumRequest(httptest.NewRequest("POST", "/album/create", bytes.NewBufferString(`{"Title":"  Holidays "}`)), false)
+	if err != nil || *request.Title != "Holidays" {
+		t.Errorf("title not trimmed, got %v %v", request, err)
+	}
+
+	for _, body := range []string{`{"Title":"Holidays"}`, `{"AlbumID":"a","Title":"   "}`, `not json`} {
+		if _, err := decodeAlbumRequest(httptest.NewRequest("POST", "/album/edit", bytes.NewBufferString(body)), true); err == nil {
+			t.Errorf("%s should be rejected", body)
+		}
+	}
+}
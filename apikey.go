@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scopes an API key can be granted, requests made with an API key may only use the endpoints of its scopes
+const (
+	ScopePhotoRead   = "photo:read"
+	ScopePhotoUpload = "photo:upload"
+	ScopePhotoEdit   = "photo:edit"
+	ScopePhotoDelete = "photo:delete"
+	ScopeAlbumWrite  = "album:write"
+)
+
+var APIKeyScopes = []string{ScopePhotoRead, ScopePhotoUpload, ScopePhotoEdit, ScopePhotoDelete, ScopeAlbumWrite}
+
+// apiKeyPrefix starts every API key so leaked keys are easy to recognize
+const apiKeyPrefix = "irk_"
+
+// lastUsedPrecision is how often the last use of an API key is recorded, so keys used in a loop do not write on every request
+const lastUsedPrecision = time.Minute
+
+const maxAPIKeyLabelLength = 100
+
+var errInvalidAPIKey = fmt.Errorf("API key is invalid or revoked")
+
+// APIKey lets scripts act as the user that created it without logging in, but only on the endpoints of its scopes
+// Only a hash of the key is stored, the key itself is returned once when it is created
+type APIKey struct {
+	ID        string    `json:"KeyID" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	UserID    string    `json:"-" gorm:"index"`
+	User      User      `json:"-"`
+	Label     string    `json:"Label"`
+	// Space separated, as OAuth scopes are
+	Scopes     string     `json:"Scopes"`
+	TokenHash  string     `json:"-" gorm:"uniqueIndex"`
+	LastUsedAt *time.Time `json:"LastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"-"`
+}
+
+// apiKeyRequest is the JSON request body of the API key endpoints
+type apiKeyRequest struct {
+	KeyID  string `json:"KeyID"`
+	Label  string `json:"Label"`
+	Scopes string `json:"Scopes"`
+}
+
+// apiKeyResponse is returned when a key is created, it is the only time the key is revealed
+type apiKeyResponse struct {
+	APIKey
+	Key string `json:"Key"`
+}
+
+// scopedHandler is an endpoint that requests authenticated with an API key may use if the key has its scope
+type scopedHandler struct {
+	scope string
+	next  http.Handler
+}
+
+func (h *scopedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.next.ServeHTTP(w, r)
+}
+
+// RequireScope lets requests authenticated with an API key that has the scope use the endpoint
+// Endpoints not wrapped in RequireScope can only be used by logged in users, whatever the scopes of the key
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return &scopedHandler{scope: scope, next: next}
+}
+
+// normalizeScopes validates space separated scopes and returns them sorted without duplicates
+func normalizeScopes(scopes string) (string, error) {
+	seen := map[string]bool{}
+	var normalized []string
+	for _, scope := range strings.Fields(scopes) {
+		known := false
+		for _, apiKeyScope := range APIKeyScopes {
+			known = known || scope == apiKeyScope
+		}
+		if !known {
+			return "", fmt.Errorf("unknown scope %q, must be one of %s", scope, strings.Join(APIKeyScopes, ", "))
+		}
+
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+
+	if len(normalized) == 0 {
+		return "", fmt.Errorf("at least one scope must be provided")
+	}
+
+	sort.Strings(normalized)
+	return strings.Join(normalized, " "), nil
+}
+
+// hasScope reports whether the space separated scopes include scope
+func hasScope(scopes string, scope string) bool {
+	for _, granted := range strings.Fields(scopes) {
+		if granted == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bearerToken returns the token of an Authorization: Bearer header, if the request has one
+func bearerToken(r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < len("Bearer ") || !strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(authorization[len("Bearer "):]), true
+}
+
+// authenticateAPIKey looks up an API key that has not been revoked, along with the user it belongs to, and records that it was used
+func authenticateAPIKey(key string, now time.Time) (*APIKey, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, errInvalidAPIKey
+	}
+
+	var keys []APIKey
+	if err := DB.Preload("User").Where(&APIKey{TokenHash: hashOpaqueToken(key)}).Where("revoked_at IS NULL").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, errInvalidAPIKey
+	}
+
+	if keys[0].LastUsedAt == nil || keys[0].LastUsedAt.Before(now.Add(-lastUsedPrecision)) {
+		DB.Model(&keys[0]).Update("last_used_at", now)
+	}
+
+	return &keys[0], nil
+}
+
+// authorizeAPIKey authenticates the API key and makes sure it may be used on the endpoint
+// When an error is returned, status is the HTTP status code to respond with
+func authorizeAPIKey(key string, next http.Handler) (*APIKey, int, error) {
+	scoped, ok := next.(*scopedHandler)
+	if !ok {
+		return nil, http.StatusForbidden, fmt.Errorf("this endpoint cannot be used with an API key")
+	}
+
+	apiKey, err := authenticateAPIKey(key, time.Now())
+	if err == errInvalidAPIKey {
+		return nil, http.StatusUnauthorized, err
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if !hasScope(apiKey.Scopes, scoped.scope) {
+		return nil, http.StatusForbidden, fmt.Errorf("API key does not have the %s scope", scoped.scope)
+	}
+
+	return apiKey, http.StatusOK, nil
+}
+
+// CreateAPIKey creates an API key with a label and the scopes it may be used for
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var request apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Malformed json"))
+		return
+	}
+
+	label := strings.TrimSpace(request.Label)
+	if label == "" || len(label) > maxAPIKeyLabelLength {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Label must be between 1 and %d characters", maxAPIKeyLabelLength)))
+		return
+	}
+
+	scopes, err := normalizeScopes(request.Scopes)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	token, _, err := newOpaqueToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	key := apiKeyPrefix + token
+
+	apiKey := APIKey{
+		ID:        uuid.New().String(),
+		UserID:    *userID,
+		Label:     label,
+		Scopes:    scopes,
+		TokenHash: hashOpaqueToken(key),
+	}
+	if result := DB.Create(&apiKey); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	response, err := json.Marshal(apiKeyResponse{APIKey: apiKey, Key: key})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// ListAPIKeys returns the API keys of the user that have not been revoked, without the keys themselves
+func ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	keys := []APIKey{}
+	if result := DB.Where(&APIKey{UserID: *userID}).Where("revoked_at IS NULL").Order("created_at DESC").Find(&keys); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	response, err := json.Marshal(keys)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// RevokeAPIKey stops an API key of the user from working
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var request apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.KeyID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("KeyID not provided in request body"))
+		return
+	}
+
+	result := DB.Model(&APIKey{}).Where(&APIKey{ID: request.KeyID, UserID: *userID}).Where("revoked_at IS NULL").Update("revoked_at", time.Now())
+	if result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("API key with id not found"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("API key revoked"))
+}
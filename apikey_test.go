@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_normalizeScopes(t *testing.T) {
+	tests := []struct {
+		scopes   string
+		expected string
+		wantErr  bool
+	}{
+		{"photo:upload", "photo:upload", false},
+		{" photo:upload  photo:read photo:upload ", "photo:read photo:upload", false},
+		{"photo:upload admin", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scopes, func(t *testing.T) {
+			normalized, err := normalizeScopes(tt.scopes)
+			if (err != nil) != tt.wantErr || normalized != tt.expected {
+				t.Errorf("expected %q (error %v), got %q (%v)", tt.expected, tt.wantErr, normalized, err)
+			}
+		})
+	}
+}
+
+func Test_hasScope(t *testing.T) {
+	if !hasScope("photo:read photo:upload", ScopePhotoUpload) {
+		t.Error("expected photo:upload to be granted")
+	}
+
+	if hasScope("photo:read photo:upload", ScopePhotoDelete) || hasScope("photo:read", "photo") {
+		t.Error("expected only whole scopes that were granted to match")
+	}
+}
+
+func Test_bearerToken(t *testing.T) {
+	tests := []struct {
+		authorization string
+		expected      string
+		ok            bool
+	}{
+		{"Bearer irk_abc", "irk_abc", true},
+		{"bearer irk_abc", "irk_abc", true},
+		{"Basic dXNlcjpwYXNz", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.authorization, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+
+			token, ok := bearerToken(r)
+			if token != tt.expected || ok != tt.ok {
+				t.Errorf("expected %q %v, got %q %v", tt.expected, tt.ok, token, ok)
+			}
+		})
+	}
+}
+
+func Test_APIKeyOnUnscopedEndpoint(t *testing.T) {
+	served := false
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	})
+
+	for name, middleware := range map[string]func(http.Handler) http.Handler{
+		"AuthenticateAndReturnUsername": AuthenticateAndReturnUsername,
+		"DetermineIfAuthenticated":      DetermineIfAuthenticated,
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer irk_abc")
+			recorder := httptest.NewRecorder()
+
+			middleware(handler).ServeHTTP(recorder, r)
+			if recorder.Code != http.StatusForbidden || served {
+				t.Errorf("expected API keys to be refused by endpoints without a scope, got %d", recorder.Code)
+			}
+		})
+	}
+}
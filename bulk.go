@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// maxBulkPhotos caps how many photos a single bulk request may change
+const maxBulkPhotos = 500
+
+// bulkRequest is the JSON request body of the bulk endpoints, IsPublic is only read when changing visibility
+type bulkRequest struct {
+	PhotoIDs []string `json:"PhotoIDs"`
+	IsPublic *bool    `json:"IsPublic"`
+}
+
+// bulkResult is the outcome for one photo of a bulk request, Status is the HTTP status code the single photo endpoint would have returned
+type bulkResult struct {
+	PhotoID string `json:"PhotoID"`
+	Status  int    `json:"Status"`
+	Error   string `json:"Error,omitempty"`
+}
+
+// decodeBulkRequest decodes the request body, dropping duplicate and empty photo IDs
+func decodeBulkRequest(r *http.Request) (*bulkRequest, error) {
+	var request bulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return nil, fmt.Errorf("Malformed json")
+	}
+
+	var photoIDs []string
+	seen := map[string]bool{}
+	for _, photoID := range request.PhotoIDs {
+		if photoID == "" || seen[photoID] {
+			continue
+		}
+		seen[photoID] = true
+		photoIDs = append(photoIDs, photoID)
+	}
+
+	if len(photoIDs) == 0 {
+		return nil, fmt.Errorf("PhotoIDs not provided in request body")
+	}
+
+	if len(photoIDs) > maxBulkPhotos {
+		return nil, fmt.Errorf("at most %d photos can be changed at once", maxBulkPhotos)
+	}
+
+	request.PhotoIDs = photoIDs
+	return &request, nil
+}
+
+// applyBulk runs apply on every photo, a photo failing does not stop the others from being changed
+func applyBulk(photoIDs []string, apply func(photoID string) (int, error)) []bulkResult {
+	results := []bulkResult{}
+	for _, photoID := range photoIDs {
+		result := bulkResult{PhotoID: photoID, Status: http.StatusOK}
+		if status, err := apply(photoID); err != nil {
+			result.Status = status
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func writeBulkResults(w http.ResponseWriter, results []bulkResult) {
+	response, err := json.Marshal(map[string][]bulkResult{"results": results})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// BulkDelete allows users to move many of their photos to the trash at once
+func BulkDelete(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request, err := decodeBulkRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeBulkResults(w, applyBulk(request.PhotoIDs, func(photoID string) (int, error) {
+		return trashPhoto(photoID, *userID)
+	}))
+}
+
+// BulkChangePermissions allows users to make many of their photos public or private at once
+func BulkChangePermissions(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request, err := decodeBulkRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if request.IsPublic == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("IsPublic not provided in request body"))
+		return
+	}
+
+	writeBulkResults(w, applyBulk(request.PhotoIDs, func(photoID string) (int, error) {
+		return setPhotoVisibility(r.Context(), photoID, *userID, *request.IsPublic)
+	}))
+}
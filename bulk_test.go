@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_decodeBulkRequest(t *testing.T) {
+	request, err := decodeBulkRequest(httptest.NewRequest("POST", "/delete/bulk", bytes.NewBufferString(`{"PhotoIDs":["a","","b","a"]}`)))
+	if err != nil || strings.Join(request.PhotoIDs, ",") != "a,b" {
+		t.Errorf("duplicates not dropped, got %v %v", request, err)
+	}
+
+	ids := make([]string, maxBulkPhotos+1)
+	for i := range ids {
+		ids[i] = fmt.Sprintf(`"%d"`, i)
+	}
+	tooMany := `{"PhotoIDs":[` + strings.Join(ids, ",") + `]}`
+
+	for _, body := range []string{`{}`, `{"PhotoIDs":[""]}`, `not json`, tooMany} {
+		if _, err := decodeBulkRequest(httptest.NewRequest("POST", "/delete/bulk", bytes.NewBufferString(body))); err == nil {
+			t.Errorf("%.40s should be rejected", body)
+		}
+	}
+}
+
+func Test_applyBulk(t *testing.T) {
+	results := applyBulk([]string{"a", "b", "c"}, func(photoID string) (int, error) {
+		if photoID == "b" {
+			return http.StatusNotFound, fmt.Errorf("No photos returned")
+		}
+		return http.StatusOK, nil
+	})
+
+	expected := []bulkResult{{"a", 200, ""}, {"b", 404, "No photos returned"}, {"c", 200, ""}}
+	if fmt.Sprint(results) != fmt.Sprint(expected) {
+		t.Errorf("unexpected results %v", results)
+	}
+}
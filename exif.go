@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/rwcarlsen/goexif/exif"
+	"gorm.io/gorm"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// ExifStripMode controls which photos have GPS and other sensitive EXIF tags removed from the stored image, set with EXIF_STRIP in .env
+// "public" (the default) strips public photos, "all" strips every photo and "none" stores images unchanged
+var ExifStripMode = "public"
+
+// PhotoMetadata holds selected EXIF fields extracted from a photo when it was uploaded
+type PhotoMetadata struct {
+	PhotoID      string     `json:"-" gorm:"primaryKey"`
+	CapturedAt   *time.Time `json:"CapturedAt,omitempty"`
+	CameraMake   string     `json:"CameraMake,omitempty"`
+	CameraModel  string     `json:"CameraModel,omitempty"`
+	Orientation  int        `json:"Orientation,omitempty"`
+	LensModel    string     `json:"LensModel,omitempty"`
+	ExposureTime string     `json:"ExposureTime,omitempty"`
+	FNumber      float64    `json:"FNumber,omitempty"`
+	ISO          int        `json:"ISO,omitempty"`
+	FocalLength  float64    `json:"FocalLength,omitempty"`
+	// GPS coordinates are only ever returned to the owner of the photo
+	GPSLatitude  *float64 `json:"GPSLatitude,omitempty"`
+	GPSLongitude *float64 `json:"GPSLongitude,omitempty"`
+}
+
+// shouldStripExif reports whether sensitive EXIF tags must be stripped from a photo with the given visibility
+func shouldStripExif(isPublic bool) bool {
+	switch ExifStripMode {
+	case "all":
+		return true
+	case "none":
+		return false
+	default:
+		return isPublic
+	}
+}
+
+// extractMetadata parses EXIF from a JPEG, TIFF or HEIC image, returning nil if the image carries no EXIF
+func extractMetadata(r io.Reader) (metadata *PhotoMetadata) {
+	// Malformed EXIF should never fail an upload
+	defer func() {
+		if recover() != nil {
+			metadata = nil
+		}
+	}()
+
+	// HEIC images keep their EXIF in an item of the container rather than where the exif package looks for it
+	buffered := bufio.NewReader(r)
+	r = buffered
+	if header, _ := buffered.Peek(64); isHEIC(header) {
+		data, err := ioutil.ReadAll(buffered)
+		if err != nil {
+			return nil
+		}
+
+		tiff, err := extractHEICExif(data)
+		if err != nil || tiff == nil {
+			return nil
+		}
+		r = bytes.NewReader(tiff)
+	}
+
+	x, err := exif.Decode(r)
+	if err != nil {
+		return nil
+	}
+
+	metadata = &PhotoMetadata{}
+	if capturedAt, err := x.DateTime(); err == nil {
+		metadata.CapturedAt = &capturedAt
+	}
+	metadata.CameraMake = exifString(x, exif.Make)
+	metadata.CameraModel = exifString(x, exif.Model)
+	metadata.LensModel = exifString(x, exif.LensModel)
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		metadata.Orientation, _ = tag.Int(0)
+	}
+	if tag, err := x.Get(exif.ExposureTime); err == nil {
+		if num, denom, err := tag.Rat2(0); err == nil {
+			metadata.ExposureTime = fmt.Sprintf("%d/%d", num, denom)
+		}
+	}
+	metadata.FNumber = exifFloat(x, exif.FNumber)
+	metadata.FocalLength = exifFloat(x, exif.FocalLength)
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		metadata.ISO, _ = tag.Int(0)
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		metadata.GPSLatitude = &lat
+		metadata.GPSLongitude = &long
+	}
+
+	return metadata
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+
+	value, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+
+	return string(bytes.TrimRight([]byte(value), "\x00 "))
+}
+
+func exifFloat(x *exif.Exif, name exif.FieldName) float64 {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+
+	value, err := tag.Rat(0)
+	if err != nil {
+		return 0
+	}
+
+	f, _ := value.Float64()
+	return f
+}
+
+// strippedMIMETypes are the formats that may carry EXIF or XMP, which stripSensitiveExif removes sensitive metadata from
+var strippedMIMETypes = map[string]bool{
+	"image/jpeg": true,
+	"image/tiff": true,
+	"image/png":  true,
+	"image/webp": true,
+	"image/heic": true,
+}
+
+// stripSensitiveExif returns a copy of an image with GPS and identifying EXIF tags blanked out
+// Tags are zeroed in place so the rest of the EXIF (e.g. orientation) survives, XMP and IPTC may repeat the location so they are removed entirely
+// Images in formats that do not carry EXIF or XMP are returned unchanged
+func stripSensitiveExif(data []byte, mimeType string) ([]byte, error) {
+	switch mimeType {
+	case "image/jpeg":
+		return stripJPEG(data)
+	case "image/png":
+		return stripPNG(data)
+	case "image/webp":
+		return stripWebP(data)
+	case "image/heic":
+		return stripHEIC(data)
+	case "image/tiff":
+		stripped := append([]byte(nil), data...)
+		if err := scrubTIFF(stripped); err != nil {
+			return nil, err
+		}
+		return stripped, nil
+	default:
+		return data, nil
+	}
+}
+
+// StripError is returned when a stored image cannot be parsed to strip its EXIF, retrying cannot succeed
+type StripError struct {
+	Object string
+	Err    error
+}
+
+func (e *StripError) Error() string {
+	return fmt.Sprintf("unable to strip exif from %s: %v", e.Object, e.Err)
+}
+
+// stripExifFromObject replaces a stored image with a copy that has sensitive EXIF tags stripped and returns its new size
+// Images in formats that do not carry EXIF or XMP are left alone and -1 is returned
+func stripExifFromObject(ctx context.Context, bucket string, object string, mimeType string) (int64, error) {
+	if !strippedMIMETypes[mimeType] {
+		return -1, nil
+	}
+
+	reader, err := Store.Get(ctx, bucket, object)
+	if err != nil {
+		return -1, err
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return -1, err
+	}
+
+	stripped, err := stripSensitiveExif(data, mimeType)
+	if err != nil {
+		return -1, &StripError{Object: object, Err: err}
+	}
+
+	if err := Store.Put(ctx, bucket, object, bytes.NewReader(stripped), int64(len(stripped))); err != nil {
+		return -1, err
+	}
+
+	return int64(len(stripped)), nil
+}
+
+// stripPhotoOriginals strips sensitive EXIF tags from every original of the photo stored in bucket and records their new sizes
+// Originals that are not in the bucket, e.g. of a version still being uploaded, are skipped, Versions must be loaded on the photo
+func stripPhotoOriginals(ctx context.Context, db *gorm.DB, photo Photo, bucket string) error {
+	for _, version := range photoOriginals(photo) {
+		size, err := stripExifFromObject(ctx, bucket, versionObjectName(photo.ID, version.Version), version.MimeType)
+		if err == ErrObjectNotExist {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := recordStrippedSize(db, photo, version, size); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordStrippedSize stores the size of a version after its original was stripped and releases the bytes saved from the quota of the owner
+// The size is only replaced if it has not changed since the version was loaded, so an original stripped twice is released once
+func recordStrippedSize(db *gorm.DB, photo Photo, version PhotoVersion, size int64) error {
+	if size < 0 || size >= version.Size {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Photos uploaded before versions were recorded have their size on the photo only
+		var result *gorm.DB
+		if len(photo.Versions) > 0 {
+			result = tx.Model(&PhotoVersion{}).Where(&PhotoVersion{PhotoID: photo.ID, Version: version.Version}).Where("size = ?", version.Size).Update("size", size)
+		} else {
+			result = tx.Model(&Photo{}).Where(&Photo{ID: photo.ID}).Where("size = ?", version.Size).Update("size", size)
+		}
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		// The photo describes its current version
+		if err := tx.Model(&Photo{}).Where(&Photo{ID: photo.ID, Version: version.Version}).Update("size", size).Error; err != nil {
+			return err
+		}
+
+		return releaseQuota(tx, photo.UserID, version.Size-size, 0)
+	})
+}
+
+// shouldStripShared reports whether the originals of private photos must be stripped before they are shared with anyone other than their owner
+// Shared photos are stripped like public ones, unless EXIF_STRIP already strips every photo or none at all
+func shouldStripShared() bool {
+	return shouldStripExif(true) && !shouldStripExif(false)
+}
+
+// shouldStripPhoto reports whether sensitive EXIF tags must be stripped from a new version of the photo, private photos that are shared included
+func shouldStripPhoto(db *gorm.DB, photo Photo) (bool, error) {
+	if photo.IsPublic || !shouldStripShared() {
+		return shouldStripExif(photo.IsPublic), nil
+	}
+
+	return isPhotoShared(db, photo.ID)
+}
+
+// stripSharedPhoto strips sensitive EXIF tags from the originals of a private photo that is being shared with anyone other than its owner
+// Share links and grants hand out the original image, which must not reveal the location only the owner may see
+func stripSharedPhoto(ctx context.Context, photo Photo) error {
+	if photo.IsPublic || !shouldStripShared() {
+		return nil
+	}
+
+	if err := DB.Where(&PhotoVersion{PhotoID: photo.ID}).Find(&photo.Versions).Error; err != nil {
+		return err
+	}
+
+	return stripPhotoOriginals(ctx, DB, photo, getBucketForPhoto(photo))
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+var xmpHeader = []byte("http://ns.adobe.com/xap/1.0/")
+var xmpExtensionHeader = []byte("http://ns.adobe.com/xmp/extension/")
+
+// stripJPEG walks the JPEG segments up to the start of the image data, scrubbing EXIF segments and dropping XMP and IPTC segments
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, fmt.Errorf("not a jpeg")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, fmt.Errorf("malformed jpeg segment at %d", pos)
+		}
+
+		marker := data[pos+1]
+		// Start of scan, everything from here on is image data
+		if marker == 0xDA {
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, fmt.Errorf("malformed jpeg segment at %d", pos)
+		}
+
+		segment := append([]byte(nil), data[pos:end]...)
+		payload := segment[4:]
+		// Extended XMP continues the XMP segment and the IPTC records of the Photoshop segment have location fields of their own
+		isXMP := bytes.HasPrefix(payload, xmpHeader) || bytes.HasPrefix(payload, xmpExtensionHeader)
+		if (marker == 0xE1 && isXMP) || marker == 0xED {
+			pos = end
+			continue
+		}
+		if marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) {
+			if err := scrubTIFF(payload[len(exifHeader):]); err != nil {
+				return nil, err
+			}
+		}
+
+		out.Write(segment)
+		pos = end
+	}
+
+	out.Write(data[pos:])
+	return out.Bytes(), nil
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripPNG walks the PNG chunks, scrubbing the eXIf chunk and dropping text chunks holding XMP or an EXIF profile
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("not a png")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+	pos := len(pngSignature)
+	for pos < len(data) {
+		if pos+12 > len(data) {
+			return nil, fmt.Errorf("malformed png chunk at %d", pos)
+		}
+
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		end := pos + 12 + length
+		if end > len(data) || end < pos {
+			return nil, fmt.Errorf("malformed png chunk at %d", pos)
+		}
+
+		chunk := append([]byte(nil), data[pos:end]...)
+		chunkType := string(chunk[4:8])
+		payload := chunk[8 : 8+length]
+		if isPNGMetadataText(chunkType, payload) {
+			pos = end
+			continue
+		}
+		if chunkType == "eXIf" {
+			if err := scrubTIFF(payload); err != nil {
+				return nil, err
+			}
+			binary.BigEndian.PutUint32(chunk[8+length:], crc32.ChecksumIEEE(chunk[4:8+length]))
+		}
+
+		out.Write(chunk)
+		pos = end
+
+		// Anything after the end of the image is dropped
+		if chunkType == "IEND" {
+			break
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+// isPNGMetadataText reports whether a PNG text chunk holds XMP or an EXIF profile, its keyword is the text up to the first null byte
+func isPNGMetadataText(chunkType string, payload []byte) bool {
+	if chunkType != "tEXt" && chunkType != "zTXt" && chunkType != "iTXt" {
+		return false
+	}
+
+	keyword := payload
+	if i := bytes.IndexByte(payload, 0); i >= 0 {
+		keyword = payload[:i]
+	}
+
+	return string(keyword) == "XML:com.adobe.xmp" || bytes.HasPrefix(keyword, []byte("Raw profile type"))
+}
+
+// webpXMPFlag is the bit of the VP8X chunk flags announcing an XMP chunk
+const webpXMPFlag = 0x04
+
+// stripWebP walks the RIFF chunks of a WebP image, scrubbing the EXIF chunk and dropping the XMP chunk
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("not a webp")
+	}
+
+	riffEnd := 8 + int(binary.LittleEndian.Uint32(data[4:8]))
+	if riffEnd > len(data) {
+		return nil, fmt.Errorf("truncated webp")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+	pos := 12
+	for pos < riffEnd {
+		if pos+8 > riffEnd {
+			return nil, fmt.Errorf("malformed webp chunk at %d", pos)
+		}
+
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		if pos+8+size > riffEnd || pos+8+size < pos {
+			return nil, fmt.Errorf("malformed webp chunk at %d", pos)
+		}
+
+		// Chunks are padded to an even size
+		end := pos + 8 + size + size%2
+		if end > riffEnd {
+			end = riffEnd
+		}
+
+		chunk := append([]byte(nil), data[pos:end]...)
+		switch string(chunk[:4]) {
+		case "XMP ":
+			pos = end
+			continue
+		case "EXIF":
+			// Some encoders keep the JPEG header in front of the TIFF structure
+			if err := scrubTIFF(bytes.TrimPrefix(chunk[8:8+size], exifHeader)); err != nil {
+				return nil, err
+			}
+		case "VP8X":
+			if size > 0 {
+				chunk[8] &^= webpXMPFlag
+			}
+		}
+
+		out.Write(chunk)
+		pos = end
+	}
+
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	return stripped, nil
+}
+
+// Tags scrubbed from IFD0 and the Exif sub IFD, the whole GPS sub IFD is scrubbed
+const (
+	tagExifIFDPointer     = 0x8769
+	tagGPSIFDPointer      = 0x8825
+	tagMakerNote          = 0x927C
+	tagImageUniqueID      = 0xA420
+	tagCameraOwnerName    = 0xA430
+	tagBodySerialNumber   = 0xA431
+	tagLensSerialNumber   = 0xA435
+	tagCameraSerialNumber = 0xC62F
+)
+
+var sensitiveExifTags = map[uint16]bool{
+	tagMakerNote:          true,
+	tagImageUniqueID:      true,
+	tagCameraOwnerName:    true,
+	tagBodySerialNumber:   true,
+	tagLensSerialNumber:   true,
+	tagCameraSerialNumber: true,
+}
+
+// exifTypeSizes are the sizes in bytes of the TIFF field types
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// tiffScrubber zeroes tags in a TIFF structure in place
+type tiffScrubber struct {
+	data  []byte
+	order binary.ByteOrder
+	// visited guards against IFD offsets pointing back at an IFD already scrubbed
+	visited map[uint32]bool
+}
+
+// scrubTIFF blanks the GPS sub IFD and sensitive tags of a TIFF structure in place
+func scrubTIFF(data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("tiff header too short")
+	}
+
+	s := tiffScrubber{data: data, visited: map[uint32]bool{}}
+	switch string(data[:2]) {
+	case "II":
+		s.order = binary.LittleEndian
+	case "MM":
+		s.order = binary.BigEndian
+	default:
+		return fmt.Errorf("invalid tiff byte order")
+	}
+
+	if s.order.Uint16(data[2:4]) != 42 {
+		return fmt.Errorf("invalid tiff magic number")
+	}
+
+	// Walk IFD0 and any following IFDs, e.g. IFD1 holding the thumbnail
+	offset := s.order.Uint32(data[4:8])
+	for offset != 0 {
+		next, err := s.scrubIFD(offset)
+		if err != nil {
+			return err
+		}
+		offset = next
+	}
+
+	return nil
+}
+
+// scrubIFD scrubs the IFD at offset and returns the offset of the next IFD
+func (s *tiffScrubber) scrubIFD(offset uint32) (uint32, error) {
+	if s.visited[offset] {
+		return 0, nil
+	}
+	s.visited[offset] = true
+
+	count, err := s.entryCount(offset)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < count; i++ {
+		entry := int(offset) + 2 + i*12
+		tag := s.order.Uint16(s.data[entry : entry+2])
+		switch {
+		case tag == tagGPSIFDPointer:
+			if err := s.clearIFD(s.order.Uint32(s.data[entry+8 : entry+12])); err != nil {
+				return 0, err
+			}
+		case tag == tagExifIFDPointer:
+			if _, err := s.scrubIFD(s.order.Uint32(s.data[entry+8 : entry+12])); err != nil {
+				return 0, err
+			}
+		case sensitiveExifTags[tag]:
+			if err := s.zeroValue(entry); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	next := int(offset) + 2 + count*12
+	return s.order.Uint32(s.data[next : next+4]), nil
+}
+
+// clearIFD zeroes the values of every entry in the IFD and then empties it, leaving a valid IFD with no entries
+func (s *tiffScrubber) clearIFD(offset uint32) error {
+	count, err := s.entryCount(offset)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < count; i++ {
+		entry := int(offset) + 2 + i*12
+		if err := s.zeroValue(entry); err != nil {
+			return err
+		}
+
+		for j := entry; j < entry+12; j++ {
+			s.data[j] = 0
+		}
+	}
+
+	s.order.PutUint16(s.data[offset:offset+2], 0)
+	return nil
+}
+
+// entryCount returns the number of entries of the IFD at offset, making sure the entries and the next IFD offset are within bounds
+func (s *tiffScrubber) entryCount(offset uint32) (int, error) {
+	if int(offset)+2 > len(s.data) {
+		return 0, fmt.Errorf("ifd offset out of range")
+	}
+
+	count := int(s.order.Uint16(s.data[offset : offset+2]))
+	if int(offset)+2+count*12+4 > len(s.data) {
+		return 0, fmt.Errorf("ifd entries out of range")
+	}
+
+	return count, nil
+}
+
+// zeroValue zeroes the value of the IFD entry, values of up to 4 bytes are stored in the entry itself, larger ones at an offset
+func (s *tiffScrubber) zeroValue(entry int) error {
+	fieldType := s.order.Uint16(s.data[entry+2 : entry+4])
+	count := int(s.order.Uint32(s.data[entry+4 : entry+8]))
+	size := exifTypeSizes[fieldType] * count
+
+	start, end := entry+8, entry+12
+	if size > 4 {
+		start = int(s.order.Uint32(s.data[entry+8 : entry+12]))
+		end = start + size
+		if start < 0 || end > len(s.data) || end < start {
+			return fmt.Errorf("tag value out of range")
+		}
+	}
+
+	for i := start; i < end; i++ {
+		s.data[i] = 0
+	}
+
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/rwcarlsen/goexif/exif"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// buildTestExif returns a little endian TIFF structure with a camera make, a serial number in the Exif IFD and a GPS location
+func buildTestExif() []byte {
+	data := make([]byte, 184)
+	le := binary.LittleEndian
+	copy(data, "II")
+	le.PutUint16(data[2:], 42)
+	le.PutUint32(data[4:], 8)
+
+	entry := func(offset int, tag uint16, fieldType uint16, count uint32, value uint32) {
+		le.PutUint16(data[offset:], tag)
+		le.PutUint16(data[offset+2:], fieldType)
+		le.PutUint32(data[offset+4:], count)
+		le.PutUint32(data[offset+8:], value)
+	}
+
+	// IFD0 at 8 holding Make and the Exif and GPS IFD pointers
+	le.PutUint16(data[8:], 3)
+	entry(10, 0x010F, 2, 6, 122)
+	entry(22, tagExifIFDPointer, 4, 1, 50)
+	entry(34, tagGPSIFDPointer, 4, 1, 68)
+
+	// Exif IFD at 50 holding BodySerialNumber
+	le.PutUint16(data[50:], 1)
+	entry(52, tagBodySerialNumber, 2, 8, 128)
+
+	// GPS IFD at 68 holding latitude 51° 30' 0" N and longitude 0° 7' 30" E
+	le.PutUint16(data[68:], 4)
+	entry(70, 0x0001, 2, 2, uint32('N'))
+	entry(82, 0x0002, 5, 3, 136)
+	entry(94, 0x0003, 2, 2, uint32('E'))
+	entry(106, 0x0004, 5, 3, 160)
+
+	copy(data[122:], "Canon\x00")
+	copy(data[128:], "SN12345\x00")
+	for i, value := range []uint32{51, 1, 30, 1, 0, 1, 0, 1, 7, 1, 30, 1} {
+		le.PutUint32(data[136+i*4:], value)
+	}
+
+	return data
+}
+
+// jpegSegment encodes a JPEG segment with the given marker
+func jpegSegment(marker byte, payload []byte) []byte {
+	header := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(payload)+2))
+	return append(header, payload...)
+}
+
+// buildTestJPEG returns a JPEG image with the given EXIF and an XMP segment repeating the location
+func buildTestJPEG(t *testing.T, tiff []byte) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	var out []byte
+	out = append(out, encoded[:2]...)
+	out = append(out, jpegSegment(0xE1, append([]byte("Exif\x00\x00"), tiff...))...)
+	out = append(out, jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<exif:GPSLatitude>51,30N</exif:GPSLatitude>"))...)
+	return append(out, encoded[2:]...)
+}
+
+// pngChunk encodes a PNG chunk along with its checksum
+func pngChunk(chunkType string, payload []byte) []byte {
+	chunk := make([]byte, 4, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	chunk = append(append(chunk, chunkType...), payload...)
+	return append(chunk, 0, 0, 0, 0)
+}
+
+// expectStrippedExif checks that the TIFF structure still parses with the camera make kept but the location and serial number removed
+func expectStrippedExif(t *testing.T, tiff []byte) {
+	x, err := exif.Decode(bytes.NewReader(tiff))
+	if err != nil {
+		t.Fatalf("stripped exif no longer parses: %v", err)
+	}
+
+	if _, _, err := x.LatLong(); err == nil {
+		t.Errorf("gps location not removed")
+	}
+
+	if bytes.Contains(tiff, []byte("SN12345")) {
+		t.Errorf("serial number not removed")
+	}
+
+	if exifString(x, exif.Make) != "Canon" {
+		t.Errorf("camera make should be kept")
+	}
+}
+
+func Test_extractMetadata(t *testing.T) {
+	metadata := extractMetadata(bytes.NewReader(buildTestJPEG(t, buildTestExif())))
+	if metadata == nil {
+		t.Fatal("metadata not extracted")
+	}
+
+	if metadata.CameraMake != "Canon" {
+		t.Errorf("camera make not extracted, got %q", metadata.CameraMake)
+	}
+
+	if metadata.GPSLatitude == nil || *metadata.GPSLatitude != 51.5 || metadata.GPSLongitude == nil || *metadata.GPSLongitude != 0.125 {
+		t.Errorf("gps location not extracted")
+	}
+
+	if extractMetadata(bytes.NewReader(encodeTestImage(t, 16, 16))) != nil {
+		t.Errorf("image without exif should have no metadata")
+	}
+}
+
+func Test_stripSensitiveExif(t *testing.T) {
+	original := buildTestJPEG(t, buildTestExif())
+
+	stripped, err := stripSensitiveExif(original, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(stripped, []byte("GPSLatitude")) {
+		t.Errorf("xmp segment not removed")
+	}
+
+	if bytes.Contains(stripped, []byte("SN12345")) {
+		t.Errorf("serial number not removed")
+	}
+
+	metadata := extractMetadata(bytes.NewReader(stripped))
+	if metadata == nil {
+		t.Fatal("non sensitive exif should be kept")
+	}
+
+	if metadata.GPSLatitude != nil || metadata.GPSLongitude != nil {
+		t.Errorf("gps location not removed")
+	}
+
+	if metadata.CameraMake != "Canon" {
+		t.Errorf("camera make should be kept, got %q", metadata.CameraMake)
+	}
+
+	if _, _, err := image.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("stripped image no longer decodes: %v", err)
+	}
+
+	// the original must not be modified in place
+	if !bytes.Contains(original, []byte("SN12345")) {
+		t.Errorf("original image modified")
+	}
+
+	// truncated exif must be rejected rather than stored unstripped
+	if _, err := stripSensitiveExif(buildTestJPEG(t, buildTestExif()[:60]), "image/jpeg"); err == nil {
+		t.Errorf("malformed exif should fail to strip")
+	}
+}
+
+func Test_stripSensitiveExif_jpegExtendedXMPAndIPTC(t *testing.T) {
+	encoded := buildTestJPEG(t, buildTestExif())
+	var original []byte
+	original = append(original, encoded[:2]...)
+	original = append(original, jpegSegment(0xE1, []byte("http://ns.adobe.com/xmp/extension/\x00<exif:GPSLongitude>0,7.5E</exif:GPSLongitude>"))...)
+	original = append(original, jpegSegment(0xED, []byte("Photoshop 3.0\x008BIM\x04\x04\x00\x00\x00\x00\x00\x0a\x1c\x02\x5c\x00\x05Soho"))...)
+	original = append(original, encoded[2:]...)
+
+	stripped, err := stripSensitiveExif(original, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(stripped, []byte("GPSLongitude")) {
+		t.Errorf("extended xmp segment not removed")
+	}
+
+	if bytes.Contains(stripped, []byte("Soho")) {
+		t.Errorf("iptc segment not removed")
+	}
+
+	if _, _, err := image.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("stripped image no longer decodes: %v", err)
+	}
+}
+
+func Test_stripSensitiveExif_png(t *testing.T) {
+	encoded := encodeTestImage(t, 16, 16)
+	exifChunk := pngChunk("eXIf", buildTestExif())
+	binary.BigEndian.PutUint32(exifChunk[len(exifChunk)-4:], crc32.ChecksumIEEE(exifChunk[4:len(exifChunk)-4]))
+
+	// Metadata chunks go right after the signature and the IHDR chunk
+	var original []byte
+	original = append(original, encoded[:33]...)
+	original = append(original, exifChunk...)
+	original = append(original, pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<exif:GPSLatitude>51,30N</exif:GPSLatitude>"))...)
+	original = append(original, pngChunk("zTXt", []byte("Raw profile type exif\x00\x00GPSLongitude"))...)
+	original = append(original, encoded[33:]...)
+
+	stripped, err := stripSensitiveExif(original, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(stripped, []byte("GPSLatitude")) || bytes.Contains(stripped, []byte("GPSLongitude")) {
+		t.Errorf("xmp and exif profile chunks not removed")
+	}
+
+	// The png decoder verifies the checksum of every chunk up to the image data, the scrubbed eXIf chunk included
+	if _, err := png.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("stripped image no longer decodes: %v", err)
+	}
+
+	start := bytes.Index(stripped, []byte("eXIf"))
+	if start < 0 {
+		t.Fatal("eXIf chunk should be kept")
+	}
+	expectStrippedExif(t, stripped[start+4:])
+}
+
+func Test_stripSensitiveExif_webp(t *testing.T) {
+	// A lossless 1x1 image, extended with EXIF and XMP chunks announced in the VP8X flags
+	var original []byte
+	original = append(original, "RIFF\x00\x00\x00\x00WEBP"...)
+	original = append(original, "VP8X\x0a\x00\x00\x00\x0c\x00\x00\x00\x00\x00\x00\x00\x00\x00"...)
+	original = append(original, "VP8L\x0e\x00\x00\x00\x2f\x00\x00\x00\x10\x07\x10\x11\x11\x88\x88\xfe\x07\x00"...)
+	tiff := buildTestExif()
+	original = append(original, "EXIF\x00\x00\x00\x00"...)
+	binary.LittleEndian.PutUint32(original[len(original)-4:], uint32(len(tiff)))
+	original = append(original, tiff...)
+	xmp := "<exif:GPSLatitude>51,30N</exif:GPSLatitude>"
+	original = append(original, "XMP \x00\x00\x00\x00"...)
+	binary.LittleEndian.PutUint32(original[len(original)-4:], uint32(len(xmp)))
+	original = append(original, xmp...)
+	binary.LittleEndian.PutUint32(original[4:8], uint32(len(original)-8))
+
+	stripped, err := stripSensitiveExif(original, "image/webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(stripped, []byte("GPSLatitude")) || stripped[20]&webpXMPFlag != 0 {
+		t.Errorf("xmp chunk not removed")
+	}
+
+	if int(binary.LittleEndian.Uint32(stripped[4:8])) != len(stripped)-8 {
+		t.Errorf("riff size not updated")
+	}
+
+	if _, _, err := image.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("stripped image no longer decodes: %v", err)
+	}
+
+	start := bytes.Index(stripped, []byte("EXIF"))
+	if start < 0 {
+		t.Fatal("EXIF chunk should be kept")
+	}
+	expectStrippedExif(t, stripped[start+8:])
+}
+
+func Test_shouldStripExif(t *testing.T) {
+	defer func(mode string) { ExifStripMode = mode }(ExifStripMode)
+
+	for mode, expected := range map[string][2]bool{"public": {false, true}, "all": {true, true}, "none": {false, false}} {
+		ExifStripMode = mode
+		if shouldStripExif(false) != expected[0] || shouldStripExif(true) != expected[1] {
+			t.Errorf("wrong photos stripped in %s mode", mode)
+		}
+	}
+}
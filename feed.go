@@ -1,49 +1,152 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+// Feeds return defaultFeedLimit items per page unless the client asks for more, up to maxFeedLimit
+const defaultFeedLimit = 20
+const maxFeedLimit = 100
+
 // FeedItem regardless of source
 type FeedItem struct {
 	// Each photo has an unique ID, that allows us to identify it in the users bucket
 	ID       string `json:"PhotoID"`
 	ImageURL string `json:"ImageURL"`
+	// Title, description and tags given to the photo by its owner
+	Title       string `json:"Title"`
+	Description string `json:"Description"`
+	Tags        []Tag  `json:"Tags"`
+	// URLs of downscaled renditions keyed by width, for use in grid views
+	Renditions map[string]string `json:"Renditions"`
+	// Only set on photos in the trash
+	TrashedAt *time.Time `json:"TrashedAt,omitempty"`
+	PurgeAt   *time.Time `json:"PurgeAt,omitempty"`
 }
 
-// GetFeed returns all photos that have public permissions
-// TODO: Pagination of results
-func GetFeed(w http.ResponseWriter, r *http.Request) {
-	// Get array of photos with isPublic set to true
-	var photos []Photo
-	result := DB.Where(&Photo{IsPublic: true}).Find(&photos)
-	if result.Error != nil {
-		w.Write([]byte(result.Error.Error()))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+// FeedPage is a single page of a feed, newest photos first
+// NextCursor is passed back as the cursor query parameter to retrieve the following page, and is empty on the last page
+type FeedPage struct {
+	Items      []FeedItem `json:"items"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// feedCursor identifies the last photo of a page, it is handed to clients as an opaque string
+type feedCursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        string    `json:"id"`
+}
+
+func encodeFeedCursor(photo Photo) string {
+	cursor, _ := json.Marshal(feedCursor{CreatedAt: photo.CreatedAt, ID: photo.ID})
+	return base64.RawURLEncoding.EncodeToString(cursor)
+}
+
+func decodeFeedCursor(value string) (*feedCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	var cursor feedCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil || cursor.ID == "" {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	return &cursor, nil
+}
+
+// parseFeedParams reads the limit and cursor query parameters of a feed request
+func parseFeedParams(r *http.Request) (int, *feedCursor, error) {
+	limit := defaultFeedLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxFeedLimit {
+			return 0, nil, fmt.Errorf("limit must be between 1 and %d", maxFeedLimit)
+		}
+	}
+
+	var cursor *feedCursor
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		var err error
+		cursor, err = decodeFeedCursor(value)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return limit, cursor, nil
+}
+
+// paginatePhotos orders the query newest first and restricts it to the page after cursor
+// One more photo than limit is fetched to find out whether there is a next page
+func paginatePhotos(query *gorm.DB, limit int, cursor *feedCursor) *gorm.DB {
+	if cursor != nil {
+		query = query.Where("(photos.created_at, photos.id) < (?, ?)", cursor.CreatedAt, cursor.ID)
+	}
+
+	return query.Order("photos.created_at DESC, photos.id DESC").Limit(limit + 1)
+}
+
+// newFeedItem builds the feed representation of a photo, Renditions and Tags must be loaded on the photo
+func newFeedItem(photo Photo) (FeedItem, error) {
+	// Get url for the object and its renditions
+	url, err := GetURLForImage(photo)
+	if err != nil {
+		return FeedItem{}, err
+	}
+
+	renditions, err := GetRenditionURLsForImage(photo)
+	if err != nil {
+		return FeedItem{}, err
+	}
+
+	// Insert photo ID, metadata, image url and rendition urls into feed item
+	return FeedItem{
+		ID:          photo.ID,
+		ImageURL:    url,
+		Title:       photo.Title,
+		Description: photo.Description,
+		Tags:        photo.Tags,
+		Renditions:  renditions,
+		TrashedAt:   photo.TrashedAt,
+		PurgeAt:     trashPurgeAt(photo),
+	}, nil
+}
+
+// writeFeedPage responds with the photos fetched by paginatePhotos as a FeedPage, Renditions and Tags must be loaded on the photos
+func writeFeedPage(w http.ResponseWriter, photos []Photo, limit int) {
+	page := FeedPage{Items: []FeedItem{}}
+	if len(photos) > limit {
+		photos = photos[:limit]
+		page.NextCursor = encodeFeedCursor(photos[limit-1])
 	}
 
-	var items []FeedItem
 	// Loop through photos array
 	for _, photo := range photos {
-		// Get url for each object in photos array
-		url, err := GetURLForImage(photo)
-
+		item, err := newFeedItem(photo)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
+			return
 		}
 
-		// Insert photo ID and image url into feed item
-		items = append(items, FeedItem{ID: photo.ID, ImageURL: url})
+		page.Items = append(page.Items, item)
 	}
 
-	// Return array of photo structs via json
-	feed, err := json.Marshal(items)
+	// Return page of photo structs via json
+	feed, err := json.Marshal(page)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
+		return
 	}
 
 	// 200 OK
@@ -52,55 +155,51 @@ func GetFeed(w http.ResponseWriter, r *http.Request) {
 	w.Write(feed)
 }
 
-// GetGallery return all public and private photos owned by the user
-func GetGallery(w http.ResponseWriter, r *http.Request) {
-	// Identify who the user is
-	username := r.Context().Value("username")
-	if username == nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Get user id for query
-	userID, err := GetUserGUID(username.(string))
+// GetFeed returns a page of photos that have public permissions
+func GetFeed(w http.ResponseWriter, r *http.Request) {
+	limit, cursor, err := parseFeedParams(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
 		return
 	}
 
-	// Get array of photos owned by user (public or private)
+	// Get page of photos with isPublic set to true
 	var photos []Photo
-	result := DB.Where(&Photo{UserID: *userID}).Find(&photos)
+	result := paginatePhotos(DB.Preload("Renditions").Preload("Tags").Scopes(activePhotos).Where(&Photo{IsPublic: true}), limit, cursor).Find(&photos)
 	if result.Error != nil {
-		w.Write([]byte(result.Error.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
 		return
 	}
 
-	var items []FeedItem
-	// Loop through photos array
-	for _, photo := range photos {
-		// Get url for each object in photos array
-		url, err := GetURLForImage(photo)
-
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-		}
+	writeFeedPage(w, photos, limit)
+}
 
-		// Insert photo ID and image url into feed item
-		items = append(items, FeedItem{ID: photo.ID, ImageURL: url})
+// GetGallery returns a page of public and private photos owned by the user
+func GetGallery(w http.ResponseWriter, r *http.Request) {
+	limit, cursor, err := parseFeedParams(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
 	}
 
-	// Return array of photo structs via json
-	feed, err := json.Marshal(items)
+	// Identify who the user is
+	userID, err := GetUserGUIDFromContext(r)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		return
 	}
 
-	// 200 OK
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(feed)
+	// Get page of photos owned by user (public or private)
+	var photos []Photo
+	result := paginatePhotos(DB.Preload("Renditions").Preload("Tags").Scopes(activePhotos).Where(&Photo{UserID: *userID}), limit, cursor).Find(&photos)
+	if result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	writeFeedPage(w, photos, limit)
 }
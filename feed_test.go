@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_feedCursor(t *testing.T) {
+	photo := Photo{ID: "f2dcddbf-576c-4816-b3dd-3b20e5faf716", CreatedAt: time.Date(2021, 9, 1, 12, 30, 0, 123456000, time.UTC)}
+
+	cursor, err := decodeFeedCursor(encodeFeedCursor(photo))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cursor.ID != photo.ID || !cursor.CreatedAt.Equal(photo.CreatedAt) {
+		t.Errorf("cursor does not round trip, got %+v", cursor)
+	}
+
+	for _, invalid := range []string{"not base64!", "bm90IGpzb24", "e30"} {
+		if _, err := decodeFeedCursor(invalid); err == nil {
+			t.Errorf("%q should not decode", invalid)
+		}
+	}
+}
+
+func Test_parseFeedParams(t *testing.T) {
+	limit, cursor, err := parseFeedParams(httptest.NewRequest("GET", "/feed/public", nil))
+	if err != nil || limit != defaultFeedLimit || cursor != nil {
+		t.Errorf("defaults not applied, got %d %v %v", limit, cursor, err)
+	}
+
+	next := encodeFeedCursor(Photo{ID: "f2dcddbf-576c-4816-b3dd-3b20e5faf716", CreatedAt: time.Now()})
+	limit, cursor, err = parseFeedParams(httptest.NewRequest("GET", "/feed/public?limit=5&cursor="+next, nil))
+	if err != nil || limit != 5 || cursor == nil {
+		t.Errorf("params not parsed, got %d %v %v", limit, cursor, err)
+	}
+
+	for _, query := range []string{"limit=0", "limit=101", "limit=abc", "cursor=abc"} {
+		if _, _, err := parseFeedParams(httptest.NewRequest("GET", "/feed/public?"+query, nil)); err == nil {
+			t.Errorf("%s should be rejected", query)
+		}
+	}
+}
+
+func Test_writeFeedPage(t *testing.T) {
+	Store = newMemStore()
+
+	now := time.Now()
+	photos := []Photo{
+		{ID: "c", IsPublic: true, CreatedAt: now},
+		{ID: "b", IsPublic: true, CreatedAt: now.Add(-time.Minute)},
+		{ID: "a", IsPublic: true, CreatedAt: now.Add(-2 * time.Minute)},
+	}
+
+	// paginatePhotos fetches one photo more than the limit to detect the next page
+	w := httptest.NewRecorder()
+	writeFeedPage(w, photos, 2)
+	if w.Body.String() != `{"items":[{"PhotoID":"c","ImageURL":"mem://`+PUBLIC_BUCKET_NAME+`/c","Title":"","Description":"","Tags":null,"Renditions":{}},{"PhotoID":"b","ImageURL":"mem://`+PUBLIC_BUCKET_NAME+`/b","Title":"","Description":"","Tags":null,"Renditions":{}}],"next_cursor":"`+encodeFeedCursor(photos[1])+`"}` {
+		t.Errorf("unexpected page %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	writeFeedPage(w, nil, 2)
+	if w.Body.String() != `{"items":[]}` {
+		t.Errorf("empty last page should have no items and no cursor, got %s", w.Body.String())
+	}
+}
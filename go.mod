@@ -6,9 +6,14 @@ require (
 	cloud.google.com/go/storage v1.16.1
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/uuid v1.1.2
+	github.com/jackc/pgconn v1.10.0
 	github.com/jackc/pgx/v4 v4.13.0 // indirect
+	github.com/jdeng/goheif v0.0.0-20200323230657-a0d6a8b3e68f
 	github.com/joho/godotenv v1.4.0
+	github.com/minio/minio-go/v7 v7.0.14
+	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
 	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
 	golang.org/x/text v0.3.7 // indirect
 	google.golang.org/api v0.54.0
 	gorm.io/driver/postgres v1.1.0
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"time"
+)
+
+// Permission levels a grant can give on a photo, edit includes view
+const (
+	GrantView = "view"
+	GrantEdit = "edit"
+)
+
+// PhotoGrant gives a specific user access to a photo owned by someone else, regardless of whether it is public
+type PhotoGrant struct {
+	PhotoID   string    `json:"PhotoID" gorm:"primaryKey"`
+	Photo     Photo     `json:"-"`
+	GranteeID string    `json:"-" gorm:"primaryKey;index"`
+	Grantee   User      `json:"-"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	// Either GrantView or GrantEdit
+	Permission string `json:"Permission"`
+	// For client side use
+	Username string `json:"Username" gorm:"-"`
+}
+
+// grantRequest is the JSON request body of the grant endpoints, Username identifies the grantee
+type grantRequest struct {
+	PhotoID    string `json:"PhotoID"`
+	Username   string `json:"Username"`
+	Permission string `json:"Permission"`
+}
+
+func validGrantPermission(permission string) bool {
+	return permission == GrantView || permission == GrantEdit
+}
+
+// getGrantPermission returns the permission the user was granted on the photo, or an empty string if there is no grant
+func getGrantPermission(photoID string, userID string) (string, error) {
+	var grants []PhotoGrant
+	if result := DB.Where(&PhotoGrant{PhotoID: photoID, GranteeID: userID}).Find(&grants); result.Error != nil {
+		return "", result.Error
+	}
+
+	if len(grants) == 0 {
+		return "", nil
+	}
+
+	return grants[0].Permission, nil
+}
+
+// getPhotoEditableBy retrieves the photo with the given ID, making sure it belongs to the user or the user was granted edit permission
+// When an error is returned, status is the HTTP status code to respond with
+func getPhotoEditableBy(photoID string, userID string) (*Photo, int, error) {
+	photo, status, err := getPhotoOwnedBy(photoID, userID)
+	if status != http.StatusBadRequest {
+		return photo, status, err
+	}
+
+	permission, err := getGrantPermission(photoID, userID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if permission != GrantEdit {
+		return nil, http.StatusBadRequest, fmt.Errorf("photo does not belong to user")
+	}
+
+	var shared Photo
+	if result := DB.Where(&Photo{ID: photoID, State: PhotoStateActive}).First(&shared); result.Error != nil {
+		return nil, http.StatusInternalServerError, result.Error
+	}
+
+	return &shared, http.StatusOK, nil
+}
+
+// decodeGrantRequest decodes the request body and looks up the grantee, who must be an existing user other than the owner
+func decodeGrantRequest(r *http.Request, ownerID string) (*grantRequest, string, error) {
+	var request grantRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return nil, "", fmt.Errorf("Malformed json")
+	}
+
+	if request.PhotoID == "" {
+		return nil, "", fmt.Errorf("PhotoID not provided in request body")
+	}
+
+	if request.Username == "" {
+		return nil, "", fmt.Errorf("Username not provided in request body")
+	}
+
+	granteeID, err := GetUserGUID(request.Username)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if *granteeID == ownerID {
+		return nil, "", fmt.Errorf("photos cannot be shared with their owner")
+	}
+
+	return &request, *granteeID, nil
+}
+
+// GrantAccess shares a photo owned by the user with another user, replacing any permission granted to them before
+func GrantAccess(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request, granteeID, err := decodeGrantRequest(r, *userID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if request.Permission == "" {
+		request.Permission = GrantView
+	}
+
+	if !validGrantPermission(request.Permission) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Permission must be view or edit"))
+		return
+	}
+
+	photo, status, err := getPhotoOwnedBy(request.PhotoID, *userID)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	grant := PhotoGrant{PhotoID: photo.ID, GranteeID: granteeID, Permission: request.Permission}
+	upsert := clause.OnConflict{
+		Columns:   []clause.Column{{Name: "photo_id"}, {Name: "grantee_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"permission"}),
+	}
+	if result := DB.Clauses(upsert).Create(&grant); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	// The grant exists before the photo is stripped, so versions uploaded in the meantime are stripped as they are stored
+	if err := stripSharedPhoto(r.Context(), *photo); err != nil {
+		DB.Where(&PhotoGrant{PhotoID: photo.ID, GranteeID: granteeID}).Delete(&PhotoGrant{})
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("photo has been shared with " + request.Username))
+}
+
+// RevokeAccess stops sharing a photo owned by the user with another user
+func RevokeAccess(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request, granteeID, err := decodeGrantRequest(r, *userID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	photo, status, err := getPhotoOwnedBy(request.PhotoID, *userID)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if result := DB.Where(&PhotoGrant{PhotoID: photo.ID, GranteeID: granteeID}).Delete(&PhotoGrant{}); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("photo is no longer shared with " + request.Username))
+}
+
+// ListGrants returns the users a photo owned by the user is shared with
+func ListGrants(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var request grantRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Malformed json"))
+		return
+	}
+
+	photo, status, err := getPhotoOwnedBy(request.PhotoID, *userID)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	grants := []PhotoGrant{}
+	if result := DB.Preload("Grantee").Where(&PhotoGrant{PhotoID: photo.ID}).Order("created_at").Find(&grants); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	for i := range grants {
+		grants[i].Username = grants[i].Grantee.Username
+	}
+
+	response, err := json.Marshal(grants)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// sharedWithUser restricts a photo query to photos other users have granted the user access to
+func sharedWithUser(query *gorm.DB, userID string) *gorm.DB {
+	return query.Where("photos.id IN (SELECT photo_grants.photo_id FROM photo_grants WHERE photo_grants.grantee_id = ?)", userID)
+}
+
+// GetSharedFeed returns a page of photos other users have shared with the user
+func GetSharedFeed(w http.ResponseWriter, r *http.Request) {
+	limit, cursor, err := parseFeedParams(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var photos []Photo
+	result := paginatePhotos(sharedWithUser(DB.Preload("Renditions").Preload("Tags").Scopes(activePhotos), *userID), limit, cursor).Find(&photos)
+	if result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	writeFeedPage(w, photos, limit)
+}
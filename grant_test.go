@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_validGrantPermission(t *testing.T) {
+	for _, permission := range []string{GrantView, GrantEdit} {
+		if !validGrantPermission(permission) {
+			t.Errorf("%q should be valid", permission)
+		}
+	}
+
+	for _, permission := range []string{"", "owner", "EDIT"} {
+		if validGrantPermission(permission) {
+			t.Errorf("%q should not be valid", permission)
+		}
+	}
+}
+
+// getPhotoDetailsAs requests the details of the photo as the user, returning the status code and the photo if one was returned
+func getPhotoDetailsAs(t *testing.T, user *User, photoID string) (int, Photo) {
+	w := httptest.NewRecorder()
+	GetPhotoDetails(w, requestAs(t, user, "POST", "/photo/details", Photo{ID: photoID}))
+
+	var photo Photo
+	if w.Code == 200 {
+		if err := json.Unmarshal(w.Body.Bytes(), &photo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return w.Code, photo
+}
+
+// editTitleAs changes the title of the photo as the user, returning the status code
+func editTitleAs(t *testing.T, user *User, photoID string, title string) int {
+	w := httptest.NewRecorder()
+	EditMetadata(w, requestAs(t, user, "POST", "/photo/edit", metadataEditRequest{ID: photoID, Title: &title}))
+	return w.Code
+}
+
+// searchAs searches for the query as the user, returning whether the photo is among the results
+func searchAs(t *testing.T, user *User, query string, photoID string) bool {
+	w := httptest.NewRecorder()
+	Search(w, requestAs(t, user, "GET", "/search?q="+query, nil))
+	if w.Code != 200 {
+		t.Fatalf("search failed, got %d %s", w.Code, w.Body.String())
+	}
+
+	var page FeedPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, item := range page.Items {
+		if item.ID == photoID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestGrantAccess(t *testing.T) {
+	useTestDB(t)
+	store := useTestStore(t)
+	defer func(mode string) { ExifStripMode = mode }(ExifStripMode)
+	ExifStripMode = "public"
+
+	owner := createTestUser(t)
+	viewer := createTestUser(t)
+	editor := createTestUser(t)
+	stranger := createTestUser(t)
+	photo := createTestPhoto(t, owner, buildTestJPEG(t, buildTestExif()), false)
+
+	for _, grant := range []grantRequest{{PhotoID: photo.ID, Username: viewer.Username, Permission: GrantView}, {PhotoID: photo.ID, Username: editor.Username, Permission: GrantEdit}} {
+		w := httptest.NewRecorder()
+		GrantAccess(w, requestAs(t, &owner, "POST", "/photo/grant", grant))
+		if w.Code != 200 {
+			t.Fatalf("%s not granted, got %d %s", grant.Permission, w.Code, w.Body.String())
+		}
+	}
+
+	// Grantees see the photo without where it was taken, in the details or the image itself
+	for _, grantee := range []User{viewer, editor} {
+		status, details := getPhotoDetailsAs(t, &grantee, photo.ID)
+		if status != 200 {
+			t.Fatalf("photo not returned to grantee, got %d", status)
+		}
+
+		if details.IsOwnedByAPIUser || details.Metadata == nil || details.Metadata.GPSLatitude != nil {
+			t.Errorf("location of the photo returned to grantee")
+		}
+
+		metadata := extractMetadata(bytes.NewReader(store.fetch(t, details.ImageURL)))
+		if metadata == nil || metadata.GPSLatitude != nil || metadata.GPSLongitude != nil {
+			t.Errorf("image returned to grantee reveals where the photo was taken")
+		}
+	}
+
+	// Only grantees with edit permission may change the photo
+	if status := editTitleAs(t, &viewer, photo.ID, "viewer"); status != 400 {
+		t.Errorf("grantee with view permission should not edit the photo, got %d", status)
+	}
+	if status := editTitleAs(t, &editor, photo.ID, "editor"); status != 200 {
+		t.Errorf("grantee with edit permission should edit the photo, got %d", status)
+	}
+	if _, details := getPhotoDetailsAs(t, &owner, photo.ID); details.Title != "editor" {
+		t.Errorf("title not changed by grantee, got %q", details.Title)
+	}
+
+	// Shared photos show up in the search results of grantees only
+	if !searchAs(t, &viewer, "editor", photo.ID) {
+		t.Errorf("photo shared with grantee missing from search results")
+	}
+	if searchAs(t, &stranger, "editor", photo.ID) || searchAs(t, nil, "editor", photo.ID) {
+		t.Errorf("photo found by search of user it was not shared with")
+	}
+
+	// Users the photo was not shared with see nothing
+	if status, _ := getPhotoDetailsAs(t, &stranger, photo.ID); status != 400 {
+		t.Errorf("photo returned to user it was not shared with, got %d", status)
+	}
+	if status, _ := getPhotoDetailsAs(t, nil, photo.ID); status != 400 {
+		t.Errorf("photo returned to unauthenticated user, got %d", status)
+	}
+	if status := editTitleAs(t, &stranger, photo.ID, "stranger"); status != 400 {
+		t.Errorf("user the photo was not shared with should not edit it, got %d", status)
+	}
+
+	// Revoking the grant takes both viewing and editing away
+	w := httptest.NewRecorder()
+	RevokeAccess(w, requestAs(t, &owner, "POST", "/photo/revoke", grantRequest{PhotoID: photo.ID, Username: editor.Username}))
+	if w.Code != 200 {
+		t.Fatalf("grant not revoked, got %d %s", w.Code, w.Body.String())
+	}
+
+	if status, _ := getPhotoDetailsAs(t, &editor, photo.ID); status != 400 {
+		t.Errorf("photo returned after the grant was revoked, got %d", status)
+	}
+	if status := editTitleAs(t, &editor, photo.ID, "revoked"); status != 400 {
+		t.Errorf("photo edited after the grant was revoked, got %d", status)
+	}
+	if searchAs(t, &editor, "editor", photo.ID) {
+		t.Errorf("photo found by search after the grant was revoked")
+	}
+	if status, _ := getPhotoDetailsAs(t, &viewer, photo.ID); status != 200 {
+		t.Errorf("revoking a grant should not affect other grantees, got %d", status)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/jdeng/goheif"
+	"github.com/jdeng/goheif/heif"
+	"github.com/jdeng/goheif/heif/bmff"
+)
+
+func init() {
+	// Decoded images otherwise point into memory of the decoder, which is freed as soon as decoding returns
+	goheif.SafeEncoding = true
+}
+
+// heicBrands are the ftyp brands of HEIF images encoded with HEVC, HEIF images using other codecs such as AVIF cannot be decoded
+var heicBrands = map[string]bool{"heic": true, "heix": true, "heim": true, "heis": true}
+
+// isHEIC reports whether the leading bytes of a file are the ftyp box of a HEIC image, looking at both its major and compatible brands
+func isHEIC(header []byte) bool {
+	if len(header) < 16 || string(header[4:8]) != "ftyp" {
+		return false
+	}
+
+	end := int(binary.BigEndian.Uint32(header[:4]))
+	if end > len(header) {
+		end = len(header)
+	}
+
+	if heicBrands[string(header[8:12])] {
+		return true
+	}
+
+	// The minor version at 12 is followed by the compatible brands
+	for i := 16; i+4 <= end; i += 4 {
+		if heicBrands[string(header[i:i+4])] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// heicItem is an Exif or XMP item of a HEIC image, Start and End are its offsets in the file
+type heicItem struct {
+	Type  string
+	Start int
+	End   int
+}
+
+// heicMetadataItems returns the Exif and XMP items of a HEIC image
+// Items that are not stored as a single extent of the file itself cannot be scrubbed in place and are reported as an error
+func heicMetadataItems(data []byte) ([]heicItem, error) {
+	reader := bmff.NewReader(bytes.NewReader(data))
+	if _, err := reader.ReadAndParseBox(bmff.TypeFtyp); err != nil {
+		return nil, err
+	}
+
+	box, err := reader.ReadAndParseBox(bmff.TypeMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos *bmff.ItemInfoBox
+	var locations []bmff.ItemLocationBoxEntry
+	for _, child := range box.(*bmff.MetaBox).Children {
+		parsed, err := child.Parse()
+		if err == bmff.ErrUnknownBox {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch parsed := parsed.(type) {
+		case *bmff.ItemInfoBox:
+			infos = parsed
+		case *bmff.ItemLocationBox:
+			locations = parsed.Items
+		}
+	}
+
+	if infos == nil {
+		return nil, nil
+	}
+
+	var items []heicItem
+	for _, info := range infos.ItemInfos {
+		if info.ItemType != "Exif" && !(info.ItemType == "mime" && info.ContentType == "application/rdf+xml") {
+			continue
+		}
+
+		item := heicItem{Type: info.ItemType, Start: -1}
+		for _, location := range locations {
+			if location.ItemID != info.ItemID {
+				continue
+			}
+
+			if location.ConstructionMethod != 0 || location.DataReferenceIndex != 0 || len(location.Extents) != 1 {
+				return nil, fmt.Errorf("heic item %d is not stored as a single extent of the file", info.ItemID)
+			}
+
+			start := location.BaseOffset + location.Extents[0].Offset
+			end := start + location.Extents[0].Length
+			if end < start || end > uint64(len(data)) {
+				return nil, fmt.Errorf("heic item %d out of range", info.ItemID)
+			}
+
+			item.Start, item.End = int(start), int(end)
+		}
+
+		if item.Start < 0 {
+			return nil, fmt.Errorf("heic item %d has no location", info.ItemID)
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// heicExifTIFF returns the TIFF structure of an Exif item, which starts with the offset of the TIFF header within the rest of the item
+func heicExifTIFF(payload []byte) ([]byte, error) {
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("heic exif item too short")
+	}
+
+	start := 4 + uint64(binary.BigEndian.Uint32(payload[:4]))
+	if start > uint64(len(payload)) {
+		return nil, fmt.Errorf("heic exif header out of range")
+	}
+
+	return payload[start:], nil
+}
+
+// extractHEICExif returns the TIFF structure holding the EXIF of a HEIC image, or nil if the image carries no EXIF
+func extractHEICExif(data []byte) ([]byte, error) {
+	items, err := heicMetadataItems(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		if item.Type == "Exif" {
+			return heicExifTIFF(data[item.Start:item.End])
+		}
+	}
+
+	return nil, nil
+}
+
+// stripHEIC returns a copy of a HEIC image with GPS and identifying EXIF tags blanked out and XMP overwritten with whitespace
+// The items are scrubbed in place, as changing their size would mean rewriting the offsets of every item after them
+func stripHEIC(data []byte) (stripped []byte, err error) {
+	// The container parser panics on some malformed boxes
+	defer func() {
+		if recover() != nil {
+			stripped, err = nil, fmt.Errorf("malformed heic")
+		}
+	}()
+
+	stripped = append([]byte(nil), data...)
+	items, err := heicMetadataItems(stripped)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		payload := stripped[item.Start:item.End]
+		if item.Type == "Exif" {
+			tiff, err := heicExifTIFF(payload)
+			if err != nil {
+				return nil, err
+			}
+			if err := scrubTIFF(tiff); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// XMP packets may be padded with whitespace, so blanking the whole packet leaves it empty
+		for i := range payload {
+			payload[i] = ' '
+		}
+	}
+
+	return stripped, nil
+}
+
+// heicOrientations maps the mirroring (none, about the vertical axis or about the horizontal axis) and the counter-clockwise quarter turns of a HEIC image to the matching EXIF orientation
+var heicOrientations = [3][4]int{
+	{1, 8, 3, 6},
+	{2, 7, 4, 5},
+	{4, 5, 2, 7},
+}
+
+// heicOrientation returns the EXIF orientation matching the rotation and mirroring the container of a HEIC image applies to its primary image
+// HEIC images are turned upright by these properties, any orientation in their EXIF is informational only
+func heicOrientation(data []byte) (orientation int, err error) {
+	defer func() {
+		if recover() != nil {
+			orientation, err = 0, fmt.Errorf("malformed heic")
+		}
+	}()
+
+	item, err := heif.Open(bytes.NewReader(data)).PrimaryItem()
+	if err != nil {
+		return 0, err
+	}
+
+	mirror := 0
+	for _, property := range item.Properties {
+		if property, ok := property.(*bmff.ImageMirror); ok {
+			mirror = 1 + int(property.Mirror&1)
+		}
+	}
+
+	return heicOrientations[mirror][item.Rotations()%4], nil
+}
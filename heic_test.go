@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"testing"
+)
+
+// The HEIC fixtures in testdata are real photos:
+// park.heic and rotate.heic are iPhone photos from the heif package of github.com/jdeng/goheif, cut short after the metadata
+// small.heic is a complete 512x512 image from github.com/gen2brain/heic
+func readTestHEIC(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func Test_isHEIC(t *testing.T) {
+	if !isHEIC(readTestHEIC(t, "park.heic")) || !isHEIC(readTestHEIC(t, "small.heic")) {
+		t.Errorf("heic images not recognised")
+	}
+
+	avif := []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf")
+	if isHEIC(avif) || isHEIC(encodeTestImage(t, 16, 16)) {
+		t.Errorf("other formats should not be recognised as heic")
+	}
+}
+
+func Test_validateImage_heic(t *testing.T) {
+	data := readTestHEIC(t, "small.heic")
+	info, err := validateImage(bytes.NewReader(data), int64(len(data)), MaxUploadBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.MimeType != "image/heic" || info.Width != 512 || info.Height != 512 {
+		t.Errorf("image info not recorded properly, got %+v", info)
+	}
+
+	// Other ISO media files are claimed by the heic decoder but must still be rejected
+	avif := append([]byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf"), data[28:]...)
+	if _, err := validateImage(bytes.NewReader(avif), int64(len(avif)), MaxUploadBytes); err == nil {
+		t.Errorf("avif image should be rejected")
+	}
+}
+
+func Test_generateRenditions_heic(t *testing.T) {
+	renditions, err := generateRenditions(bytes.NewReader(readTestHEIC(t, "small.heic")), []int{150, 1280}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rendition := range renditions {
+		// Browsers cannot display the original, so even widths larger than the image get a rendition
+		config, format, err := image.DecodeConfig(bytes.NewReader(rendition.Data))
+		if err != nil {
+			t.Fatalf("rendition %d not encoded: %v", rendition.Width, err)
+		}
+
+		expected := rendition.Width
+		if expected > 512 {
+			expected = 512
+		}
+		if format != "jpeg" || config.Width != expected || config.Height != expected {
+			t.Errorf("rendition %d encoded as %s of %dx%d", rendition.Width, format, config.Width, config.Height)
+		}
+	}
+}
+
+func Test_extractMetadata_heic(t *testing.T) {
+	metadata := extractMetadata(bytes.NewReader(readTestHEIC(t, "park.heic")))
+	if metadata == nil {
+		t.Fatal("metadata not extracted")
+	}
+
+	if metadata.CameraMake != "Apple" {
+		t.Errorf("camera make not extracted, got %q", metadata.CameraMake)
+	}
+
+	if metadata.GPSLatitude == nil || int(*metadata.GPSLatitude*100) != 4763 || metadata.GPSLongitude == nil || int(*metadata.GPSLongitude*100) != -12236 {
+		t.Errorf("gps location not extracted")
+	}
+
+	if extractMetadata(bytes.NewReader(readTestHEIC(t, "small.heic")[:200])) != nil {
+		t.Errorf("truncated heic should have no metadata")
+	}
+}
+
+func Test_stripSensitiveExif_heic(t *testing.T) {
+	original := readTestHEIC(t, "park.heic")
+
+	stripped, err := stripSensitiveExif(original, "image/heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Items are scrubbed in place so the offsets of the image data stay valid
+	if len(stripped) != len(original) {
+		t.Errorf("stripped image changed size from %d to %d bytes", len(original), len(stripped))
+	}
+
+	metadata := extractMetadata(bytes.NewReader(stripped))
+	if metadata == nil {
+		t.Fatal("non sensitive exif should be kept")
+	}
+
+	if metadata.GPSLatitude != nil || metadata.GPSLongitude != nil {
+		t.Errorf("gps location not removed")
+	}
+
+	if metadata.CameraMake != "Apple" {
+		t.Errorf("camera make should be kept, got %q", metadata.CameraMake)
+	}
+
+	if extractMetadata(bytes.NewReader(original)).GPSLatitude == nil {
+		t.Errorf("original image modified")
+	}
+
+	if _, err := stripSensitiveExif(original[:300], "image/heic"); err == nil {
+		t.Errorf("truncated heic should fail to strip")
+	}
+}
+
+func Test_heicOrientation(t *testing.T) {
+	// rotate.heic is turned a quarter clockwise by its container, which EXIF orientation 6 describes
+	for name, expected := range map[string]int{"park.heic": 1, "rotate.heic": 6} {
+		orientation, err := heicOrientation(readTestHEIC(t, name))
+		if err != nil || orientation != expected {
+			t.Errorf("%s: expected orientation %d, got %d %v", name, expected, orientation, err)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxUploadBytes is the largest file in bytes that may be uploaded, set with MAX_UPLOAD_BYTES in .env
+var MaxUploadBytes int64 = 32 << 20
+
+// MaxResumableUploadBytes is the largest image in bytes that may be uploaded through a resumable upload session, set with MAX_RESUMABLE_UPLOAD_BYTES in .env
+var MaxResumableUploadBytes int64 = 256 << 20
+
+// MaxImageWidth and MaxImageHeight are the largest dimensions in pixels an uploaded image may have, set with MAX_IMAGE_WIDTH and MAX_IMAGE_HEIGHT in .env
+// They protect against decompression bombs, small files that decode to huge images
+var MaxImageWidth int64 = 10000
+var MaxImageHeight int64 = 10000
+
+// MaxConcurrentDecodes is how many images may be decoded to generate renditions at once, set with MAX_CONCURRENT_DECODES in .env
+// A decoded image takes 4 bytes per pixel, about 400MB at the default maximum dimensions, so further uploads wait for their turn
+var MaxConcurrentDecodes int64 = 2
+
+// decodeSlots holds a token for every image being decoded, it is sized with MaxConcurrentDecodes at startup
+var decodeSlots = make(chan struct{}, MaxConcurrentDecodes)
+
+// imageFormatMIMETypes maps the formats the image package can decode to their MIME type
+var imageFormatMIMETypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+	"bmp":  "image/bmp",
+	"tiff": "image/tiff",
+	"heic": "image/heic",
+}
+
+// ImageValidationError is returned when an uploaded file is rejected, Status is the HTTP status code to respond with
+type ImageValidationError struct {
+	Status  int
+	Message string
+}
+
+func (e *ImageValidationError) Error() string {
+	return e.Message
+}
+
+// imageInfo describes an uploaded image that passed validation
+type imageInfo struct {
+	MimeType string
+	Width    int
+	Height   int
+	Size     int64
+}
+
+// validateImage makes sure the file is an image in a supported format of at most maxBytes within the configured dimensions
+// Only the header of the image is decoded, so oversized images are rejected before any pixel data is allocated
+// The file is rewound to the start before returning
+func validateImage(file io.ReadSeeker, size int64, maxBytes int64) (*imageInfo, error) {
+	if size > maxBytes {
+		return nil, &ImageValidationError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("file is larger than the maximum of %d bytes", maxBytes)}
+	}
+
+	// Sniff the content type from the leading bytes rather than trusting the client provided one
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, &ImageValidationError{Status: http.StatusBadRequest, Message: "unable to read uploaded file"}
+	}
+	sniffed := http.DetectContentType(header[:n])
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	config, format, err := decodeImageConfig(file)
+	if err != nil {
+		return nil, &ImageValidationError{Status: http.StatusUnsupportedMediaType, Message: "uploaded file is not a supported image"}
+	}
+
+	// DetectContentType recognises neither TIFF nor HEIC, every other format must match what was sniffed
+	// The HEIC decoder claims any ISO media file, so its brand is checked as well
+	mimeType := imageFormatMIMETypes[format]
+	unsniffed := (format == "tiff" || format == "heic") && sniffed == "application/octet-stream"
+	if mimeType == "" || (sniffed != mimeType && !unsniffed) || (format == "heic" && !isHEIC(header[:n])) {
+		return nil, &ImageValidationError{Status: http.StatusUnsupportedMediaType, Message: "uploaded file is not a supported image"}
+	}
+
+	if int64(config.Width) > MaxImageWidth || int64(config.Height) > MaxImageHeight {
+		return nil, &ImageValidationError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("image dimensions must not exceed %dx%d pixels", MaxImageWidth, MaxImageHeight)}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return &imageInfo{MimeType: mimeType, Width: config.Width, Height: config.Height, Size: size}, nil
+}
+
+// decodeImageConfig decodes the header of an image, the HEIC decoder panics on some malformed files instead of returning an error
+func decodeImageConfig(r io.Reader) (config image.Config, format string, err error) {
+	defer func() {
+		if recover() != nil {
+			err = fmt.Errorf("malformed image")
+		}
+	}()
+
+	return image.DecodeConfig(r)
+}
+
+// decodeImage decodes an image, recovering from panics of the HEIC decoder like decodeImageConfig
+func decodeImage(r io.Reader) (img image.Image, format string, err error) {
+	defer func() {
+		if recover() != nil {
+			err = fmt.Errorf("malformed image")
+		}
+	}()
+
+	return image.Decode(r)
+}
+
+// RenditionWidths are the widths in pixels downscaled renditions are generated at for each uploaded photo, set with RENDITION_WIDTHS in .env
+var RenditionWidths = []int{150, 640, 1280}
+
+// Rendition is a downscaled copy of a photo, stored next to the original in the same bucket
+type Rendition struct {
+	ID      uint   `json:"-" gorm:"primaryKey"`
+	PhotoID string `json:"-" gorm:"index"`
+	// Width is the width the rendition was requested at, clients pick renditions by it
+	Width  int `json:"Width"`
+	Height int `json:"Height"`
+	// ObjectName is the name of the object in the photo's bucket, photos narrower than Width reuse the original instead of being upscaled
+	ObjectName string `json:"-"`
+	// Version of the photo the rendition was generated from, renditions of previous versions are kept so they can be reverted to
+	Version int `json:"-" gorm:"default:1"`
+}
+
+// renditionData is an encoded rendition that has not been stored yet
+type renditionData struct {
+	Width  int
+	Height int
+	// Data is nil when the original is used as is
+	Data []byte
+}
+
+// parseRenditionWidths parses a comma separated list of widths, as used for RENDITION_WIDTHS
+func parseRenditionWidths(value string) ([]int, error) {
+	var widths []int
+	for _, field := range strings.Split(value, ",") {
+		width, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || width <= 0 {
+			return nil, fmt.Errorf("invalid rendition width %q", field)
+		}
+
+		widths = append(widths, width)
+	}
+
+	return widths, nil
+}
+
+// renditionObjectName returns the object name a rendition of the photo is stored under
+func renditionObjectName(photoID string, width int) string {
+	return photoID + "_" + strconv.Itoa(width)
+}
+
+// generateRenditions decodes the image and downscales it to each of the widths, preserving the aspect ratio
+// Renditions are turned upright as the EXIF orientation describes, so widths are those of the upright image
+// Images are never upscaled, widths larger than the image get a renditionData without Data so the original is used instead
+// Browsers cannot display HEIC, so HEIC images get a rendition of their full size for those widths instead
+func generateRenditions(src io.Reader, widths []int, orientation int) ([]renditionData, error) {
+	decodeSlots <- struct{}{}
+	defer func() { <-decodeSlots }()
+
+	img, format, err := decodeImage(src)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode image: %v", err)
+	}
+
+	// Downscale from the largest width to the smallest, so each rendition is scaled from the previous, smaller one
+	sorted := append([]int(nil), widths...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+
+	uprightWidth, uprightHeight := img.Bounds().Dx(), img.Bounds().Dy()
+	if orientationSwapsAxes(orientation) {
+		uprightWidth, uprightHeight = uprightHeight, uprightWidth
+	}
+
+	var renditions []renditionData
+	var source image.Image = img
+	for _, width := range sorted {
+		if width >= uprightWidth && format != "heic" {
+			renditions = append(renditions, renditionData{Width: width, Height: uprightHeight})
+			continue
+		}
+
+		renditionWidth := width
+		if renditionWidth > uprightWidth {
+			renditionWidth = uprightWidth
+		}
+
+		height := uprightHeight * renditionWidth / uprightWidth
+		if height < 1 {
+			height = 1
+		}
+
+		// The image is scaled as stored and only the small result is turned upright
+		scaledWidth, scaledHeight := renditionWidth, height
+		if orientationSwapsAxes(orientation) {
+			scaledWidth, scaledHeight = height, renditionWidth
+		}
+
+		scaled := image.NewRGBA(image.Rect(0, 0, scaledWidth, scaledHeight))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), source, source.Bounds(), draw.Over, nil)
+		source = scaled
+
+		data, err := encodeRendition(orientImage(scaled, orientation), format)
+		if err != nil {
+			return nil, err
+		}
+
+		renditions = append(renditions, renditionData{Width: width, Height: height, Data: data})
+	}
+
+	return renditions, nil
+}
+
+// imageOrientation returns the EXIF orientation an image has to be turned upright with, taken from the container of HEIC images
+// The file is rewound to the start before returning
+func imageOrientation(file io.ReadSeeker, mimeType string, metadata *PhotoMetadata) (int, error) {
+	if mimeType != "image/heic" {
+		if metadata == nil {
+			return 0, nil
+		}
+		return metadata.Orientation, nil
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return heicOrientation(data)
+}
+
+// orientationSwapsAxes reports whether turning an image with the EXIF orientation upright rotates it by 90 degrees
+func orientationSwapsAxes(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// orientImage returns a copy of the image rotated and flipped as the EXIF orientation describes, so it displays upright without the tag
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if orientationSwapsAxes(orientation) {
+		width, height = height, width
+	}
+
+	upright := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			var ux, uy int
+			switch orientation {
+			case 2:
+				ux, uy = bounds.Dx()-1-x, y
+			case 3:
+				ux, uy = bounds.Dx()-1-x, bounds.Dy()-1-y
+			case 4:
+				ux, uy = x, bounds.Dy()-1-y
+			case 5:
+				ux, uy = y, x
+			case 6:
+				ux, uy = bounds.Dy()-1-y, x
+			case 7:
+				ux, uy = bounds.Dy()-1-y, bounds.Dx()-1-x
+			case 8:
+				ux, uy = y, bounds.Dx()-1-x
+			}
+			upright.Set(ux, uy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+
+	return upright
+}
+
+// encodeRendition encodes formats that may carry transparency as PNG and everything else as JPEG
+func encodeRendition(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png", "gif", "webp":
+		err = png.Encode(&buf, img)
+	default:
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode rendition: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// photoObjectNames returns the names of every object stored for the photo across all its versions, the originals first
+// Renditions and Versions must be loaded on the photo
+func photoObjectNames(photo Photo) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, version := range photoOriginals(photo) {
+		objectName := versionObjectName(photo.ID, version.Version)
+		if !seen[objectName] {
+			seen[objectName] = true
+			names = append(names, objectName)
+		}
+	}
+
+	for _, rendition := range photo.Renditions {
+		if !seen[rendition.ObjectName] {
+			seen[rendition.ObjectName] = true
+			names = append(names, rendition.ObjectName)
+		}
+	}
+
+	return names
+}
+
+// GetRenditionURLsForImage returns URLs for each rendition of the current version of the photo keyed by width, Renditions must be loaded on the photo
+func GetRenditionURLsForImage(photo Photo) (map[string]string, error) {
+	urls := map[string]string{}
+	for _, rendition := range photo.Renditions {
+		if rendition.Version != photo.Version {
+			continue
+		}
+
+		url, err := GetURLForObject(photo, rendition.ObjectName)
+		if err != nil {
+			return nil, err
+		}
+
+		urls[strconv.Itoa(rendition.Width)] = url
+	}
+
+	return urls, nil
+}
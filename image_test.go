@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+// encodeTestImage returns a PNG encoded image of the given size
+func encodeTestImage(t *testing.T, width int, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, height/2, color.RGBA{R: 255, A: 255})
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func Test_parseRenditionWidths(t *testing.T) {
+	widths, err := parseRenditionWidths("150, 640,1280")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(widths) != 3 || widths[0] != 150 || widths[1] != 640 || widths[2] != 1280 {
+		t.Errorf("widths not parsed properly, got %v", widths)
+	}
+
+	for _, invalid := range []string{"", "abc", "150,,640", "-150", "0"} {
+		if _, err := parseRenditionWidths(invalid); err == nil {
+			t.Errorf("%q should not parse", invalid)
+		}
+	}
+}
+
+func Test_generateRenditions(t *testing.T) {
+	renditions, err := generateRenditions(bytes.NewReader(encodeTestImage(t, 2000, 1000)), []int{150, 4000, 640}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(renditions) != 3 {
+		t.Fatalf("expected 3 renditions, got %d", len(renditions))
+	}
+
+	for _, rendition := range renditions {
+		// widths larger than the image should reuse the original rather than upscale it
+		if rendition.Width == 4000 {
+			if rendition.Data != nil || rendition.Height != 1000 {
+				t.Errorf("image was upscaled")
+			}
+			continue
+		}
+
+		config, format, err := image.DecodeConfig(bytes.NewReader(rendition.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if format != "png" {
+			t.Errorf("png rendition encoded as %s", format)
+		}
+
+		if config.Width != rendition.Width || config.Height != rendition.Width/2 || rendition.Height != config.Height {
+			t.Errorf("rendition %d has wrong dimensions %dx%d", rendition.Width, config.Width, config.Height)
+		}
+	}
+
+	if _, err := generateRenditions(bytes.NewReader([]byte("not an image")), []int{150}, 1); err == nil {
+		t.Errorf("non image should not decode")
+	}
+}
+
+func Test_generateRenditions_orientation(t *testing.T) {
+	// Stored sideways, the image is 100 pixels wide and 200 high once upright
+	renditions, err := generateRenditions(bytes.NewReader(encodeTestImage(t, 200, 100)), []int{50, 150}, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rendition := range renditions {
+		if rendition.Width == 150 {
+			if rendition.Data != nil || rendition.Height != 200 {
+				t.Errorf("upright image was upscaled")
+			}
+			continue
+		}
+
+		config, _, err := image.DecodeConfig(bytes.NewReader(rendition.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if config.Width != 50 || config.Height != 100 || rendition.Height != 100 {
+			t.Errorf("rendition not turned upright, got %dx%d", config.Width, config.Height)
+		}
+	}
+}
+
+func Test_orientImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	first, second := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	img.Set(0, 0, first)
+	img.Set(1, 0, second)
+
+	// Orientation 6 is rotated 90 degrees clockwise to be upright, the left pixel ends up on top
+	upright := orientImage(img, 6)
+	if upright.Bounds().Dx() != 1 || upright.Bounds().Dy() != 2 || upright.At(0, 0) != first || upright.At(0, 1) != second {
+		t.Errorf("image not rotated clockwise")
+	}
+
+	if upright := orientImage(img, 2); upright.At(0, 0) != second || upright.At(1, 0) != first {
+		t.Errorf("image not mirrored")
+	}
+
+	if orientImage(img, 1) != image.Image(img) {
+		t.Errorf("upright image should be returned as is")
+	}
+}
+
+func Test_photoObjectNames(t *testing.T) {
+	photo := Photo{
+		ID: "photo",
+		Renditions: []Rendition{
+			{Width: 150, ObjectName: renditionObjectName("photo", 150)},
+			{Width: 640, ObjectName: "photo"},
+			{Width: 1280, ObjectName: "photo"},
+		},
+	}
+
+	names := photoObjectNames(photo)
+	if len(names) != 2 || names[0] != "photo" || names[1] != "photo_150" {
+		t.Errorf("objects shared between renditions should only be listed once, got %v", names)
+	}
+}
+
+func Test_validateImage(t *testing.T) {
+	data := encodeTestImage(t, 200, 100)
+
+	info, err := validateImage(bytes.NewReader(data), int64(len(data)), MaxUploadBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.MimeType != "image/png" || info.Width != 200 || info.Height != 100 || info.Size != int64(len(data)) {
+		t.Errorf("image info not recorded properly, got %+v", info)
+	}
+
+	expectRejected := func(name string, data []byte, size int64, status int) {
+		_, err := validateImage(bytes.NewReader(data), size, MaxUploadBytes)
+		validationErr, ok := err.(*ImageValidationError)
+		if !ok {
+			t.Errorf("%s should be rejected, got %v", name, err)
+			return
+		}
+
+		if validationErr.Status != status {
+			t.Errorf("%s should be rejected with %d, got %d", name, status, validationErr.Status)
+		}
+	}
+
+	expectRejected("non image", []byte("<html><body>not an image</body></html>"), 38, http.StatusUnsupportedMediaType)
+	expectRejected("truncated image", data[:20], 20, http.StatusUnsupportedMediaType)
+	expectRejected("oversized file", data, MaxUploadBytes+1, http.StatusRequestEntityTooLarge)
+
+	if _, err := validateImage(bytes.NewReader(data), int64(len(data)), int64(len(data))-1); err == nil {
+		t.Errorf("file larger than the given maximum should be rejected")
+	}
+
+	defer func(width int64) { MaxImageWidth = width }(MaxImageWidth)
+	MaxImageWidth = 199
+	expectRejected("oversized image", data, int64(len(data)), http.StatusRequestEntityTooLarge)
+}
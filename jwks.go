@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Access tokens are signed with SigningAlgorithm by a key that is replaced every SigningKeyRotation
+// New keys are published SigningKeyOverlap before they start signing and old keys stay published SigningKeyOverlap after they stop, so services caching the JWKS can always verify our tokens
+var SigningAlgorithm = "EdDSA"
+var SigningKeyRotation = 30 * 24 * time.Hour
+var SigningKeyOverlap = 24 * time.Hour
+
+var errUnknownSigningKey = fmt.Errorf("token is signed with an unknown key")
+var errNoActiveSigningKey = fmt.Errorf("no signing key is active yet")
+
+// SigningKey is a key access tokens are signed with, tokens name the key they were signed with in their kid header
+// Keys are stored PKCS #8 encoded so every server signs with the same keys and rotates them together
+type SigningKey struct {
+	ID          string `gorm:"primaryKey"`
+	CreatedAt   time.Time
+	Algorithm   string
+	PrivateKey  []byte
+	ActivatesAt time.Time `gorm:"index"`
+}
+
+// parsedSigningKey is a SigningKey that is ready to sign and verify tokens
+type parsedSigningKey struct {
+	SigningKey
+	method  jwt.SigningMethod
+	private crypto.PrivateKey
+	public  crypto.PublicKey
+}
+
+// keyring holds the signing keys currently published, ordered by when they activate
+type keyring struct {
+	mu   sync.RWMutex
+	keys []parsedSigningKey
+}
+
+var signingKeys = &keyring{}
+
+// jsonWebKey is the public part of a signing key as published in the JWKS, see RFC 7517 and RFC 8037
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// Set for RSA keys
+	Modulus  string `json:"n,omitempty"`
+	Exponent string `json:"e,omitempty"`
+	// Set for Ed25519 keys, and for EC keys of other parties along with Y
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+func signingMethod(algorithm string) (jwt.SigningMethod, error) {
+	switch algorithm {
+	case "RS256":
+		return jwt.SigningMethodRS256, nil
+	case "EdDSA":
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q, must be RS256 or EdDSA", algorithm)
+	}
+}
+
+// generateSigningKey creates a new key for the algorithm that starts signing tokens at activatesAt
+func generateSigningKey(algorithm string, activatesAt time.Time) (*SigningKey, error) {
+	var private interface{}
+	var err error
+	switch algorithm {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		_, err = signingMethod(algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{ID: uuid.New().String(), Algorithm: algorithm, PrivateKey: der, ActivatesAt: activatesAt}, nil
+}
+
+func parseSigningKey(key SigningKey) (*parsedSigningKey, error) {
+	method, err := signingMethod(key.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := x509.ParsePKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var public crypto.PublicKey
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		if key.Algorithm == "RS256" {
+			public = &private.PublicKey
+		}
+	case ed25519.PrivateKey:
+		if key.Algorithm == "EdDSA" {
+			public = private.Public()
+		}
+	}
+
+	if public == nil {
+		return nil, fmt.Errorf("signing key %s is not a %s key", key.ID, key.Algorithm)
+	}
+
+	return &parsedSigningKey{SigningKey: key, method: method, private: private, public: public}, nil
+}
+
+// nextSigningKeyActivation returns when the next signing key should activate, if it is time to schedule one
+// keys must be ordered by when they activate, a key is scheduled SigningKeyOverlap before the newest one is due for rotation or right away when the algorithm was changed
+func nextSigningKeyActivation(keys []SigningKey, now time.Time) (time.Time, bool) {
+	if len(keys) == 0 {
+		return now, true
+	}
+
+	newest := keys[len(keys)-1]
+	activatesAt := newest.ActivatesAt.Add(SigningKeyRotation)
+	if newest.Algorithm != SigningAlgorithm {
+		activatesAt = now
+	} else if now.Before(activatesAt.Add(-SigningKeyOverlap)) {
+		return time.Time{}, false
+	}
+
+	// Give services caching the JWKS time to pick the key up before tokens are signed with it
+	if earliest := now.Add(SigningKeyOverlap); activatesAt.Before(earliest) {
+		activatesAt = earliest
+	}
+
+	return activatesAt, true
+}
+
+// retiredSigningKeyIDs returns the keys that were replaced more than SigningKeyOverlap ago, every token they signed has expired
+// keys must be ordered by when they activate
+func retiredSigningKeyIDs(keys []SigningKey, now time.Time) []string {
+	var retired []string
+	for i := 0; i+1 < len(keys); i++ {
+		if keys[i+1].ActivatesAt.Add(SigningKeyOverlap).Before(now) {
+			retired = append(retired, keys[i].ID)
+		}
+	}
+
+	return retired
+}
+
+// rotateSigningKeys schedules the next signing key when one is due and deletes the keys that were retired
+func rotateSigningKeys(db *gorm.DB, now time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Keep servers starting or rotating at the same time from each scheduling a key
+		if err := tx.Exec("LOCK TABLE signing_keys IN SHARE ROW EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+
+		var keys []SigningKey
+		if err := tx.Order("activates_at").Find(&keys).Error; err != nil {
+			return err
+		}
+
+		if activatesAt, due := nextSigningKeyActivation(keys, now); due {
+			key, err := generateSigningKey(SigningAlgorithm, activatesAt)
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Create(key).Error; err != nil {
+				return err
+			}
+		}
+
+		if retired := retiredSigningKeyIDs(keys, now); len(retired) > 0 {
+			return tx.Where("id IN ?", retired).Delete(&SigningKey{}).Error
+		}
+
+		return nil
+	})
+}
+
+// load replaces the keys of the keyring with the signing keys stored in the database
+func (k *keyring) load(db *gorm.DB) error {
+	var keys []SigningKey
+	if err := db.Order("activates_at").Find(&keys).Error; err != nil {
+		return err
+	}
+
+	parsed := make([]parsedSigningKey, 0, len(keys))
+	for _, key := range keys {
+		parsedKey, err := parseSigningKey(key)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, *parsedKey)
+	}
+
+	k.mu.Lock()
+	k.keys = parsed
+	k.mu.Unlock()
+
+	return nil
+}
+
+// RunKeyRotation periodically rotates the signing keys and picks up keys scheduled by other servers
+func RunKeyRotation(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if err := rotateSigningKeys(DB, time.Now()); err != nil {
+			fmt.Println("unable to rotate signing keys:", err)
+		}
+
+		if err := signingKeys.load(DB); err != nil {
+			fmt.Println("unable to load signing keys:", err)
+		}
+	}
+}
+
+// sign signs the claims with the key that is active at now
+func (k *keyring) sign(claims jwt.Claims, now time.Time) (string, error) {
+	k.mu.RLock()
+	var active *parsedSigningKey
+	for i := range k.keys {
+		if !k.keys[i].ActivatesAt.After(now) {
+			active = &k.keys[i]
+		}
+	}
+	k.mu.RUnlock()
+
+	if active == nil {
+		return "", errNoActiveSigningKey
+	}
+
+	token := jwt.NewWithClaims(active.method, claims)
+	token.Header["kid"] = active.ID
+	return token.SignedString(active.private)
+}
+
+// verificationKey is the jwt.Keyfunc of tokens signed by the keyring, the key named by the kid header must be published and of the algorithm the token claims
+func (k *keyring) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.ID != kid {
+			continue
+		}
+
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("token is signed with %s but key %s is for %s", token.Method.Alg(), kid, key.method.Alg())
+		}
+
+		return key.public, nil
+	}
+
+	return nil, errUnknownSigningKey
+}
+
+// jwks returns the public parts of every published key, including keys not active yet and keys that were recently replaced
+func (k *keyring) jwks() jsonWebKeySet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := jsonWebKeySet{Keys: []jsonWebKey{}}
+	for _, key := range k.keys {
+		jwk := jsonWebKey{KeyID: key.ID, Use: "sig", Algorithm: key.method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.Modulus = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.Exponent = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set
+}
+
+// publicKey decodes a key published by another party, such as an OIDC provider
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(values ...string) ([][]byte, error) {
+		var decoded [][]byte
+		for _, value := range values {
+			bytes, err := base64.RawURLEncoding.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("key %s is malformed: %v", k.KeyID, err)
+			}
+			decoded = append(decoded, bytes)
+		}
+		return decoded, nil
+	}
+
+	switch {
+	case k.KeyType == "RSA":
+		decoded, err := decode(k.Modulus, k.Exponent)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(decoded[0]), E: int(new(big.Int).SetBytes(decoded[1]).Int64())}, nil
+	case k.KeyType == "OKP" && k.Curve == "Ed25519":
+		decoded, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(decoded[0]) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key %s is malformed", k.KeyID)
+		}
+		return ed25519.PublicKey(decoded[0]), nil
+	case k.KeyType == "EC" && k.Curve == "P-256":
+		decoded, err := decode(k.X, k.Y)
+		if err != nil {
+			return nil, err
+		}
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(decoded[0]), Y: new(big.Int).SetBytes(decoded[1])}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			return nil, fmt.Errorf("key %s is malformed", k.KeyID)
+		}
+		return public, nil
+	default:
+		return nil, fmt.Errorf("key %s is of unsupported type %s %s", k.KeyID, k.KeyType, k.Curve)
+	}
+}
+
+// GetJWKS publishes the keys access tokens are signed with, so other services can verify them without sharing a secret
+func GetJWKS(w http.ResponseWriter, r *http.Request) {
+	response, err := json.Marshal(signingKeys.jwks())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Keys are published well ahead of use, caching the set for a fraction of the overlap is safe
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int((SigningKeyOverlap/4).Seconds())))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
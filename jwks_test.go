@@ -0,0 +1,123 @@
+package main
+
+import (
+	"github.com/golang-jwt/jwt"
+	"testing"
+	"time"
+)
+
+// useTestSigningKey makes the keyring sign with a newly generated key of the algorithm for the rest of the test
+func useTestSigningKey(t *testing.T, algorithm string) *parsedSigningKey {
+	key, err := generateSigningKey(algorithm, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := parseSigningKey(*key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := signingKeys.keys
+	signingKeys.keys = []parsedSigningKey{*parsed}
+	t.Cleanup(func() {
+		signingKeys.keys = previous
+	})
+
+	return parsed
+}
+
+func Test_nextSigningKeyActivation(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		keys     []SigningKey
+		expected time.Time
+		due      bool
+	}{
+		{"no keys", nil, now, true},
+		{"recently rotated", []SigningKey{{Algorithm: SigningAlgorithm, ActivatesAt: now.Add(-time.Hour)}}, time.Time{}, false},
+		{"next key scheduled", []SigningKey{{Algorithm: SigningAlgorithm, ActivatesAt: now.Add(-SigningKeyRotation)}, {Algorithm: SigningAlgorithm, ActivatesAt: now.Add(time.Hour)}}, time.Time{}, false},
+		{"due soon", []SigningKey{{Algorithm: SigningAlgorithm, ActivatesAt: now.Add(time.Hour - SigningKeyRotation)}}, now.Add(SigningKeyOverlap), true},
+		{"overdue", []SigningKey{{Algorithm: SigningAlgorithm, ActivatesAt: now.Add(-2 * SigningKeyRotation)}}, now.Add(SigningKeyOverlap), true},
+		{"algorithm changed", []SigningKey{{Algorithm: "RS256", ActivatesAt: now.Add(-time.Hour)}}, now.Add(SigningKeyOverlap), SigningAlgorithm != "RS256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			activatesAt, due := nextSigningKeyActivation(tt.keys, now)
+			if due != tt.due || (due && !activatesAt.Equal(tt.expected)) {
+				t.Errorf("expected %v %v, got %v %v", tt.expected, tt.due, activatesAt, due)
+			}
+		})
+	}
+}
+
+func Test_retiredSigningKeyIDs(t *testing.T) {
+	now := time.Now()
+	keys := []SigningKey{
+		{ID: "retired", ActivatesAt: now.Add(-2 * SigningKeyRotation)},
+		{ID: "replaced", ActivatesAt: now.Add(-SigningKeyRotation)},
+		{ID: "active", ActivatesAt: now.Add(-time.Minute)},
+		{ID: "scheduled", ActivatesAt: now.Add(time.Hour)},
+	}
+
+	retired := retiredSigningKeyIDs(keys, now)
+	if len(retired) != 1 || retired[0] != "retired" {
+		t.Errorf("expected only the key replaced more than the overlap ago to be retired, got %v", retired)
+	}
+}
+
+func Test_keyring(t *testing.T) {
+	for _, algorithm := range []string{"EdDSA", "RS256"} {
+		t.Run(algorithm, func(t *testing.T) {
+			key := useTestSigningKey(t, algorithm)
+
+			tokenString, err := signingKeys.sign(&Claims{Username: "user"}, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claims := &Claims{}
+			token, err := jwt.ParseWithClaims(tokenString, claims, signingKeys.verificationKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Header["kid"] != key.ID || token.Method.Alg() != algorithm || claims.Username != "user" {
+				t.Errorf("unexpected token %v with claims %+v", token.Header, claims)
+			}
+
+			set := signingKeys.jwks()
+			if len(set.Keys) != 1 || set.Keys[0].KeyID != key.ID || set.Keys[0].Algorithm != algorithm || set.Keys[0].Use != "sig" {
+				t.Errorf("unexpected key set %+v", set)
+			}
+
+			// Tokens must not be accepted when signed with another algorithm than the one of the key they name
+			forged := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{Username: "user"})
+			forged.Header["kid"] = key.ID
+			forgedString, err := forged.SignedString([]byte("secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := jwt.ParseWithClaims(forgedString, &Claims{}, signingKeys.verificationKey); err == nil {
+				t.Error("expected token signed with another algorithm to be rejected")
+			}
+		})
+	}
+}
+
+func Test_keyringWithoutActiveKey(t *testing.T) {
+	key, err := generateSigningKey("EdDSA", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := parseSigningKey(*key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ring := &keyring{keys: []parsedSigningKey{*parsed}}
+	if _, err := ring.sign(&Claims{}, time.Now()); err != errNoActiveSigningKey {
+		t.Errorf("expected keys that are not active yet not to sign, got %v", err)
+	}
+}
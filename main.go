@@ -1,29 +1,23 @@
 package main
 
 import (
-	"cloud.google.com/go/storage"
 	"context"
 	"fmt"
 	"github.com/joho/godotenv"
-	"google.golang.org/api/option"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
-var jwtKey = []byte(os.Getenv("JWT_SECRET"))
-
 var GCPPkey []byte
 
 // DB is the global connection pool for the database connection
 var DB *gorm.DB
 
-// Client is the global connection pool for the GCP SDK
-var Client *storage.Client
-
 var IsDebug bool
 
 // GCPProjectID is the project ID withing GCP, should be passed wherever a project ID is needed as an argument
@@ -50,64 +44,275 @@ func main() {
 		panic("IS_DEBUG in .env must either be \"true\" or \"false\"")
 	}
 
-	// Load GCP private key
-	if !IsDebug {
-		GCPPkey = GetPrivateKeyFromGCPCredentialsFile("gcp-service-acc-creds.json")
+	MaxUploadBytes, err = getEnvInt64("MAX_UPLOAD_BYTES", MaxUploadBytes)
+	if err != nil {
+		panic("MAX_UPLOAD_BYTES in .env must be a number of bytes")
+	}
+
+	MaxResumableUploadBytes, err = getEnvInt64("MAX_RESUMABLE_UPLOAD_BYTES", MaxResumableUploadBytes)
+	if err != nil {
+		panic("MAX_RESUMABLE_UPLOAD_BYTES in .env must be a number of bytes")
+	}
+
+	MaxImageWidth, err = getEnvInt64("MAX_IMAGE_WIDTH", MaxImageWidth)
+	if err != nil {
+		panic("MAX_IMAGE_WIDTH in .env must be a number of pixels")
+	}
+
+	MaxImageHeight, err = getEnvInt64("MAX_IMAGE_HEIGHT", MaxImageHeight)
+	if err != nil {
+		panic("MAX_IMAGE_HEIGHT in .env must be a number of pixels")
+	}
+
+	MaxBatchUploadFiles, err = getEnvInt64("MAX_BATCH_UPLOAD_FILES", MaxBatchUploadFiles)
+	if err != nil || MaxBatchUploadFiles < 1 {
+		panic("MAX_BATCH_UPLOAD_FILES in .env must be a positive number of files")
+	}
+
+	BatchUploadWorkers, err = getEnvInt64("BATCH_UPLOAD_WORKERS", BatchUploadWorkers)
+	if err != nil || BatchUploadWorkers < 1 {
+		panic("BATCH_UPLOAD_WORKERS in .env must be a positive number of workers")
+	}
+
+	MaxConcurrentDecodes, err = getEnvInt64("MAX_CONCURRENT_DECODES", MaxConcurrentDecodes)
+	if err != nil || MaxConcurrentDecodes < 1 {
+		panic("MAX_CONCURRENT_DECODES in .env must be a positive number of images")
+	}
+	decodeSlots = make(chan struct{}, MaxConcurrentDecodes)
+
+	UploadSessionDir = getEnvOrDefault("UPLOAD_SESSION_DIR", UploadSessionDir)
+	if err = os.MkdirAll(UploadSessionDir, 0700); err != nil {
+		panic(err)
+	}
+
+	if ttl := os.Getenv("UPLOAD_SESSION_TTL"); ttl != "" {
+		UploadSessionTTL, err = time.ParseDuration(ttl)
+		if err != nil || UploadSessionTTL <= 0 {
+			panic("UPLOAD_SESSION_TTL in .env must be a duration such as \"24h\"")
+		}
+	}
+
+	if interval := os.Getenv("RECONCILE_INTERVAL"); interval != "" {
+		ReconcileInterval, err = time.ParseDuration(interval)
+		if err != nil || ReconcileInterval < 0 {
+			panic("RECONCILE_INTERVAL in .env must be a duration such as \"24h\", or \"0\" to disable reconciliation")
+		}
+	}
+	ReconcileFix = os.Getenv("RECONCILE_FIX") == "true"
+
+	if ttl := os.Getenv("SESSION_TTL"); ttl != "" {
+		SessionTTL, err = time.ParseDuration(ttl)
+		if err != nil || SessionTTL <= 0 {
+			panic("SESSION_TTL in .env must be a duration such as \"720h\"")
+		}
+	}
+
+	SigningAlgorithm = getEnvOrDefault("JWT_SIGNING_ALGORITHM", SigningAlgorithm)
+	if _, err = signingMethod(SigningAlgorithm); err != nil {
+		panic("JWT_SIGNING_ALGORITHM in .env must be RS256 or EdDSA")
+	}
+
+	if rotation := os.Getenv("JWT_KEY_ROTATION"); rotation != "" {
+		SigningKeyRotation, err = time.ParseDuration(rotation)
+		if err != nil || SigningKeyRotation <= 0 {
+			panic("JWT_KEY_ROTATION in .env must be a duration such as \"720h\"")
+		}
+	}
+
+	if overlap := os.Getenv("JWT_KEY_OVERLAP"); overlap != "" {
+		SigningKeyOverlap, err = time.ParseDuration(overlap)
+		if err != nil {
+			panic("JWT_KEY_OVERLAP in .env must be a duration such as \"24h\"")
+		}
+	}
+	if SigningKeyOverlap < AccessTokenTTL || SigningKeyOverlap >= SigningKeyRotation {
+		panic(fmt.Sprintf("JWT_KEY_OVERLAP in .env must be at least %v and shorter than JWT_KEY_ROTATION", AccessTokenTTL))
+	}
+
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		if os.Getenv("OIDC_CLIENT_ID") == "" {
+			panic("OIDC_CLIENT_ID in .env must be set when OIDC_ISSUER is")
+		}
+		redirectURL := getEnvOrDefault("OIDC_REDIRECT_URL", getEnvOrDefault("PUBLIC_URL", "http://localhost:8080")+"/user/oidc/callback")
+		OIDC = newOIDCProvider(issuer, os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"), redirectURL, getEnvOrDefault("OIDC_SCOPES", "openid email profile"))
+	}
+
+	if retention := os.Getenv("TRASH_RETENTION"); retention != "" {
+		TrashRetention, err = time.ParseDuration(retention)
+		if err != nil || TrashRetention <= 0 {
+			panic("TRASH_RETENTION in .env must be a duration such as \"720h\"")
+		}
+	}
+
+	if tiers := os.Getenv("QUOTA_TIERS"); tiers != "" {
+		QuotaTiers, err = parseQuotaTiers(tiers)
+		if err != nil {
+			panic("QUOTA_TIERS in .env is invalid: " + err.Error())
+		}
+	}
+
+	DefaultQuotaTier = getEnvOrDefault("DEFAULT_QUOTA_TIER", DefaultQuotaTier)
+	if _, ok := QuotaTiers[DefaultQuotaTier]; !ok {
+		panic("DEFAULT_QUOTA_TIER in .env must be one of the tiers in QUOTA_TIERS")
+	}
+
+	for _, userID := range strings.Split(os.Getenv("ADMIN_USER_IDS"), ",") {
+		if userID = strings.TrimSpace(userID); userID != "" {
+			AdminUserIDs[userID] = true
+		}
+	}
+
+	ExifStripMode = getEnvOrDefault("EXIF_STRIP", ExifStripMode)
+	if ExifStripMode != "public" && ExifStripMode != "all" && ExifStripMode != "none" {
+		panic("EXIF_STRIP in .env must either be \"public\", \"all\" or \"none\"")
+	}
+
+	if widths := os.Getenv("RENDITION_WIDTHS"); widths != "" {
+		RenditionWidths, err = parseRenditionWidths(widths)
+		if err != nil {
+			panic("RENDITION_WIDTHS in .env must be a comma separated list of widths in pixels")
+		}
 	}
 
 	// Migrate the schema
-	DB.AutoMigrate(&User{})
-	DB.AutoMigrate(&Photo{})
+	if err = migrateSchema(DB); err != nil {
+		panic(err)
+	}
+	if err = recalculateUsage(DB); err != nil {
+		panic(err)
+	}
 
-	// Connect to Google Cloud SDK
-	ctx := context.Background()
-	if IsDebug {
-		Client, err = storage.NewClient(context.TODO(), option.WithoutAuthentication(), option.WithEndpoint(fmt.Sprintf("http://%s:4443/storage/v1/", os.Getenv("CLOUD_STORAGE_HOST"))))
-	} else {
-		Client, err = storage.NewClient(ctx, option.WithCredentialsFile("gcp-service-acc-creds.json"))
+	// Make sure a signing key is active before issuing any token
+	if err = rotateSigningKeys(DB, time.Now()); err != nil {
+		panic(err)
 	}
+	if err = signingKeys.load(DB); err != nil {
+		panic(err)
+	}
+
+	// Load revoked access tokens before serving any request so none of them is accepted
+	if err = revokedTokens.sync(DB, time.Now()); err != nil {
+		panic(err)
+	}
+
+	// Connect to the storage backend
+	ctx := context.Background()
+	Store, err = NewBlobStore(ctx, os.Getenv("STORAGE_BACKEND"))
 	if err != nil {
 		panic(err)
 	}
 
 	// Make sure public bucket exists and create it if it doesn't
-	// Only run in production as Google Cloud Storage emulator for local development does not support metadata retrieval
 	// TODO: Setup terraform to handle settin up prod environment from scratch
-	if !IsDebug {
-		_, err = Client.Bucket(PUBLIC_BUCKET_NAME).Attrs(ctx)
-		if err == storage.ErrBucketNotExist {
-			bkt := Client.Bucket(PUBLIC_BUCKET_NAME)
-			if err = bkt.Create(ctx, GCPProjectID, nil); err != nil {
-				panic(err)
-			}
-		}
-		if err != nil {
+	exists, err := Store.BucketExists(ctx, PUBLIC_BUCKET_NAME)
+	if err != nil {
+		panic(err)
+	}
+	if !exists {
+		if err = Store.CreateBucket(ctx, PUBLIC_BUCKET_NAME); err != nil {
 			panic(err)
 		}
 	}
 
+	// Run a one off reconciliation instead of the server when started as "reconcile [-fix]"
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		os.Exit(ReconcileCommand(ctx, os.Args[2:]))
+	}
+
+	// Bring storage in line with changes committed to the database, including those interrupted by a crash
+	go RunOutboxWorker(OutboxPollInterval)
+
+	// Periodically look for drift the outbox could not prevent, such as objects written or deleted by hand
+	if ReconcileInterval > 0 {
+		go RunReconciler(ReconcileInterval, ReconcileFix)
+	}
+
+	// Permanently delete photos that have been in the trash for longer than the retention period
+	go RunTrashPurger(TrashPurgeInterval, TrashRetention)
+
+	// Rotate signing keys, checking often enough that keys scheduled by other servers are loaded well before they activate
+	go RunKeyRotation(SigningKeyOverlap / 4)
+
+	// Pick up access tokens revoked by other servers
+	go RunRevocationSync(RevocationSyncInterval)
+
+	// Delete sessions that expired or were revoked
+	go CleanupSessions(time.Hour)
+
+	// Delete resumable uploads that were never finalized
+	go CleanupUploadSessions(time.Hour)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/GetVersion", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("0.1\n"))
 	})
+	mux.HandleFunc("/.well-known/jwks.json", GetJWKS)
 
 	userService := http.NewServeMux()
 	userService.HandleFunc("/signup", Signup)
 	userService.HandleFunc("/authenticate", Authenticate)
 	userService.HandleFunc("/refresh", Refresh)
 	userService.HandleFunc("/logout", Logout)
+	userService.Handle("/oidc/login", DetermineIfAuthenticated(http.HandlerFunc(OIDCLogin))) // logged in users link the identity to their account
+	userService.HandleFunc("/oidc/callback", OIDCCallback)
+	userService.Handle("/logout/all", AuthenticateAndReturnUsername(http.HandlerFunc(LogoutAll)))
+	userService.Handle("/sessions", AuthenticateAndReturnUsername(http.HandlerFunc(ListSessions)))
+	userService.Handle("/sessions/revoke", AuthenticateAndReturnUsername(http.HandlerFunc(RevokeSession)))
+	userService.Handle("/apikeys", AuthenticateAndReturnUsername(http.HandlerFunc(ListAPIKeys)))
+	userService.Handle("/apikeys/create", AuthenticateAndReturnUsername(http.HandlerFunc(CreateAPIKey)))
+	userService.Handle("/apikeys/revoke", AuthenticateAndReturnUsername(http.HandlerFunc(RevokeAPIKey)))
+	userService.Handle("/usage", AuthenticateAndReturnUsername(RequireScope(ScopePhotoRead, http.HandlerFunc(GetUsage))))
+	userService.Handle("/quota", AuthenticateAndReturnUsername(http.HandlerFunc(SetQuotaTier))) // admins only
 	mux.Handle("/user/", http.StripPrefix("/user", userService))
 
 	photoService := http.NewServeMux()
-	photoService.Handle("/upload", AuthenticateAndReturnUsername(http.HandlerFunc(Upload)))
-	photoService.Handle("/edit/permissions", AuthenticateAndReturnUsername(http.HandlerFunc(ChangePermissions)))
-	photoService.Handle("/delete", AuthenticateAndReturnUsername(http.HandlerFunc(Delete)))
-	photoService.Handle("/details", DetermineIfAuthenticated(http.HandlerFunc(GetPhotoDetails)))
+	photoService.Handle("/upload", AuthenticateAndReturnUsername(RequireScope(ScopePhotoUpload, http.HandlerFunc(Upload))))
+	photoService.Handle("/upload/batch", AuthenticateAndReturnUsername(RequireScope(ScopePhotoUpload, http.HandlerFunc(BatchUpload))))
+	photoService.Handle("/upload/resumable", AuthenticateAndReturnUsername(RequireScope(ScopePhotoUpload, http.HandlerFunc(CreateUploadSession))))
+	photoService.Handle("/upload/resumable/", AuthenticateAndReturnUsername(RequireScope(ScopePhotoUpload, http.HandlerFunc(ResumableUpload))))
+	photoService.Handle("/edit/permissions", AuthenticateAndReturnUsername(RequireScope(ScopePhotoEdit, http.HandlerFunc(ChangePermissions))))
+	photoService.Handle("/edit/permissions/bulk", AuthenticateAndReturnUsername(RequireScope(ScopePhotoEdit, http.HandlerFunc(BulkChangePermissions))))
+	photoService.Handle("/edit/metadata", AuthenticateAndReturnUsername(RequireScope(ScopePhotoEdit, http.HandlerFunc(EditMetadata))))
+	photoService.Handle("/delete", AuthenticateAndReturnUsername(RequireScope(ScopePhotoDelete, http.HandlerFunc(Delete))))
+	photoService.Handle("/delete/bulk", AuthenticateAndReturnUsername(RequireScope(ScopePhotoDelete, http.HandlerFunc(BulkDelete))))
+	photoService.Handle("/trash", AuthenticateAndReturnUsername(RequireScope(ScopePhotoRead, http.HandlerFunc(GetTrash))))
+	photoService.Handle("/trash/empty", AuthenticateAndReturnUsername(RequireScope(ScopePhotoDelete, http.HandlerFunc(EmptyTrash))))
+	photoService.Handle("/restore", AuthenticateAndReturnUsername(RequireScope(ScopePhotoEdit, http.HandlerFunc(Restore))))
+	photoService.Handle("/replace", AuthenticateAndReturnUsername(RequireScope(ScopePhotoUpload, http.HandlerFunc(ReplacePhoto))))
+	photoService.Handle("/versions", AuthenticateAndReturnUsername(RequireScope(ScopePhotoRead, http.HandlerFunc(ListVersions))))
+	photoService.Handle("/versions/details", AuthenticateAndReturnUsername(RequireScope(ScopePhotoRead, http.HandlerFunc(GetVersion))))
+	photoService.Handle("/versions/revert", AuthenticateAndReturnUsername(RequireScope(ScopePhotoEdit, http.HandlerFunc(RevertVersion))))
+	photoService.Handle("/details", DetermineIfAuthenticated(RequireScope(ScopePhotoRead, http.HandlerFunc(GetPhotoDetails))))
+	photoService.Handle("/search", DetermineIfAuthenticated(RequireScope(ScopePhotoRead, http.HandlerFunc(Search))))
+	photoService.Handle("/share", AuthenticateAndReturnUsername(http.HandlerFunc(CreateShareLink)))
+	photoService.Handle("/share/list", AuthenticateAndReturnUsername(http.HandlerFunc(ListShareLinks)))
+	photoService.Handle("/share/revoke", AuthenticateAndReturnUsername(http.HandlerFunc(RevokeShareLink)))
+	photoService.Handle("/grant", AuthenticateAndReturnUsername(http.HandlerFunc(GrantAccess)))
+	photoService.Handle("/grant/list", AuthenticateAndReturnUsername(http.HandlerFunc(ListGrants)))
+	photoService.Handle("/grant/revoke", AuthenticateAndReturnUsername(http.HandlerFunc(RevokeAccess)))
+	photoService.HandleFunc("/shared/", GetSharedPhoto) // anyone holding the token of a share link
 	mux.Handle("/photo/", http.StripPrefix("/photo", photoService))
 
+	// Backends that serve objects themselves, rather than handing out URLs to an external service, are mounted on /blob/
+	if blobHandler, ok := Store.(http.Handler); ok {
+		mux.Handle("/blob/", http.StripPrefix("/blob", blobHandler))
+	}
+
+	albumService := http.NewServeMux()
+	albumService.Handle("/create", AuthenticateAndReturnUsername(RequireScope(ScopeAlbumWrite, http.HandlerFunc(CreateAlbum))))
+	albumService.Handle("/list", AuthenticateAndReturnUsername(RequireScope(ScopePhotoRead, http.HandlerFunc(ListAlbums))))
+	albumService.Handle("/edit", AuthenticateAndReturnUsername(RequireScope(ScopeAlbumWrite, http.HandlerFunc(EditAlbum))))
+	albumService.Handle("/photos/add", AuthenticateAndReturnUsername(RequireScope(ScopeAlbumWrite, http.HandlerFunc(AddAlbumPhotos))))
+	albumService.Handle("/photos/remove", AuthenticateAndReturnUsername(RequireScope(ScopeAlbumWrite, http.HandlerFunc(RemoveAlbumPhotos))))
+	albumService.Handle("/photos/reorder", AuthenticateAndReturnUsername(RequireScope(ScopeAlbumWrite, http.HandlerFunc(ReorderAlbum))))
+	albumService.Handle("/delete", AuthenticateAndReturnUsername(RequireScope(ScopeAlbumWrite, http.HandlerFunc(DeleteAlbum))))
+	albumService.Handle("/details", DetermineIfAuthenticated(RequireScope(ScopePhotoRead, http.HandlerFunc(GetAlbumDetails))))
+	mux.Handle("/album/", http.StripPrefix("/album", albumService))
+
 	feedService := http.NewServeMux()
-	feedService.HandleFunc("/public", GetFeed)                                               // public photos from all users
-	feedService.Handle("/home", AuthenticateAndReturnUsername(http.HandlerFunc(GetGallery))) // all photos uploaded by user (public + private)
+	feedService.HandleFunc("/public", GetFeed)                                                                                  // public photos from all users
+	feedService.Handle("/home", AuthenticateAndReturnUsername(RequireScope(ScopePhotoRead, http.HandlerFunc(GetGallery))))      // all photos uploaded by user (public + private)
+	feedService.Handle("/shared", AuthenticateAndReturnUsername(RequireScope(ScopePhotoRead, http.HandlerFunc(GetSharedFeed)))) // photos other users shared with user
 	mux.Handle("/feed/", http.StripPrefix("/feed", feedService))
 
 	s := http.Server{
@@ -126,3 +331,47 @@ func main() {
 		}
 	}
 }
+
+// migrateSchema creates or updates every table, index and search index used by image-repo
+func migrateSchema(db *gorm.DB) error {
+	models := []interface{}{
+		&User{},
+		&Tag{},
+		&Photo{},
+		&Rendition{},
+		&PhotoMetadata{},
+		&Album{},
+		&AlbumPhoto{},
+		&ShareLink{},
+		&PhotoGrant{},
+		&UploadSession{},
+		&OutboxEvent{},
+		&PhotoVersion{},
+		&Session{},
+		&RefreshToken{},
+		&AccessToken{},
+		&RevokedToken{},
+		&SigningKey{},
+		&APIKey{},
+		&ExternalIdentity{},
+		&OIDCLoginAttempt{},
+	}
+	// Usernames were not unique before, users sharing one have to be renamed by hand before the unique index can be created
+	if db.Migrator().HasTable(&User{}) {
+		var duplicates []string
+		if err := db.Model(&User{}).Group("username").Having("count(*) > 1").Pluck("username", &duplicates).Error; err != nil {
+			return err
+		}
+		if len(duplicates) > 0 {
+			return fmt.Errorf("usernames %q are shared by several users, rename all but one user of each before starting the server", duplicates)
+		}
+	}
+
+	for _, model := range models {
+		if err := db.AutoMigrate(model); err != nil {
+			return err
+		}
+	}
+
+	return migrateSearchIndex(db)
+}
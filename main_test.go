@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// useTestDB points DB at the database of TEST_DATABASE_DSN for the duration of the test, migrating it first
+// Tests using it are skipped when it is not set, e.g. to run them against the postgres service in docker-compose.yml:
+// TEST_DATABASE_DSN="host=localhost user=postgres password=secret dbname=image-repo-test sslmode=disable" go test
+func useTestDB(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: dsn, PreferSimpleProtocol: true}), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := DB
+	DB = db
+	t.Cleanup(func() { DB = previous })
+}
+
+// createTestUser registers a user with a unique username and creates their bucket in Store, the user is deleted after the test
+func createTestUser(t *testing.T) User {
+	user := User{ID: uuid.New().String(), Username: "test-" + uuid.New().String()[:8]}
+	if err := DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Delete(&user) })
+
+	if err := Store.CreateBucket(context.Background(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+// createTestPhoto registers an active JPEG photo owned by the user and stores data as its original, the photo is deleted after the test
+func createTestPhoto(t *testing.T, owner User, data []byte, isPublic bool) Photo {
+	size := int64(len(data))
+	photo := Photo{
+		ID:       uuid.New().String(),
+		IsPublic: isPublic,
+		MimeType: "image/jpeg",
+		Width:    16,
+		Height:   16,
+		Size:     size,
+		UserID:   owner.ID,
+		State:    PhotoStateActive,
+		Version:  1,
+		Versions: []PhotoVersion{{Version: 1, MimeType: "image/jpeg", Width: 16, Height: 16, Size: size, State: PhotoStateActive}},
+		Metadata: extractMetadata(bytes.NewReader(data)),
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := reserveQuota(tx, owner.ID, size, 1); err != nil {
+			return err
+		}
+
+		return tx.Create(&photo).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { deletePhotoRows(DB, photo) })
+
+	if err := Store.Put(context.Background(), getBucketForPhoto(photo), photo.ID, bytes.NewReader(data), size); err != nil {
+		t.Fatal(err)
+	}
+
+	return photo
+}
+
+// requestAs returns a request with body encoded as JSON, authenticated as the user the way AuthenticateAndReturnUsername and DetermineIfAuthenticated do
+// A nil user makes an unauthenticated request
+func requestAs(t *testing.T, user *User, method string, path string, body interface{}) *http.Request {
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(method, path, bytes.NewReader(data))
+	if user == nil {
+		return r.WithContext(context.WithValue(r.Context(), "IsAuthenticated", false))
+	}
+
+	ctx := context.WithValue(r.Context(), "IsAuthenticated", true)
+	return r.WithContext(context.WithValue(ctx, "username", user.Username))
+}
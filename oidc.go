@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDC is the OpenID Connect provider users can log in with, it is nil when OIDC_ISSUER is not set
+var OIDC *oidcProvider
+
+// oidcLoginTimeout is how long a user has to log in with the provider once they were sent to it
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidcUsernameAttempts is how many usernames are tried when registering a user on their first OIDC login
+const oidcUsernameAttempts = 3
+
+// oidcStateCookie binds a login to the browser that started it, so a callback forged by someone else cannot complete it
+const oidcStateCookie = "oidc_state"
+
+// oidcKeyRefetchInterval limits how often the provider's keys are fetched again when a token names an unknown key
+const oidcKeyRefetchInterval = time.Minute
+
+var errOIDCLoginUsed = fmt.Errorf("login is unknown, expired or was already completed, start the login again")
+
+// ExternalIdentity links an account of an OIDC provider to a user, the account is identified by the issuer and subject of its ID tokens
+type ExternalIdentity struct {
+	ID          uint `gorm:"primaryKey"`
+	CreatedAt   time.Time
+	Issuer      string `gorm:"uniqueIndex:idx_external_identity"`
+	Subject     string `gorm:"uniqueIndex:idx_external_identity"`
+	UserID      string `gorm:"index"`
+	User        User
+	Email       string
+	LastLoginAt time.Time
+}
+
+// OIDCLoginAttempt is a login that was sent to the provider and has not come back yet
+// It is stored under a hash of its state parameter and can only be completed once
+type OIDCLoginAttempt struct {
+	ID           string `gorm:"primaryKey"`
+	Nonce        string
+	CodeVerifier string
+	// Set when a logged in user is linking an identity to their account instead of logging in
+	UserID    string
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// oidcProviderConfig is the part of the provider's discovery document the login flow uses
+type oidcProviderConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider is an OpenID Connect provider we are a client of, its configuration and keys are fetched on first use
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       string
+	client       *http.Client
+
+	mu            sync.Mutex
+	config        *oidcProviderConfig
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+// audience is the aud claim, which is either a single string or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(value string) bool {
+	for _, item := range a {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// idTokenClaims are the claims of an ID token the login flow uses
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp,omitempty"`
+	ExpiresAt         int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+}
+
+// Valid implements jwt.Claims, ID tokens are validated by verifyIDToken instead
+func (c *idTokenClaims) Valid() error {
+	return nil
+}
+
+func newOIDCProvider(issuer string, clientID string, clientSecret string, redirectURL string, scopes string) *oidcProvider {
+	return &oidcProvider{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		scopes:       scopes,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// getJSON fetches a JSON document from the provider
+func (p *oidcProvider) getJSON(ctx context.Context, url string, document interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", url, response.Status)
+	}
+
+	return json.NewDecoder(response.Body).Decode(document)
+}
+
+// discover fetches the provider's discovery document the first time it is needed
+func (p *oidcProvider) discover(ctx context.Context) (*oidcProviderConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config != nil {
+		return p.config, nil
+	}
+
+	var config oidcProviderConfig
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", &config); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(config.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("provider identifies as issuer %q instead of %q", config.Issuer, p.issuer)
+	}
+
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return nil, fmt.Errorf("provider configuration is missing endpoints")
+	}
+
+	p.config = &config
+	return p.config, nil
+}
+
+// publicKey returns the provider key an ID token was signed with, fetching the provider's keys again if it is not known yet
+func (p *oidcProvider) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	config, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+
+	// The provider may have rotated its keys, but do not let tokens naming made up keys hammer it
+	if time.Since(p.keysFetchedAt) < oidcKeyRefetchInterval {
+		return nil, errUnknownSigningKey
+	}
+	p.keysFetchedAt = time.Now()
+
+	var set jsonWebKeySet
+	if err := p.getJSON(ctx, config.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Keys of types we do not support cannot have signed a token we accept
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	p.keys = keys
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+
+	return nil, errUnknownSigningKey
+}
+
+// lookupKey finds a fetched key by its ID, tokens without a kid header can only be verified when the provider has a single key
+func (p *oidcProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// authorizationURL is where the user is sent to log in, using PKCE so an intercepted code cannot be exchanged by anyone else
+func (p *oidcProvider) authorizationURL(config *oidcProviderConfig, state string, nonce string, codeVerifier string) string {
+	challenge := sha256.Sum256([]byte(codeVerifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.clientID)
+	query.Set("redirect_uri", p.redirectURL)
+	query.Set("scope", p.scopes)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(config.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return config.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// exchange trades the authorization code the user came back with for an ID token
+func (p *oidcProvider) exchange(ctx context.Context, code string, codeVerifier string) (string, error) {
+	config, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("client_id", p.clientID)
+	form.Set("code_verifier", codeVerifier)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.clientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1<<10))
+		return "", fmt.Errorf("provider refused the authorization code: %s %s", response.Status, body)
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	if token.IDToken == "" {
+		return "", fmt.Errorf("provider did not return an ID token")
+	}
+
+	return token.IDToken, nil
+}
+
+// verifyIDToken checks the ID token was signed by the provider for us, for the login that was started with nonce, and has not expired
+func (p *oidcProvider) verifyIDToken(ctx context.Context, idToken string, nonce string, now time.Time) (*idTokenClaims, error) {
+	claims := &idTokenClaims{}
+	parser := jwt.Parser{ValidMethods: []string{"RS256", "ES256", "EdDSA"}, SkipClaimsValidation: true}
+	_, err := parser.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(claims.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("ID token was issued by %q", claims.Issuer)
+	}
+
+	if !claims.Audience.contains(p.clientID) || (len(claims.Audience) > 1 && claims.AuthorizedParty != p.clientID) {
+		return nil, fmt.Errorf("ID token was not issued for this client")
+	}
+
+	if !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, fmt.Errorf("ID token has expired")
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("ID token has no subject")
+	}
+
+	if claims.Nonce == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("ID token was not issued for this login")
+	}
+
+	return claims, nil
+}
+
+var usernameDisallowed = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// oidcUsername picks the username of a user created on their first OIDC login, based on the name or email they have with the provider
+func oidcUsername(claims *idTokenClaims) string {
+	name := claims.PreferredUsername
+	if name == "" {
+		name = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+
+	name = strings.Trim(usernameDisallowed.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(name) > 32 {
+		name = name[:32]
+	}
+
+	if name == "" {
+		name = "user"
+	}
+
+	return name
+}
+
+// loginExternalIdentity returns the user the identity is linked to, linking it to linkUserID or to a new user if it was never seen before
+// When an error is returned, status is the HTTP status code to respond with
+func loginExternalIdentity(ctx context.Context, issuer string, claims *idTokenClaims, linkUserID string, now time.Time) (*User, int, error) {
+	var identities []ExternalIdentity
+	if err := DB.Preload("User").Where(&ExternalIdentity{Issuer: issuer, Subject: claims.Subject}).Find(&identities).Error; err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if len(identities) > 0 {
+		identity := identities[0]
+		if linkUserID != "" && identity.UserID != linkUserID {
+			return nil, http.StatusConflict, fmt.Errorf("identity is already linked to another user")
+		}
+
+		if err := DB.Model(&identity).Updates(map[string]interface{}{"email": claims.Email, "last_login_at": now}).Error; err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		return &identity.User, http.StatusOK, nil
+	}
+
+	identity := ExternalIdentity{Issuer: issuer, Subject: claims.Subject, Email: claims.Email, LastLoginAt: now}
+
+	// A logged in user is linking the identity to their account
+	if linkUserID != "" {
+		var user User
+		if err := DB.Where(&User{ID: linkUserID}).First(&user).Error; err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		identity.UserID = user.ID
+		if err := DB.Create(&identity).Error; err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		return &user, http.StatusOK, nil
+	}
+
+	// First login with the identity, register a user without a password as it only logs in through the provider
+	// The username is claimed by the insert itself, when another user holds it a random suffix is tried instead
+	name := oidcUsername(claims)
+	user := User{ID: uuid.New().String(), Username: name}
+	identity.UserID = user.ID
+	for attempt := 1; ; attempt++ {
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+
+			return tx.Create(&identity).Error
+		})
+		if err == nil {
+			break
+		}
+
+		// A concurrent login with the same identity registered its user first
+		if isUniqueViolation(err, "idx_external_identity") {
+			return loginExternalIdentity(ctx, issuer, claims, linkUserID, now)
+		}
+
+		if !isUniqueViolation(err, "idx_users_username") || attempt == oidcUsernameAttempts {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		user.Username = name + "-" + uuid.New().String()[:8]
+	}
+
+	// Create storage bucket for user
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := Store.CreateBucket(ctx, user.ID); err != nil {
+		log.Println(err.Error())
+		return nil, http.StatusInternalServerError, fmt.Errorf("Unable to register user storage")
+	}
+
+	return &user, http.StatusOK, nil
+}
+
+// OIDCLogin sends the user to the OIDC provider to log in, a user who is already logged in links the identity they log in with to their account
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if OIDC == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("OIDC login is not configured"))
+		return
+	}
+
+	config, err := OIDC.discover(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	state, stateHash, err := newOpaqueToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	nonce, _, err := newOpaqueToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	codeVerifier, _, err := newOpaqueToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	attempt := OIDCLoginAttempt{ID: stateHash, Nonce: nonce, CodeVerifier: codeVerifier, ExpiresAt: time.Now().Add(oidcLoginTimeout)}
+	if isAuthenticated, _ := r.Context().Value("IsAuthenticated").(bool); isAuthenticated {
+		userID, err := GetUserGUIDFromContext(r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		attempt.UserID = *userID
+	}
+
+	if result := DB.Create(&attempt); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	// Lax so the cookie is sent along when the provider redirects the user back
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/user/oidc",
+		Value:    state,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  attempt.ExpiresAt,
+	})
+
+	http.Redirect(w, r, OIDC.authorizationURL(config, state, nonce, codeVerifier), http.StatusFound)
+}
+
+// OIDCCallback completes a login the user was sent to the provider for, and starts a session just like Authenticate does
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if OIDC == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("OIDC login is not configured"))
+		return
+	}
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(fmt.Sprintf("provider refused the login: %s %s", providerErr, query.Get("error_description"))))
+		return
+	}
+
+	state := query.Get("state")
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("login was not started from this browser, start the login again"))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/user/oidc", HttpOnly: true, Expires: time.Unix(0, 0)})
+
+	// Complete each login at most once, deleting the attempt is what claims it
+	now := time.Now()
+	var attempts []OIDCLoginAttempt
+	if err := DB.Where(&OIDCLoginAttempt{ID: hashOpaqueToken(state)}).Find(&attempts).Error; err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if len(attempts) == 0 || !attempts[0].ExpiresAt.After(now) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(errOIDCLoginUsed.Error()))
+		return
+	}
+	attempt := attempts[0]
+
+	result := DB.Delete(&OIDCLoginAttempt{}, "id = ?", attempt.ID)
+	if result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+	if result.RowsAffected == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(errOIDCLoginUsed.Error()))
+		return
+	}
+
+	idToken, err := OIDC.exchange(r.Context(), query.Get("code"), attempt.CodeVerifier)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	claims, err := OIDC.verifyIDToken(r.Context(), idToken, attempt.Nonce, now)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	user, status, err := loginExternalIdentity(r.Context(), OIDC.issuer, claims, attempt.UserID, now)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err := startSession(w, r, *user); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Authentication successful"))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/google/uuid"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockOIDCProvider is a provider that issues an ID token with the claims it is given for the code "code"
+type mockOIDCProvider struct {
+	server *httptest.Server
+	ring   *keyring
+	claims idTokenClaims
+	// codeChallenge is the PKCE challenge of the login, the code is only exchanged with the matching verifier
+	codeChallenge string
+}
+
+func newMockOIDCProvider(t *testing.T, algorithm string) *mockOIDCProvider {
+	key, err := generateSigningKey(algorithm, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := parseSigningKey(*key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := &mockOIDCProvider{ring: &keyring{keys: []parsedSigningKey{*parsed}}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcProviderConfig{
+			Issuer:                mock.server.URL,
+			AuthorizationEndpoint: mock.server.URL + "/authorize",
+			TokenEndpoint:         mock.server.URL + "/token",
+			JWKSURI:               mock.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(mock.ring.jwks())
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "code" || base64.RawURLEncoding.EncodeToString(challenge[:]) != mock.codeChallenge {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		idToken, err := mock.ring.sign(&mock.claims, time.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "access_token": "access", "token_type": "Bearer"})
+	})
+	mock.server = httptest.NewServer(mux)
+	t.Cleanup(mock.server.Close)
+
+	return mock
+}
+
+// login starts a login with the provider and returns the code verifier and nonce it was started with
+func (m *mockOIDCProvider) login(t *testing.T, provider *oidcProvider) (string, string) {
+	config, err := provider.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorizationURL, err := url.Parse(provider.authorizationURL(config, "state", "nonce", "verifier"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := authorizationURL.Query()
+	if !strings.HasPrefix(authorizationURL.String(), m.server.URL+"/authorize?") || query.Get("state") != "state" || query.Get("client_id") != provider.clientID || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization URL %s", authorizationURL)
+	}
+	m.codeChallenge = query.Get("code_challenge")
+
+	return "verifier", query.Get("nonce")
+}
+
+func Test_oidcProvider(t *testing.T) {
+	for _, algorithm := range []string{"RS256", "EdDSA"} {
+		t.Run(algorithm, func(t *testing.T) {
+			mock := newMockOIDCProvider(t, algorithm)
+			provider := newOIDCProvider(mock.server.URL, "image-repo", "secret", "http://localhost:8080/user/oidc/callback", "openid email")
+			codeVerifier, nonce := mock.login(t, provider)
+
+			now := time.Now()
+			valid := idTokenClaims{Issuer: mock.server.URL, Subject: "engineer", Audience: audience{"image-repo"}, ExpiresAt: now.Add(time.Minute).Unix(), IssuedAt: now.Unix(), Nonce: nonce, Email: "engineer@example.com"}
+			tests := []struct {
+				name    string
+				modify  func(claims *idTokenClaims)
+				wantErr bool
+			}{
+				{"valid", func(claims *idTokenClaims) {}, false},
+				{"other audience", func(claims *idTokenClaims) { claims.Audience = audience{"other"} }, true},
+				{"several audiences without azp", func(claims *idTokenClaims) { claims.Audience = audience{"image-repo", "other"} }, true},
+				{"several audiences", func(claims *idTokenClaims) {
+					claims.Audience = audience{"image-repo", "other"}
+					claims.AuthorizedParty = "image-repo"
+				}, false},
+				{"other issuer", func(claims *idTokenClaims) { claims.Issuer = "https://evil.example.com" }, true},
+				{"expired", func(claims *idTokenClaims) { claims.ExpiresAt = now.Add(-time.Second).Unix() }, true},
+				{"other login", func(claims *idTokenClaims) { claims.Nonce = "other" }, true},
+				{"no subject", func(claims *idTokenClaims) { claims.Subject = "" }, true},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					mock.claims = valid
+					tt.modify(&mock.claims)
+
+					idToken, err := provider.exchange(context.Background(), "code", codeVerifier)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					claims, err := provider.verifyIDToken(context.Background(), idToken, nonce, now)
+					if (err != nil) != tt.wantErr {
+						t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+					}
+					if err == nil && (claims.Subject != "engineer" || claims.Email != "engineer@example.com") {
+						t.Errorf("unexpected claims %+v", claims)
+					}
+				})
+			}
+
+			if _, err := provider.exchange(context.Background(), "code", "other verifier"); err == nil {
+				t.Error("expected the code not to be exchanged without the code verifier of the login")
+			}
+
+			// ID tokens signed by anyone but the provider must be rejected
+			forger := newMockOIDCProvider(t, algorithm)
+			forged, err := forger.ring.sign(&valid, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := provider.verifyIDToken(context.Background(), forged, nonce, now); err == nil {
+				t.Error("expected ID token signed with another key to be rejected")
+			}
+		})
+	}
+}
+
+func Test_audience(t *testing.T) {
+	for _, data := range []string{`"image-repo"`, `["other","image-repo"]`} {
+		var aud audience
+		if err := json.Unmarshal([]byte(data), &aud); err != nil {
+			t.Fatal(err)
+		}
+
+		if !aud.contains("image-repo") || aud.contains("image") {
+			t.Errorf("unexpected audience %v from %s", aud, data)
+		}
+	}
+}
+
+func Test_oidcUsername(t *testing.T) {
+	tests := []struct {
+		claims   idTokenClaims
+		expected string
+	}{
+		{idTokenClaims{PreferredUsername: "Jane.Doe", Email: "jane@example.com"}, "jane.doe"},
+		{idTokenClaims{Email: "jane+photos@example.com"}, "jane-photos"},
+		{idTokenClaims{PreferredUsername: "  ", Email: ""}, "user"},
+	}
+	for _, tt := range tests {
+		if username := oidcUsername(&tt.claims); username != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, username)
+		}
+	}
+}
+
+func Test_loginExternalIdentity_takenUsername(t *testing.T) {
+	useTestDB(t)
+	useTestStore(t)
+
+	existing := createTestUser(t)
+	claims := &idTokenClaims{Subject: uuid.New().String(), PreferredUsername: existing.Username}
+
+	user, status, err := loginExternalIdentity(context.Background(), "issuer", claims, "", time.Now())
+	if err != nil {
+		t.Fatalf("user not registered, got %d %v", status, err)
+	}
+	t.Cleanup(func() {
+		DB.Where(&ExternalIdentity{Issuer: "issuer", Subject: claims.Subject}).Delete(&ExternalIdentity{})
+		DB.Delete(user)
+	})
+
+	// The username of the existing user is never handed to the new one
+	if user.ID == existing.ID || !strings.HasPrefix(user.Username, existing.Username+"-") {
+		t.Errorf("expected a suffixed username, got %q", user.Username)
+	}
+
+	again, _, err := loginExternalIdentity(context.Background(), "issuer", claims, "", time.Now())
+	if err != nil || again.ID != user.ID {
+		t.Errorf("second login should return the registered user, got %v", err)
+	}
+}
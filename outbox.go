@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// Photos go through the following states, only active photos are shown to users
+// pending:  the row exists but the objects are still being written, the upload is aborted if it does not complete in time
+// active:   the row and its objects are in place
+// trashed:  the photo has been deleted by its owner, it keeps its objects and can be restored until it is purged
+// deleting: the photo has been purged, its objects and rows are being removed
+const (
+	PhotoStatePending  = "pending"
+	PhotoStateActive   = "active"
+	PhotoStateTrashed  = "trashed"
+	PhotoStateDeleting = "deleting"
+)
+
+// Kinds of outbox events, each one brings the objects of a photo in line with its row
+const (
+	// OutboxAbortUpload removes a photo that is still pending, it is scheduled PendingUploadTimeout after the upload starts
+	OutboxAbortUpload = "abort_upload"
+	// OutboxDeletePhoto removes the objects and then the rows of a photo purged from the trash
+	OutboxDeletePhoto = "delete_photo"
+	// OutboxRelocatePhoto moves the objects of a photo into the bucket matching its visibility
+	OutboxRelocatePhoto = "relocate_photo"
+	// OutboxAbortVersion removes a new version of a photo that is still pending, it is scheduled PendingUploadTimeout after the upload starts
+	OutboxAbortVersion = "abort_version"
+)
+
+// Uploads that have not completed after PendingUploadTimeout are aborted, the outbox is polled every OutboxPollInterval
+var PendingUploadTimeout = 15 * time.Minute
+var OutboxPollInterval = 5 * time.Second
+
+// maxOutboxBackoff caps the delay between attempts of a failing event
+const maxOutboxBackoff = time.Hour
+
+// outboxLease is how long a worker has to handle an event it claimed before another worker may claim it again
+const outboxLease = 10 * time.Minute
+
+// OutboxEvent is storage work that has to happen because of a change committed to the database
+// Events are written in the same transaction as the change, so the work is never lost even if the server crashes before doing it
+type OutboxEvent struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	Kind      string
+	PhotoID   string `gorm:"index"`
+	// Only set for events about a single version of the photo
+	Version int
+	// Number of times the event was claimed, failed events are retried with exponential backoff
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	LastError     string
+	// Set while a worker handles the event, if the worker dies the event is claimed again once the lease runs out
+	LockedUntil *time.Time
+}
+
+// activePhotos restricts a photo query to photos that are neither being uploaded, in the trash nor deleted
+func activePhotos(db *gorm.DB) *gorm.DB {
+	return db.Where("photos.state = ?", PhotoStateActive)
+}
+
+// enqueueOutboxEvent records an event due at the given time, tx must be the transaction making the change the event is for
+func enqueueOutboxEvent(tx *gorm.DB, kind string, photoID string, due time.Time) (*OutboxEvent, error) {
+	event := OutboxEvent{Kind: kind, PhotoID: photoID, NextAttemptAt: due}
+	if err := tx.Create(&event).Error; err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// outboxBackoff is the delay before retrying an event that failed attempts times
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 12 {
+		return maxOutboxBackoff
+	}
+
+	backoff := time.Duration(1<<uint(attempts)) * time.Second
+	if backoff > maxOutboxBackoff {
+		return maxOutboxBackoff
+	}
+
+	return backoff
+}
+
+// processOutboxEvent handles the event with the given ID right away instead of waiting for the worker
+// Nothing happens if the event has already been handled or is being handled by the worker
+func processOutboxEvent(ctx context.Context, id uint) error {
+	_, err := processNextOutboxEvent(ctx, func(query *gorm.DB) *gorm.DB {
+		return query.Where("id = ?", id)
+	})
+	return err
+}
+
+// dueOutboxEvents selects events whose next attempt is due, oldest first
+func dueOutboxEvents(query *gorm.DB) *gorm.DB {
+	return query.Where("next_attempt_at <= ?", time.Now()).Order("next_attempt_at, id")
+}
+
+// unleasedOutboxEvents skips events of photos that have an event leased to a worker, which includes the leased events themselves
+func unleasedOutboxEvents(now time.Time) func(*gorm.DB) *gorm.DB {
+	return func(query *gorm.DB) *gorm.DB {
+		return query.Where("NOT EXISTS (SELECT 1 FROM outbox_events AS leased WHERE leased.photo_id = outbox_events.photo_id AND leased.locked_until > ?)", now)
+	}
+}
+
+// claimOutboxEvent leases one event matching the scope to the caller for outboxLease, or returns nil if there is none to handle
+// Events are locked with SKIP LOCKED so several servers can claim events concurrently, but only for as long as it takes to claim one
+// Events of the same photo are handled one at a time, an event is not claimed while another event of its photo is leased
+func claimOutboxEvent(scope func(*gorm.DB) *gorm.DB, now time.Time) (*OutboxEvent, error) {
+	var claimed *OutboxEvent
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var events []OutboxEvent
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).Scopes(scope, unleasedOutboxEvents(now)).Limit(1)
+		if err := query.Find(&events).Error; err != nil {
+			return err
+		}
+
+		if len(events) == 0 {
+			return nil
+		}
+		event := events[0]
+
+		// Lock the photo and check again, events of the same photo may have been claimed by another server since the query started
+		var photos []Photo
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where(&Photo{ID: event.PhotoID}).Find(&photos).Error; err != nil {
+			return err
+		}
+
+		var leased int64
+		if err := tx.Model(&OutboxEvent{}).Where("photo_id = ? AND locked_until > ?", event.PhotoID, now).Count(&leased).Error; err != nil {
+			return err
+		}
+
+		if leased > 0 {
+			return nil
+		}
+
+		lockedUntil := now.Add(outboxLease)
+		updates := map[string]interface{}{"locked_until": lockedUntil, "attempts": gorm.Expr("attempts + 1")}
+		if err := tx.Model(&event).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		event.LockedUntil = &lockedUntil
+		event.Attempts++
+		claimed = &event
+		return nil
+	})
+
+	return claimed, err
+}
+
+// processNextOutboxEvent claims one event matching the scope and handles it, reporting whether an event was claimed
+// The event is handled outside of any transaction, on success it is deleted and on failure it is rescheduled and released
+func processNextOutboxEvent(ctx context.Context, scope func(*gorm.DB) *gorm.DB) (bool, error) {
+	event, err := claimOutboxEvent(scope, time.Now())
+	if err != nil || event == nil {
+		return false, err
+	}
+
+	handleErr := handleOutboxEvent(ctx, *event)
+	if handleErr == nil {
+		return true, DB.Delete(event).Error
+	}
+
+	// The handler already undid the change the event was for, retrying would fail the same way
+	if _, ok := handleErr.(*StripError); ok {
+		if err := DB.Delete(event).Error; err != nil {
+			return true, err
+		}
+		return true, handleErr
+	}
+
+	updates := map[string]interface{}{
+		"next_attempt_at": time.Now().Add(outboxBackoff(event.Attempts)),
+		"last_error":      handleErr.Error(),
+		"locked_until":    nil,
+	}
+	if err := DB.Model(event).Updates(updates).Error; err != nil {
+		return true, err
+	}
+
+	return true, handleErr
+}
+
+// handleOutboxEvent does the storage work of an event, every handler can safely be run again after partially failing
+// Pending uploads are taken out of the pending state before their objects are deleted, so they cannot complete while being aborted
+func handleOutboxEvent(ctx context.Context, event OutboxEvent) error {
+	var photos []Photo
+	query := DB.Preload("Renditions").Preload("Versions").Where(&Photo{ID: event.PhotoID})
+	if err := query.Find(&photos).Error; err != nil {
+		return err
+	}
+
+	// The photo is already gone, so is everything the event was about
+	if len(photos) == 0 {
+		return nil
+	}
+	photo := photos[0]
+
+	switch event.Kind {
+	case OutboxAbortUpload:
+		if photo.State == PhotoStatePending {
+			result := DB.Model(&Photo{}).Where(&Photo{ID: photo.ID, State: PhotoStatePending}).Update("state", PhotoStateDeleting)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 1 {
+				photo.State = PhotoStateDeleting
+			}
+		}
+		// The upload completed in the meantime, unless a previous attempt started aborting it
+		if photo.State != PhotoStateDeleting {
+			return nil
+		}
+		return removePhoto(ctx, photo)
+	case OutboxDeletePhoto:
+		return removePhoto(ctx, photo)
+	case OutboxRelocatePhoto:
+		err := relocatePhotoObjects(ctx, photo)
+		if _, ok := err.(*StripError); ok {
+			// An original that cannot be stripped must not become public, so the photo is made private again
+			if revertErr := revertToPrivate(photo.ID); revertErr != nil {
+				return revertErr
+			}
+		}
+		return err
+	case OutboxAbortVersion:
+		return abortPhotoVersion(ctx, photo, event.Version)
+	default:
+		return fmt.Errorf("unknown outbox event kind %q", event.Kind)
+	}
+}
+
+// removePhoto deletes the objects of a photo in the deleting state and then its rows
+// Renditions and Versions must be loaded on the photo
+func removePhoto(ctx context.Context, photo Photo) error {
+	if err := deletePhotoObjects(ctx, photo); err != nil {
+		return err
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		return deletePhotoRows(tx, photo)
+	})
+}
+
+// photoBuckets returns the bucket the objects of a photo belong in, and the bucket they are in when the photo has the other visibility
+func photoBuckets(photo Photo) (string, string) {
+	if photo.IsPublic {
+		return PUBLIC_BUCKET_NAME, photo.UserID
+	}
+
+	return photo.UserID, PUBLIC_BUCKET_NAME
+}
+
+// deletePhotoObjects deletes the photo and its renditions from both buckets it may be in, objects that are already gone are skipped
+// Renditions and Versions must be loaded on the photo
+func deletePhotoObjects(ctx context.Context, photo Photo) error {
+	return deleteObjects(ctx, photo, photoObjectNames(photo))
+}
+
+// deleteObjects deletes the named objects of the photo from both buckets they may be in, objects that are already gone are skipped
+func deleteObjects(ctx context.Context, photo Photo, objectNames []string) error {
+	bucket, otherBucket := photoBuckets(photo)
+	for _, objectName := range objectNames {
+		for _, b := range []string{bucket, otherBucket} {
+			if err := Store.Delete(ctx, b, objectName); err != nil && err != ErrObjectNotExist {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// relocatePhotoObjects moves any object of the photo found in the wrong bucket into the bucket matching its visibility
+// Private photos keep their EXIF unless EXIF_STRIP is "all", so sensitive tags are stripped from the originals before they become public
+// Renditions and Versions must be loaded on the photo
+func relocatePhotoObjects(ctx context.Context, photo Photo) error {
+	bucket, otherBucket := photoBuckets(photo)
+
+	if photo.IsPublic && shouldStripExif(true) && !shouldStripExif(false) {
+		if err := stripPhotoOriginals(ctx, DB, photo, otherBucket); err != nil {
+			return err
+		}
+	}
+
+	for _, objectName := range photoObjectNames(photo) {
+		if err := Store.Move(ctx, otherBucket, bucket, objectName); err != nil && err != ErrObjectNotExist {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revertToPrivate makes a public photo private again, objects already moved to the public bucket are moved back by a new relocate event
+func revertToPrivate(photoID string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Photo{}).Where(&Photo{ID: photoID}).Where("is_public = ?", true).Update("is_public", false)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		_, err := enqueueOutboxEvent(tx, OutboxRelocatePhoto, photoID, time.Now())
+		return err
+	})
+}
+
+// deletePhotoRows deletes the photo and everything referencing it from the database, and releases the quota it used
+// Versions must be loaded on the photo
+func deletePhotoRows(tx *gorm.DB, photo Photo) error {
+	if err := tx.Model(&photo).Association("Tags").Clear(); err != nil {
+		return err
+	}
+
+	for _, model := range []interface{}{&Rendition{}, &PhotoMetadata{}, &AlbumPhoto{}, &ShareLink{}, &PhotoGrant{}, &PhotoVersion{}} {
+		if err := tx.Where("photo_id = ?", photo.ID).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+
+	// A worker whose lease ran out may delete the photo at the same time, only the one that deletes it releases its quota
+	result := tx.Delete(&photo)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+
+	return releaseQuota(tx, photo.UserID, photoStoredBytes(photo), 1)
+}
+
+// RunOutboxWorker handles due outbox events until there are none left, then waits for interval before checking again
+func RunOutboxWorker(interval time.Duration) {
+	ctx := context.Background()
+	for {
+		claimed, err := processNextOutboxEvent(ctx, dueOutboxEvents)
+		if err != nil {
+			fmt.Println("outbox:", err)
+		}
+
+		if !claimed {
+			time.Sleep(interval)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+func Test_outboxBackoff(t *testing.T) {
+	if outboxBackoff(1) != 2*time.Second || outboxBackoff(5) != 32*time.Second {
+		t.Errorf("backoff should double with each attempt")
+	}
+
+	if outboxBackoff(12) != maxOutboxBackoff || outboxBackoff(100) != maxOutboxBackoff {
+		t.Errorf("backoff should be capped at %v", maxOutboxBackoff)
+	}
+}
+
+func Test_relocatePhotoObjects(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+	Store = store
+	store.CreateBucket(ctx, PUBLIC_BUCKET_NAME)
+	store.CreateBucket(ctx, "user")
+
+	photo := Photo{ID: "p", UserID: "user", IsPublic: true, MimeType: "image/gif", Renditions: []Rendition{{Width: 150, ObjectName: "p_150"}}}
+
+	// A previous attempt moved the rendition but not the original
+	store.Put(ctx, "user", "p", bytes.NewReader([]byte("original")), 8)
+	store.Put(ctx, PUBLIC_BUCKET_NAME, "p_150", bytes.NewReader([]byte("rendition")), 9)
+
+	if err := relocatePhotoObjects(ctx, photo); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.buckets["user"]) != 0 || len(store.buckets[PUBLIC_BUCKET_NAME]) != 2 {
+		t.Errorf("objects not relocated, got %v", store.buckets)
+	}
+
+	// Running it again changes nothing
+	if err := relocatePhotoObjects(ctx, photo); err != nil || len(store.buckets[PUBLIC_BUCKET_NAME]) != 2 {
+		t.Errorf("relocation should be idempotent, got %v %v", err, store.buckets)
+	}
+}
+
+func Test_deletePhotoObjects(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+	Store = store
+	store.CreateBucket(ctx, PUBLIC_BUCKET_NAME)
+	store.CreateBucket(ctx, "user")
+
+	photo := Photo{ID: "p", UserID: "user", Renditions: []Rendition{{Width: 150, ObjectName: "p_150"}, {Width: 640, ObjectName: "p_640"}}}
+
+	// Objects may be missing or in the wrong bucket after an interrupted move
+	store.Put(ctx, "user", "p", bytes.NewReader([]byte("original")), 8)
+	store.Put(ctx, PUBLIC_BUCKET_NAME, "p_150", bytes.NewReader([]byte("rendition")), 9)
+	store.Put(ctx, PUBLIC_BUCKET_NAME, "other", bytes.NewReader([]byte("other photo")), 11)
+
+	if err := deletePhotoObjects(ctx, photo); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.buckets["user"]) != 0 || len(store.buckets[PUBLIC_BUCKET_NAME]) != 1 {
+		t.Errorf("objects not deleted, got %v", store.buckets)
+	}
+}
+
+func Test_claimOutboxEvent(t *testing.T) {
+	useTestDB(t)
+	useTestStore(t)
+
+	owner := createTestUser(t)
+	first := createTestPhoto(t, owner, []byte("first"), false)
+	second := createTestPhoto(t, owner, []byte("second"), false)
+	t.Cleanup(func() { DB.Where("photo_id IN ?", []string{first.ID, second.ID}).Delete(&OutboxEvent{}) })
+
+	now := time.Now()
+	var events []*OutboxEvent
+	for i, photoID := range []string{first.ID, first.ID, second.ID} {
+		event, err := enqueueOutboxEvent(DB, OutboxRelocatePhoto, photoID, now.Add(time.Duration(i-10)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+
+	scope := func(query *gorm.DB) *gorm.DB {
+		return dueOutboxEvents(query).Where("photo_id IN ?", []string{first.ID, second.ID})
+	}
+
+	// Events of a photo with a leased event are skipped until the lease runs out
+	for _, expected := range []*OutboxEvent{events[0], events[2], nil} {
+		claimed, err := claimOutboxEvent(scope, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected == nil && claimed != nil {
+			t.Errorf("event %d claimed while its photo has a leased event", claimed.ID)
+		}
+		if expected != nil && (claimed == nil || claimed.ID != expected.ID || claimed.Attempts != 1 || claimed.LockedUntil == nil) {
+			t.Errorf("event %d not claimed, got %+v", expected.ID, claimed)
+		}
+	}
+
+	// An event whose worker died is claimed again
+	claimed, err := claimOutboxEvent(scope, now.Add(outboxLease+time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed == nil || claimed.ID != events[0].ID || claimed.Attempts != 2 {
+		t.Errorf("event with expired lease not claimed again, got %+v", claimed)
+	}
+}
+
+func Test_relocatePhotoObjects_stripped(t *testing.T) {
+	useTestDB(t)
+	store := useTestStore(t)
+	defer func(mode string) { ExifStripMode = mode }(ExifStripMode)
+	ExifStripMode = "public"
+
+	owner := createTestUser(t)
+	photo := createTestPhoto(t, owner, buildTestJPEG(t, buildTestExif()), false)
+	photo.IsPublic = true
+
+	if err := relocatePhotoObjects(context.Background(), photo); err != nil {
+		t.Fatal(err)
+	}
+
+	stripped := store.buckets[PUBLIC_BUCKET_NAME][photo.ID]
+	if metadata := extractMetadata(bytes.NewReader(stripped)); metadata == nil || metadata.GPSLatitude != nil {
+		t.Fatalf("original not stripped before becoming public")
+	}
+
+	// The quota of the owner only counts the stripped image
+	var stored Photo
+	DB.Preload("Versions").Preload("User").Where(&Photo{ID: photo.ID}).First(&stored)
+	if stored.Size != int64(len(stripped)) || stored.Versions[0].Size != int64(len(stripped)) || stored.User.UsedBytes != int64(len(stripped)) {
+		t.Errorf("size of the stripped image not recorded, got %d, %d and %d bytes used for %d bytes", stored.Size, stored.Versions[0].Size, stored.User.UsedBytes, len(stripped))
+	}
+}
+
+func Test_setPhotoVisibility_unstrippable(t *testing.T) {
+	useTestDB(t)
+	store := useTestStore(t)
+	defer func(mode string) { ExifStripMode = mode }(ExifStripMode)
+	ExifStripMode = "public"
+
+	owner := createTestUser(t)
+	photo := createTestPhoto(t, owner, []byte("not a jpeg"), false)
+	t.Cleanup(func() { DB.Where(&OutboxEvent{PhotoID: photo.ID}).Delete(&OutboxEvent{}) })
+
+	// The original cannot be stripped, so the photo must stay private instead of being published with its location
+	if status, err := setPhotoVisibility(context.Background(), photo.ID, owner.ID, true); status != 422 || err == nil {
+		t.Errorf("photo that cannot be stripped should not be made public, got %d %v", status, err)
+	}
+
+	var stored Photo
+	DB.Where(&Photo{ID: photo.ID}).First(&stored)
+	if stored.IsPublic {
+		t.Errorf("visibility not rolled back")
+	}
+
+	if len(store.buckets[PUBLIC_BUCKET_NAME]) != 0 || len(store.buckets[owner.ID]) != 1 {
+		t.Errorf("objects of the photo moved, got %v", store.buckets)
+	}
+
+	// Only the event moving back objects of earlier attempts is left, the failed one is not retried
+	var events []OutboxEvent
+	DB.Where(&OutboxEvent{PhotoID: photo.ID}).Find(&events)
+	if len(events) != 1 || events[0].Attempts != 0 {
+		t.Errorf("unexpected outbox events %+v", events)
+	}
+}
@@ -1,14 +1,13 @@
 package main
 
 import (
-	"cloud.google.com/go/storage"
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/google/uuid"
-	"io"
+	"gorm.io/gorm"
 	"net/http"
-	"strconv"
+	"strings"
+	"time"
 )
 
 const PUBLIC_BUCKET_NAME = "shopify-image-repo_public"
@@ -16,16 +15,39 @@ const PUBLIC_BUCKET_NAME = "shopify-image-repo_public"
 // Photo represents a photo that has been uploaded
 type Photo struct {
 	// Each photo has an unique ID
-	ID string `json:"PhotoID" gorm:"primaryKey"`
+	ID string `json:"PhotoID" gorm:"primaryKey;index:idx_photos_created_at_id,priority:2"`
+	// Feeds are ordered by upload time, photos uploaded before it was recorded default to the time of migration
+	CreatedAt time.Time `json:"CreatedAt" gorm:"default:CURRENT_TIMESTAMP;index:idx_photos_created_at_id,priority:1"`
 	// Each photo can either be public or private, and is private by default
 	IsPublic bool `json:"IsPublic" gorm:"default:false"`
+	// Lifecycle of the photo, see PhotoStatePending, PhotoStateActive, PhotoStateTrashed and PhotoStateDeleting
+	State string `json:"-" gorm:"default:active;index"`
+	// When the photo was moved to the trash, it is purged TrashRetention later
+	TrashedAt *time.Time `json:"-" gorm:"index"`
+	// Optional title, description and tags set by the owner to tell photos apart
+	Title       string `json:"Title"`
+	Description string `json:"Description"`
+	Tags        []Tag  `json:"Tags" gorm:"many2many:photo_tags"`
+	// Format, dimensions in pixels and size in bytes of the current version of the image
+	MimeType string `json:"MimeType"`
+	Width    int    `json:"Width"`
+	Height   int    `json:"Height"`
+	Size     int64  `json:"Size"`
+	// Number of the current version, owners can replace the image with a new version and revert to previous ones
+	Version  int            `json:"Version" gorm:"default:1"`
+	Versions []PhotoVersion `json:"-"`
 	// Each photo is owned by a valid user from the users table
 	UserID string `json:"-"`
 	User   User   `json:"-"`
+	// Downscaled copies of the photo stored next to it
+	Renditions []Rendition `json:"-"`
+	// EXIF metadata extracted on upload, if the image had any
+	Metadata *PhotoMetadata `json:"Metadata,omitempty"`
 	// For client side use
-	ImageURL         string `json:"ImageURL" gorm:"-"`
-	Username         string `json:"Username" gorm:"-"`
-	IsOwnedByAPIUser bool   `json:"IsOwnedByAPIUser" gorm:"-"`
+	ImageURL         string            `json:"ImageURL" gorm:"-"`
+	RenditionURLs    map[string]string `json:"Renditions" gorm:"-"`
+	Username         string            `json:"Username" gorm:"-"`
+	IsOwnedByAPIUser bool              `json:"IsOwnedByAPIUser" gorm:"-"`
 }
 
 // GetPhotoDetails returns
@@ -41,7 +63,7 @@ func GetPhotoDetails(w http.ResponseWriter, r *http.Request) {
 
 	// Retrieve photo
 	var photo Photo
-	DB.Where(&Photo{ID: requestedPhoto.ID}).First(&photo)
+	DB.Preload("Renditions").Preload("Metadata").Preload("Tags").Where(&Photo{ID: requestedPhoto.ID, State: PhotoStateActive}).First(&photo)
 	if photo.ID == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("photo with id not found"))
@@ -52,76 +74,85 @@ func GetPhotoDetails(w http.ResponseWriter, r *http.Request) {
 	IsAuthenticated := r.Context().Value("IsAuthenticated").(bool)
 
 	// If authenticated get username/id
-	var username string
-	var userID *string
-	IsOwnedByAPIUser := false // Determine if user requesting image owns photo
+	IsOwnedByAPIUser := false    // Determine if user requesting image owns photo
+	IsSharedWithAPIUser := false // Determine if the owner granted the user access to the photo
 	if IsAuthenticated {
-		username = r.Context().Value("username").(string)
-		userID, err = GetUserGUID(username)
+		userID, err := GetUserGUIDFromContext(r)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(""))
+			return
 		}
 
 		if photo.UserID == *userID {
 			IsOwnedByAPIUser = true
+		} else if !photo.IsPublic {
+			permission, err := getGrantPermission(photo.ID, *userID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			IsSharedWithAPIUser = permission != ""
 		}
 	}
 
-	// Fill in some values for use by client side
-	photo.Username = GetUsernameForUser(photo.UserID)
-	photo.IsOwnedByAPIUser = IsOwnedByAPIUser
-
-	if photo.IsPublic /* can return image regardless of who is requesting */ {
-		url, err := GetURLForImage(photo)
-
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-		}
+	// Public photos can be returned regardless of who is requesting, private ones only to the owner and users they were shared with
+	if !photo.IsPublic && !IsOwnedByAPIUser && !IsSharedWithAPIUser {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-		photo.ImageURL = url
+	writePhotoDetails(w, photo, IsOwnedByAPIUser)
+}
 
-		photoItem, err := json.Marshal(photo)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-		}
+// writePhotoDetails responds with the photo and URLs to its image and renditions, the caller must have checked access to it
+// Renditions, Metadata and Tags must be loaded on the photo
+func writePhotoDetails(w http.ResponseWriter, photo Photo, isOwner bool) {
+	// Fill in some values for use by client side
+	photo.Username = GetUsernameForUser(photo.UserID)
+	photo.IsOwnedByAPIUser = isOwner
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write(photoItem)
-	} else /* need to verify owner is requesting image */ {
-		if IsOwnedByAPIUser {
-			url, err := GetURLForImage(photo)
+	// Only the owner may see where a photo was taken
+	if !isOwner && photo.Metadata != nil {
+		photo.Metadata.GPSLatitude = nil
+		photo.Metadata.GPSLongitude = nil
+	}
 
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(err.Error()))
-			}
+	url, err := GetURLForImage(photo)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
-			photo.ImageURL = url
+	photo.ImageURL = url
 
-			photoItem, err := json.Marshal(photo)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(err.Error()))
-			}
+	photo.RenditionURLs, err = GetRenditionURLsForImage(photo)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			w.Write(photoItem)
-		}
+	photoItem, err := json.Marshal(photo)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
 	}
 
-	w.WriteHeader(http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(photoItem)
 }
 
 // Upload allows users to upload photos, they may be marked as public or private
 func Upload(w http.ResponseWriter, r *http.Request) {
-	// Get uploaded file
+	// Get uploaded file, leaving some room above the maximum file size for the rest of the form
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadBytes+1<<20)
 	r.ParseMultipartForm(32 << 20)
-	file, _, err := r.FormFile("uploadFile")
+	file, fileHeader, err := r.FormFile("uploadFile")
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Println(err)
@@ -129,244 +160,261 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Get isPublic attribute
-	IsPublicFromValue := r.FormValue("IsPublic")
-	if IsPublicFromValue == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	IsPublic, err := strconv.ParseBool(IsPublicFromValue)
+	// Get IsPublic, Title, Description and Tags attributes
+	attributes, status, err := parseUploadAttributes(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
 		return
 	}
 
 	// Identify who the user is
-	username := r.Context().Value("username")
-	if username == nil {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// Get user bucket id
-	bucketID, err := GetUserGUID(username.(string))
+	photo, status, err := storePhoto(r.Context(), file, fileHeader.Size, MaxUploadBytes, *attributes, *userID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
 		return
 	}
 
-	// Generate a unique ID to identify the photo object
-	photoID := uuid.New().String()
+	w.Write([]byte(photo.ID))
+	w.WriteHeader(http.StatusOK)
+}
 
-	// Register photo in photos table
-	photo := Photo{
-		ID:       photoID,
-		IsPublic: IsPublic,
-		UserID:   *bucketID,
+// ChangePermissions allows users to change the visibility of photo between public (everyone can see) and private (only you can see)
+func ChangePermissions(w http.ResponseWriter, r *http.Request) {
+	// Identify who the user is
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
 	}
-	DB.Create(&photo)
 
-	// Retrieve user's bucket
-	bkt := Client.Bucket(getBucketForPhoto(photo))
-
-	// Verify existence of bucket
-	// Only run in production as Google Cloud Storage emulator for local development does not support metadata retrieval
-	// TODO: Need more robust diaster recovery
-	if !IsDebug {
-		_, err = Client.Bucket(getBucketForPhoto(photo)).Attrs(r.Context())
-		if err == storage.ErrBucketNotExist {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Bucket does not exist: " + err.Error()))
-			return
-		}
+	// Retrieve PhotoID and IsPublic from JSON request body
+	var requestedPhoto Photo
+	err = json.NewDecoder(r.Body).Decode(&requestedPhoto)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Missing PhotoID or IsPublic attribute"))
+		return
 	}
 
-	// Upload photo to bucket
-	obj := bkt.Object(photoID)
-	objWriter := obj.NewWriter(r.Context())
-	if _, err := io.Copy(objWriter, file); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if requestedPhoto.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("PhotoID not provided in request body"))
 		return
 	}
 
-	if err := objWriter.Close(); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if status, err := setPhotoVisibility(r.Context(), requestedPhoto.ID, *userID, requestedPhoto.IsPublic); err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
 		return
 	}
 
-	w.Write([]byte(photoID))
 	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("photo visibility has been changed"))
 }
 
-// ChangePermissions allows users to change the visibility of photo between public (everyone can see) and private (only you can see)
-func ChangePermissions(w http.ResponseWriter, r *http.Request) {
-	// Identify who the user is
-	username := r.Context().Value("username")
-	if username == nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+// setPhotoVisibility makes a photo owned by the user public or private, moving its objects between buckets
+// When an error is returned, status is the HTTP status code to respond with
+func setPhotoVisibility(ctx context.Context, photoID string, userID string, isPublic bool) (int, error) {
+	// Make sure photo exists and belongs to user
+	photo, status, err := getPhotoOwnedBy(photoID, userID)
+	if err != nil {
+		return status, err
 	}
 
-	// Get userid for user
-	userID, err := GetUserGUID(username.(string))
+	// Nothing to do if permission has not changed
+	if photo.IsPublic == isPublic {
+		return http.StatusOK, nil
+	}
+
+	// Change permission for photo in photos table, the objects are moved between buckets by the outbox
+	var event *OutboxEvent
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(photo).Update("is_public", isPublic).Error; err != nil {
+			return err
+		}
+
+		var err error
+		event, err = enqueueOutboxEvent(tx, OutboxRelocatePhoto, photo.ID, time.Now())
+		return err
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Move the objects right away, if it fails the outbox worker will retry
+	if err := processOutboxEvent(ctx, event.ID); err != nil {
+		// The photo was made private again rather than published with its location
+		if stripErr, ok := err.(*StripError); ok {
+			return http.StatusUnprocessableEntity, fmt.Errorf("photo cannot be made public: %v", stripErr)
+		}
+		fmt.Println("unable to move photo objects:", err)
+	}
+
+	return http.StatusOK, nil
+}
+
+// metadataEditRequest is the JSON request body of EditMetadata, attributes that are left out are not changed
+type metadataEditRequest struct {
+	ID          string    `json:"PhotoID"`
+	Title       *string   `json:"Title"`
+	Description *string   `json:"Description"`
+	Tags        *[]string `json:"Tags"`
+}
+
+// EditMetadata allows users to change the title, description and tags of their photos, or photos shared with them for editing
+func EditMetadata(w http.ResponseWriter, r *http.Request) {
+	// Identify who the user is
+	userID, err := GetUserGUIDFromContext(r)
 	if err != nil {
-		w.Write([]byte(err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
 		return
 	}
 
-	// Retrieve PhotoID and IsPublic from JSON request body
-	var requestedPhoto Photo
-	err = json.NewDecoder(r.Body).Decode(&requestedPhoto)
+	// Retrieve PhotoID and the attributes to change from JSON request body
+	var request metadataEditRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
-		w.Write([]byte("Missing PhotoID or IsPublic attribute"))
 		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Malformed json"))
 		return
 	}
 
-	if requestedPhoto.ID == "" {
-		w.Write([]byte("PhotoID not provided in request body"))
+	if request.ID == "" {
 		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("PhotoID not provided in request body"))
 		return
 	}
 
-	// make sure photo exists
-	var photos []Photo
-	DB.Where(&Photo{ID: requestedPhoto.ID}).Find(&photos)
+	// Make sure photo exists and belongs to user, or was shared with them for editing
+	photo, status, err := getPhotoEditableBy(request.ID, *userID)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
-	if len(photos) > 1 {
-		w.Write([]byte("Multiple photos returned"))
-		w.WriteHeader(http.StatusInternalServerError)
+	if request.Title != nil {
+		photo.Title = strings.TrimSpace(*request.Title)
+	}
 
+	if request.Description != nil {
+		photo.Description = strings.TrimSpace(*request.Description)
 	}
 
-	if len(photos) == 0 {
-		w.Write([]byte("No photos returned"))
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := validatePhotoText(photo.Title, photo.Description); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
 		return
 	}
 
-	photo := photos[0]
+	var tags []Tag
+	if request.Tags != nil {
+		tagNames, err := normalizeTags(*request.Tags)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
 
-	// Make sure photo belongs to user
-	if photo.UserID != *userID {
-		w.Write([]byte("photo does not belong to user"))
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		tags, err = findOrCreateTags(tagNames)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
 	}
 
-	// If permission has changed photo needs to be updated in photos tabe and object needs to be moved between buckets
-	if photo.IsPublic != requestedPhoto.IsPublic {
-		// If permission has gone from public to private
-		if photo.IsPublic == true && requestedPhoto.IsPublic == false {
-			err = moveBuckets(r.Context(), PUBLIC_BUCKET_NAME, *userID, photo.ID)
-			if err != nil {
-				w.Write([]byte(err.Error()))
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+	// Change title and description, and replace tags if provided, in one transaction
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(photo).Select("Title", "Description").Updates(photo).Error; err != nil {
+			return err
 		}
 
-		// If permission has gone from private to public
-		if photo.IsPublic == false && requestedPhoto.IsPublic == true {
-			err = moveBuckets(r.Context(), *userID, PUBLIC_BUCKET_NAME, photo.ID)
-			if err != nil {
-				w.Write([]byte(err.Error()))
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+		if request.Tags != nil {
+			if err := tx.Model(photo).Association("Tags").Replace(tags); err != nil {
+				return err
 			}
 		}
 
-		// change permission for photo in photos table
-		photo.IsPublic = requestedPhoto.IsPublic
-		DB.Save(&photo)
+		return refreshSearchIndex(tx, photo.ID)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
 	}
 
-	w.Write([]byte("photo visibility has been changed"))
 	w.WriteHeader(http.StatusOK)
-	return
+	w.Write([]byte("photo metadata has been changed"))
 }
 
-func moveBuckets(ctx context.Context, srcBucketName string, dstBucketName string, objName string) error {
-	src := Client.Bucket(srcBucketName).Object(objName)
-	dst := Client.Bucket(dstBucketName).Object(objName)
+// getPhotoOwnedBy retrieves the active photo with the given ID, making sure it belongs to the user
+// When an error is returned, status is the HTTP status code to respond with
+func getPhotoOwnedBy(photoID string, userID string) (*Photo, int, error) {
+	return getPhotoInStateOwnedBy(photoID, userID, PhotoStateActive)
+}
 
-	if _, err := dst.CopierFrom(src).Run(ctx); err != nil {
-		return fmt.Errorf("Object(%q).CopierFrom(%q).Run: %v", objName, srcBucketName, err)
+// getPhotoInStateOwnedBy retrieves the photo with the given ID in the given state, making sure it belongs to the user
+// When an error is returned, status is the HTTP status code to respond with
+func getPhotoInStateOwnedBy(photoID string, userID string, state string) (*Photo, int, error) {
+	var photos []Photo
+	if result := DB.Where(&Photo{ID: photoID, State: state}).Find(&photos); result.Error != nil {
+		return nil, http.StatusInternalServerError, result.Error
 	}
 
-	if err := src.Delete(ctx); err != nil {
-		return fmt.Errorf("Object(%q).Delete: %v", objName, err)
+	if len(photos) == 0 {
+		return nil, http.StatusNotFound, fmt.Errorf("No photos returned")
 	}
 
-	return nil
+	if photos[0].UserID != userID {
+		return nil, http.StatusBadRequest, fmt.Errorf("photo does not belong to user")
+	}
+
+	return &photos[0], http.StatusOK, nil
 }
 
-// Delete allows users to delete photos
+// Delete allows users to move photos to the trash, they can be restored until they are purged
 func Delete(w http.ResponseWriter, r *http.Request) {
 	// get user info
-	username := r.Context().Value("username")
-	if username == nil {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	// retrieve photo id from api call
 	var requestedPhoto Photo
-	err := json.NewDecoder(r.Body).Decode(&requestedPhoto)
+	err = json.NewDecoder(r.Body).Decode(&requestedPhoto)
 	if err != nil {
-		w.Write([]byte("Missing PhotoID or IsPublic attribute"))
 		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Missing PhotoID or IsPublic attribute"))
 		return
 	}
 
 	if requestedPhoto.ID == "" {
-		w.Write([]byte("PhotoID not provided in request body"))
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	// make sure photo exists
-	var photos []Photo
-	DB.Where(&Photo{ID: requestedPhoto.ID}).Find(&photos)
-
-	if len(photos) > 1 {
-		w.Write([]byte("Multiple photos returned"))
-		w.WriteHeader(http.StatusInternalServerError)
-
-	}
-
-	if len(photos) == 0 {
-		w.Write([]byte("No photos returned"))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	photo := photos[0]
-
-	// Make sure photo belongs to user
-	userID, err := GetUserGUID(username.(string))
-	if photo.UserID != *userID {
-		w.Write([]byte("photo does not belong to user"))
 		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("PhotoID not provided in request body"))
 		return
 	}
 
-	// delete photo from photos table
-	DB.Delete(&photo)
-
-	// delete file from bucket
-	imageFile := Client.Bucket(getBucketForPhoto(photo)).Object(photo.ID)
-	if err = imageFile.Delete(r.Context()); err != nil {
-		err = fmt.Errorf("Object(%q).Delete: %v", photo.ID, err)
+	if status, err := trashPhoto(requestedPhoto.ID, *userID); err != nil {
+		w.WriteHeader(status)
 		w.Write([]byte(err.Error()))
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	w.Write([]byte("photo deleted"))
 	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("photo moved to trash"))
 }
 
 func getBucketForPhoto(photo Photo) string {
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// QuotaTier limits how much a user may store, photos are counted by the size of their original and a limit of 0 means unlimited
+type QuotaTier struct {
+	MaxBytes  int64 `json:"MaxBytes"`
+	MaxPhotos int64 `json:"MaxPhotos"`
+}
+
+// Users are limited by the tier assigned to them by an admin, or DefaultQuotaTier if they were never assigned one
+var QuotaTiers = map[string]QuotaTier{
+	"free":      {MaxBytes: 1 << 30, MaxPhotos: 1000},
+	"pro":       {MaxBytes: 100 << 30, MaxPhotos: 100000},
+	"unlimited": {},
+}
+var DefaultQuotaTier = "free"
+
+// AdminUserIDs are the IDs of the users allowed to change the quota tier of other users
+// Admins are not named by username, as a username nobody registered yet could be claimed by anyone through signup or OIDC
+var AdminUserIDs = map[string]bool{}
+
+// QuotaExceededError is returned when storing a photo would take a user over the limits of their tier
+type QuotaExceededError struct {
+	Tier       string
+	Quota      QuotaTier
+	UsedBytes  int64
+	PhotoCount int64
+	Size       int64
+	Photos     int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.Quota.MaxPhotos > 0 && e.PhotoCount+e.Photos > e.Quota.MaxPhotos {
+		return fmt.Sprintf("storage quota exceeded: the %s tier allows at most %d photos and %d are already stored", e.Tier, e.Quota.MaxPhotos, e.PhotoCount)
+	}
+
+	if e.Quota.MaxBytes > 0 && e.UsedBytes+e.Size > e.Quota.MaxBytes {
+		return fmt.Sprintf("storage quota exceeded: storing %d more bytes would use %d of the %d bytes allowed by the %s tier", e.Size, e.UsedBytes+e.Size, e.Quota.MaxBytes, e.Tier)
+	}
+
+	return fmt.Sprintf("storage quota exceeded: the %s tier does not allow storing %d more bytes", e.Tier, e.Size)
+}
+
+// parseQuotaTiers parses tiers written as name=maxBytes/maxPhotos separated by commas, such as "free=1073741824/1000,unlimited=0/0"
+func parseQuotaTiers(value string) (map[string]QuotaTier, error) {
+	tiers := map[string]QuotaTier{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		limits := strings.SplitN(parts[len(parts)-1], "/", 2)
+		if len(parts) != 2 || parts[0] == "" || len(limits) != 2 {
+			return nil, fmt.Errorf("quota tier %q must be written as name=maxBytes/maxPhotos", entry)
+		}
+
+		maxBytes, err := strconv.ParseInt(limits[0], 10, 64)
+		if err != nil || maxBytes < 0 {
+			return nil, fmt.Errorf("quota tier %q must have a non negative byte limit", entry)
+		}
+
+		maxPhotos, err := strconv.ParseInt(limits[1], 10, 64)
+		if err != nil || maxPhotos < 0 {
+			return nil, fmt.Errorf("quota tier %q must have a non negative photo limit", entry)
+		}
+
+		tiers[parts[0]] = QuotaTier{MaxBytes: maxBytes, MaxPhotos: maxPhotos}
+	}
+
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("no quota tiers given")
+	}
+
+	return tiers, nil
+}
+
+// userQuotaTier returns the name and limits of the tier the user is on, users on a tier that no longer exists fall back to DefaultQuotaTier
+func userQuotaTier(user User) (string, QuotaTier) {
+	if tier, ok := QuotaTiers[user.QuotaTier]; ok {
+		return user.QuotaTier, tier
+	}
+
+	return DefaultQuotaTier, QuotaTiers[DefaultQuotaTier]
+}
+
+// checkQuota makes sure the user can store size more bytes in photos more photos without going over their tier
+// New versions of existing photos only take up bytes, so photos is 0 for them
+func checkQuota(user User, size int64, photos int64) error {
+	name, tier := userQuotaTier(user)
+	quotaErr := &QuotaExceededError{Tier: name, Quota: tier, UsedBytes: user.UsedBytes, PhotoCount: user.PhotoCount, Size: size, Photos: photos}
+	if tier.MaxPhotos > 0 && user.PhotoCount+photos > tier.MaxPhotos {
+		return quotaErr
+	}
+
+	if tier.MaxBytes > 0 && user.UsedBytes+size > tier.MaxBytes {
+		return quotaErr
+	}
+
+	return nil
+}
+
+// reserveQuota adds size bytes in photos photos to the usage of the user, tx must be the transaction creating them
+// The limits are checked in the same statement as the increment so concurrent uploads cannot exceed them
+func reserveQuota(tx *gorm.DB, userID string, size int64, photos int64) error {
+	var user User
+	if err := tx.Where(&User{ID: userID}).First(&user).Error; err != nil {
+		return err
+	}
+
+	if err := checkQuota(user, size, photos); err != nil {
+		return err
+	}
+
+	name, tier := userQuotaTier(user)
+	query := tx.Model(&User{}).Where("id = ?", userID)
+	if tier.MaxBytes > 0 {
+		query = query.Where("used_bytes + ? <= ?", size, tier.MaxBytes)
+	}
+	if tier.MaxPhotos > 0 {
+		query = query.Where("photo_count + ? <= ?", photos, tier.MaxPhotos)
+	}
+
+	result := query.Updates(map[string]interface{}{"used_bytes": gorm.Expr("used_bytes + ?", size), "photo_count": gorm.Expr("photo_count + ?", photos)})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	// A concurrent upload used up the remaining quota
+	if result.RowsAffected == 0 {
+		return &QuotaExceededError{Tier: name, Quota: tier, UsedBytes: user.UsedBytes, PhotoCount: user.PhotoCount, Size: size, Photos: photos}
+	}
+
+	return nil
+}
+
+// releaseQuota removes size bytes in photos photos from the usage of the user, tx must be the transaction deleting them
+func releaseQuota(tx *gorm.DB, userID string, size int64, photos int64) error {
+	updates := map[string]interface{}{"used_bytes": gorm.Expr("used_bytes - ?", size), "photo_count": gorm.Expr("photo_count - ?", photos)}
+	return tx.Model(&User{}).Where("id = ?", userID).Updates(updates).Error
+}
+
+// recalculateUsage recomputes the usage of every user from their photos, photos and versions are counted from the moment their row is created until it is deleted
+// Photos uploaded before versions were recorded have no versions and are counted by their own size
+func recalculateUsage(db *gorm.DB) error {
+	return db.Exec(`UPDATE users SET
+		used_bytes = COALESCE((SELECT SUM(COALESCE((SELECT SUM(photo_versions.size) FROM photo_versions WHERE photo_versions.photo_id = photos.id), photos.size))
+			FROM photos WHERE photos.user_id = users.id), 0),
+		photo_count = (SELECT COUNT(*) FROM photos WHERE photos.user_id = users.id)`).Error
+}
+
+// usageResponse is the JSON response of the usage endpoint
+type usageResponse struct {
+	Tier string `json:"Tier"`
+	QuotaTier
+	UsedBytes  int64 `json:"UsedBytes"`
+	PhotoCount int64 `json:"PhotoCount"`
+}
+
+// GetUsage returns how much the user has stored and the limits of their tier
+func GetUsage(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var user User
+	if result := DB.Where(&User{ID: *userID}).First(&user); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	name, tier := userQuotaTier(user)
+	response, err := json.Marshal(usageResponse{Tier: name, QuotaTier: tier, UsedBytes: user.UsedBytes, PhotoCount: user.PhotoCount})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// quotaRequest is the JSON request body of the quota endpoint
+type quotaRequest struct {
+	Username string `json:"Username"`
+	Tier     string `json:"Tier"`
+}
+
+// SetQuotaTier allows admins to move a user to another quota tier, photos already stored are kept even if they exceed the new limits
+func SetQuotaTier(w http.ResponseWriter, r *http.Request) {
+	adminID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !AdminUserIDs[*adminID] {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("only admins can change quota tiers"))
+		return
+	}
+
+	var request quotaRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Malformed json"))
+		return
+	}
+
+	if _, ok := QuotaTiers[request.Tier]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("quota tier %q does not exist", request.Tier)))
+		return
+	}
+
+	userID, err := GetUserGUID(request.Username)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if result := DB.Model(&User{}).Where("id = ?", *userID).Update("quota_tier", request.Tier); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(request.Username + " is now on the " + request.Tier + " tier"))
+}
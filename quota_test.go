@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_parseQuotaTiers(t *testing.T) {
+	tiers, err := parseQuotaTiers("free=1024/10, unlimited=0/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tiers) != 2 || tiers["free"] != (QuotaTier{MaxBytes: 1024, MaxPhotos: 10}) || tiers["unlimited"] != (QuotaTier{}) {
+		t.Errorf("unexpected tiers %v", tiers)
+	}
+
+	for _, value := range []string{"", "free", "free=1024", "=1024/10", "free=-1/10", "free=1024/ten"} {
+		if _, err := parseQuotaTiers(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func Test_checkQuota(t *testing.T) {
+	defaultTiers, defaultTier := QuotaTiers, DefaultQuotaTier
+	defer func() { QuotaTiers, DefaultQuotaTier = defaultTiers, defaultTier }()
+	QuotaTiers = map[string]QuotaTier{"small": {MaxBytes: 100, MaxPhotos: 2}, "unlimited": {}}
+	DefaultQuotaTier = "small"
+
+	tests := []struct {
+		name    string
+		user    User
+		size    int64
+		photos  int64
+		wantErr string
+	}{
+		{"fits", User{UsedBytes: 40, PhotoCount: 1}, 60, 1, ""},
+		{"too many bytes", User{UsedBytes: 40, PhotoCount: 1}, 61, 1, "would use 101 of the 100 bytes allowed by the small tier"},
+		{"too many photos", User{UsedBytes: 0, PhotoCount: 2}, 1, 1, "allows at most 2 photos"},
+		{"new version at the photo limit", User{UsedBytes: 0, PhotoCount: 2}, 1, 0, ""},
+		{"new version over the byte limit", User{UsedBytes: 90, PhotoCount: 2}, 11, 0, "would use 101 of the 100 bytes"},
+		{"unlimited", User{UsedBytes: 1 << 40, PhotoCount: 1 << 20, QuotaTier: "unlimited"}, 1 << 30, 1, ""},
+		{"removed tier falls back to default", User{UsedBytes: 100, QuotaTier: "gone"}, 1, 1, "small tier"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkQuota(tt.user, tt.size, tt.photos)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+
+			if _, ok := err.(*QuotaExceededError); !ok || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected quota error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
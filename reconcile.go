@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"os"
+	"sort"
+	"time"
+)
+
+// Kinds of drift between the photos table and storage
+const (
+	// DriftOrphaned is an object that belongs to no photo
+	DriftOrphaned = "orphaned"
+	// DriftMissing is an object of an active or trashed photo that is in no bucket at all
+	DriftMissing = "missing"
+	// DriftMisplaced is an object of an active or trashed photo that is only found in a bucket not matching its visibility
+	DriftMisplaced = "misplaced"
+	// DriftDuplicate is an object of an active or trashed photo found in the bucket matching its visibility and in another bucket as well
+	DriftDuplicate = "duplicate"
+)
+
+// Storage is reconciled every ReconcileInterval, drift is only reported unless ReconcileFix is set
+var ReconcileInterval = 24 * time.Hour
+var ReconcileFix = false
+
+// Drift is a single object that is not where the photos table says it should be
+type Drift struct {
+	Kind    string `json:"Kind"`
+	Bucket  string `json:"Bucket"`
+	Object  string `json:"Object"`
+	PhotoID string `json:"PhotoID,omitempty"`
+}
+
+func (d Drift) String() string {
+	if d.PhotoID == "" {
+		return fmt.Sprintf("%s %s/%s", d.Kind, d.Bucket, d.Object)
+	}
+
+	return fmt.Sprintf("%s %s/%s (photo %s)", d.Kind, d.Bucket, d.Object, d.PhotoID)
+}
+
+// findDrift compares the objects listed in each bucket against the photos they should belong to
+// Objects of photos that are pending or deleting are in flight and are never reported, trashed photos keep their objects and are checked like active ones
+func findDrift(photos []Photo, listing map[string][]string) []Drift {
+	owners := map[string]Photo{}
+	for _, photo := range photos {
+		for _, objectName := range photoObjectNames(photo) {
+			owners[objectName] = photo
+		}
+	}
+
+	// Find out which buckets each object is in
+	found := map[string]map[string]bool{}
+	for bucket, objects := range listing {
+		for _, object := range objects {
+			if found[object] == nil {
+				found[object] = map[string]bool{}
+			}
+			found[object][bucket] = true
+		}
+	}
+
+	buckets := make([]string, 0, len(listing))
+	for bucket := range listing {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+
+	drift := []Drift{}
+	for _, bucket := range buckets {
+		for _, object := range listing[bucket] {
+			photo, ok := owners[object]
+			if !ok {
+				drift = append(drift, Drift{Kind: DriftOrphaned, Bucket: bucket, Object: object})
+				continue
+			}
+
+			expected := getBucketForPhoto(photo)
+			if photoInFlight(photo) || bucket == expected {
+				continue
+			}
+
+			kind := DriftMisplaced
+			if found[object][expected] {
+				kind = DriftDuplicate
+			}
+			drift = append(drift, Drift{Kind: kind, Bucket: bucket, Object: object, PhotoID: photo.ID})
+		}
+	}
+
+	for _, photo := range photos {
+		if photoInFlight(photo) {
+			continue
+		}
+
+		for _, objectName := range photoObjectNames(photo) {
+			if len(found[objectName]) == 0 {
+				drift = append(drift, Drift{Kind: DriftMissing, Bucket: getBucketForPhoto(photo), Object: objectName, PhotoID: photo.ID})
+			}
+		}
+	}
+
+	return drift
+}
+
+// photoInFlight reports whether the objects of a photo are being written or removed
+func photoInFlight(photo Photo) bool {
+	return photo.State == PhotoStatePending || photo.State == PhotoStateDeleting
+}
+
+// fixDrift cleans up a single drift, missing objects cannot be recovered and are left alone
+// Drift is found in a snapshot that may be stale by now, so objects of a photo are only touched while its row is locked and it has no outbox events
+// Every change of visibility locks the row and enqueues an event, and events are only deleted once their objects are in place
+func fixDrift(ctx context.Context, drift Drift) (bool, error) {
+	if drift.Kind == DriftOrphaned {
+		if err := Store.Delete(ctx, drift.Bucket, drift.Object); err != nil && err != ErrObjectNotExist {
+			return false, err
+		}
+		return true, nil
+	}
+
+	fixed := false
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var photos []Photo
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Renditions").Preload("Versions").Where(&Photo{ID: drift.PhotoID})
+		if err := query.Find(&photos).Error; err != nil {
+			return err
+		}
+
+		if len(photos) == 0 || photoInFlight(photos[0]) {
+			return nil
+		}
+
+		// The outbox is moving or removing the objects of the photo, it will bring them in line itself
+		var events int64
+		if err := tx.Model(&OutboxEvent{}).Where(&OutboxEvent{PhotoID: drift.PhotoID}).Count(&events).Error; err != nil {
+			return err
+		}
+		if events > 0 {
+			return nil
+		}
+
+		var err error
+		fixed, err = fixPhotoDrift(ctx, tx, drift, photos[0])
+		return err
+	})
+
+	return fixed, err
+}
+
+// fixPhotoDrift cleans up an object of the photo found in the wrong bucket, going by where the object is now rather than the kind of drift found
+// A copy in the bucket matching the visibility of the photo is kept and the other one deleted, otherwise the object is moved there
+// The photo must be locked by tx, Renditions and Versions must be loaded on it
+func fixPhotoDrift(ctx context.Context, tx *gorm.DB, drift Drift, photo Photo) (bool, error) {
+	expected := getBucketForPhoto(photo)
+	if drift.Kind == DriftMissing || drift.Bucket == expected {
+		return false, nil
+	}
+
+	owned := false
+	for _, objectName := range photoObjectNames(photo) {
+		owned = owned || objectName == drift.Object
+	}
+	if !owned {
+		return false, nil
+	}
+
+	reader, err := Store.Get(ctx, expected, drift.Object)
+	if err == nil {
+		reader.Close()
+		if err := Store.Delete(ctx, drift.Bucket, drift.Object); err != nil && err != ErrObjectNotExist {
+			return false, err
+		}
+		return true, nil
+	}
+	if err != ErrObjectNotExist {
+		return false, err
+	}
+
+	// Originals moved into the public bucket must have their sensitive EXIF tags stripped first, as relocatePhotoObjects does
+	if photo.IsPublic && shouldStripExif(true) && !shouldStripExif(false) {
+		for _, version := range photoOriginals(photo) {
+			if drift.Object != versionObjectName(photo.ID, version.Version) {
+				continue
+			}
+			size, err := stripExifFromObject(ctx, drift.Bucket, drift.Object, version.MimeType)
+			if err != nil {
+				return false, err
+			}
+			if err := recordStrippedSize(tx, photo, version, size); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if err := Store.Move(ctx, drift.Bucket, expected, drift.Object); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// listBuckets lists the public bucket and the bucket of every user
+func listBuckets(ctx context.Context) (map[string][]string, error) {
+	var userIDs []string
+	if err := DB.Model(&User{}).Pluck("id", &userIDs).Error; err != nil {
+		return nil, err
+	}
+
+	listing := map[string][]string{}
+	for _, bucket := range append([]string{PUBLIC_BUCKET_NAME}, userIDs...) {
+		exists, err := Store.BucketExists(ctx, bucket)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		objects, err := Store.List(ctx, bucket)
+		if err != nil {
+			return nil, err
+		}
+		listing[bucket] = objects
+	}
+
+	return listing, nil
+}
+
+// reconcileStorage finds drift between the photos table and storage and, if fix is set, cleans up what it can
+// It returns the drift found and how much of it was fixed
+func reconcileStorage(ctx context.Context, fix bool) ([]Drift, int, error) {
+	// Buckets are listed before photos are loaded, as photo rows are created before their objects are written
+	// Listing the other way round would report objects of photos uploaded in between as orphaned
+	listing, err := listBuckets(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var photos []Photo
+	if err := DB.Preload("Renditions").Preload("Versions").Find(&photos).Error; err != nil {
+		return nil, 0, err
+	}
+
+	drift := findDrift(photos, listing)
+	if !fix {
+		return drift, 0, nil
+	}
+
+	fixed := 0
+	for _, d := range drift {
+		ok, err := fixDrift(ctx, d)
+		if err != nil {
+			fmt.Println("reconcile: unable to fix", d, err)
+			continue
+		}
+		if ok {
+			fixed++
+		}
+	}
+
+	return drift, fixed, nil
+}
+
+// RunReconciler reconciles storage every interval, logging any drift it finds
+func RunReconciler(interval time.Duration, fix bool) {
+	ctx := context.Background()
+	for {
+		time.Sleep(interval)
+
+		drift, fixed, err := reconcileStorage(ctx, fix)
+		if err != nil {
+			fmt.Println("reconcile:", err)
+			continue
+		}
+
+		for _, d := range drift {
+			fmt.Println("reconcile:", d)
+		}
+		fmt.Printf("reconcile: found %d drifted objects, fixed %d\n", len(drift), fixed)
+	}
+}
+
+// ReconcileCommand runs a single reconciliation from the command line, pass -fix to clean up drift instead of only reporting it
+// It returns the exit code, which is non zero when drift remains
+func ReconcileCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "delete orphaned and duplicate objects and move misplaced objects into the right bucket")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	drift, fixed, err := reconcileStorage(ctx, *fix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, d := range drift {
+		fmt.Println(d)
+	}
+	fmt.Printf("found %d drifted objects, fixed %d\n", len(drift), fixed)
+
+	if fixed < len(drift) {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_findDrift(t *testing.T) {
+	photos := []Photo{
+		// Public photo whose rendition is also left behind in the user bucket
+		{ID: "a", UserID: "user", IsPublic: true, State: PhotoStateActive, Renditions: []Rendition{{Width: 150, ObjectName: "a_150"}}},
+		// Private photo still in the public bucket, with its rendition lost
+		{ID: "b", UserID: "user", State: PhotoStateActive, Renditions: []Rendition{{Width: 150, ObjectName: "b_150"}}},
+		// Photos in flight are left alone
+		{ID: "c", UserID: "user", State: PhotoStatePending},
+		{ID: "d", UserID: "user", IsPublic: true, State: PhotoStateDeleting},
+		// Trashed photos keep their objects, so they are checked like active ones
+		{ID: "e", UserID: "user", State: PhotoStateTrashed},
+	}
+	listing := map[string][]string{
+		PUBLIC_BUCKET_NAME: {"a", "a_150", "b", "e", "stray"},
+		"user":             {"a_150", "c", "d"},
+	}
+
+	expected := []Drift{
+		{Kind: DriftMisplaced, Bucket: PUBLIC_BUCKET_NAME, Object: "b", PhotoID: "b"},
+		{Kind: DriftMisplaced, Bucket: PUBLIC_BUCKET_NAME, Object: "e", PhotoID: "e"},
+		{Kind: DriftOrphaned, Bucket: PUBLIC_BUCKET_NAME, Object: "stray"},
+		{Kind: DriftDuplicate, Bucket: "user", Object: "a_150", PhotoID: "a"},
+		{Kind: DriftMissing, Bucket: "user", Object: "b_150", PhotoID: "b"},
+	}
+	if drift := findDrift(photos, listing); fmt.Sprint(drift) != fmt.Sprint(expected) {
+		t.Errorf("unexpected drift\n got %v\nwant %v", drift, expected)
+	}
+}
+
+func Test_fixDrift(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+	Store = store
+	store.CreateBucket(ctx, PUBLIC_BUCKET_NAME)
+	store.CreateBucket(ctx, "user")
+	store.Put(ctx, PUBLIC_BUCKET_NAME, "b", bytes.NewReader([]byte("private")), 7)
+	store.Put(ctx, PUBLIC_BUCKET_NAME, "b_150", bytes.NewReader([]byte("rendition")), 9)
+	store.Put(ctx, "user", "b_150", bytes.NewReader([]byte("rendition")), 9)
+	store.Put(ctx, PUBLIC_BUCKET_NAME, "stray", bytes.NewReader([]byte("stray")), 5)
+
+	if ok, err := fixDrift(ctx, Drift{Kind: DriftOrphaned, Bucket: PUBLIC_BUCKET_NAME, Object: "stray"}); !ok || err != nil {
+		t.Errorf("orphaned object not deleted, got %v", err)
+	}
+
+	photo := Photo{ID: "b", UserID: "user", MimeType: "image/png", State: PhotoStateActive, Renditions: []Rendition{{Width: 150, ObjectName: "b_150"}}}
+	for _, d := range []Drift{
+		{Kind: DriftMisplaced, Bucket: PUBLIC_BUCKET_NAME, Object: "b", PhotoID: "b"},
+		// The rendition was found misplaced but has been copied over since, so only the stray copy is deleted
+		{Kind: DriftMisplaced, Bucket: PUBLIC_BUCKET_NAME, Object: "b_150", PhotoID: "b"},
+	} {
+		if ok, err := fixPhotoDrift(ctx, nil, d, photo); !ok || err != nil {
+			t.Errorf("%v not fixed, got %v", d, err)
+		}
+	}
+
+	for _, d := range []Drift{
+		{Kind: DriftMissing, Bucket: "user", Object: "b_640", PhotoID: "b"},
+		// The photo has been made private since the drift was found
+		{Kind: DriftDuplicate, Bucket: "user", Object: "b", PhotoID: "b"},
+		// The object no longer belongs to the photo
+		{Kind: DriftMisplaced, Bucket: PUBLIC_BUCKET_NAME, Object: "b_640", PhotoID: "b"},
+	} {
+		if ok, _ := fixPhotoDrift(ctx, nil, d, photo); ok {
+			t.Errorf("%v should not be fixed", d)
+		}
+	}
+
+	if len(store.buckets[PUBLIC_BUCKET_NAME]) != 0 || len(store.buckets["user"]) != 2 || string(store.buckets["user"]["b"]) != "private" {
+		t.Errorf("unexpected objects after fixing %v", store.buckets)
+	}
+}
+
+func Test_fixDrift_outbox(t *testing.T) {
+	useTestDB(t)
+	store := useTestStore(t)
+
+	owner := createTestUser(t)
+	photo := createTestPhoto(t, owner, []byte("private"), false)
+	t.Cleanup(func() { DB.Where(&OutboxEvent{PhotoID: photo.ID}).Delete(&OutboxEvent{}) })
+
+	// The photo is being made public, the copy in the public bucket is the relocation in progress
+	store.Put(context.Background(), PUBLIC_BUCKET_NAME, photo.ID, bytes.NewReader([]byte("private")), 7)
+	if _, err := enqueueOutboxEvent(DB, OutboxRelocatePhoto, photo.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	drift := Drift{Kind: DriftDuplicate, Bucket: PUBLIC_BUCKET_NAME, Object: photo.ID, PhotoID: photo.ID}
+	if ok, err := fixDrift(context.Background(), drift); ok || err != nil {
+		t.Errorf("drift of a photo with outbox events should be left alone, got %v %v", ok, err)
+	}
+
+	if len(store.buckets[PUBLIC_BUCKET_NAME]) != 1 || len(store.buckets[owner.ID]) != 1 {
+		t.Errorf("objects of the photo changed, got %v", store.buckets)
+	}
+
+	// Once the outbox is done with the photo, the reconciler may clean up after it
+	DB.Where(&OutboxEvent{PhotoID: photo.ID}).Delete(&OutboxEvent{})
+	if ok, err := fixDrift(context.Background(), drift); !ok || err != nil {
+		t.Errorf("duplicate not deleted, got %v %v", ok, err)
+	}
+
+	if len(store.buckets[PUBLIC_BUCKET_NAME]) != 0 || len(store.buckets[owner.ID]) != 1 {
+		t.Errorf("unexpected objects after fixing %v", store.buckets)
+	}
+}
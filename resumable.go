@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads are buffered in UploadSessionDir and abandoned after UploadSessionTTL
+// Sessions only work on the server that created them as their chunks and locks are local to it, deployments running several servers must route every request of a session to the same server
+var UploadSessionDir = filepath.Join(os.TempDir(), "image-repo-uploads")
+var UploadSessionTTL = 24 * time.Hour
+
+// UploadSession is a resumable upload in progress, the image is received in chunks and turned into a photo once complete
+// The attributes the photo will be given are set when the session is created
+type UploadSession struct {
+	ID        string    `json:"UploadID" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	ExpiresAt time.Time `json:"ExpiresAt" gorm:"index"`
+	// Each session is owned by a valid user from the users table
+	UserID string `json:"-" gorm:"index"`
+	User   User   `json:"-"`
+	// Total size of the image in bytes, and how many of them have been received so far
+	Size     int64 `json:"Size"`
+	Received int64 `json:"Offset"`
+	// Attributes of the photo
+	IsPublic    bool   `json:"IsPublic"`
+	Title       string `json:"Title"`
+	Description string `json:"Description"`
+	// Comma separated normalized tag names
+	Tags string `json:"-"`
+}
+
+// uploadSessionRequest is the JSON request body creating an upload session
+type uploadSessionRequest struct {
+	Size        int64    `json:"Size"`
+	IsPublic    bool     `json:"IsPublic"`
+	Title       string   `json:"Title"`
+	Description string   `json:"Description"`
+	Tags        []string `json:"Tags"`
+}
+
+// uploadSessionLocks serializes chunks and finalization of the same session, it only holds locks of sessions that exist
+var uploadSessionLocks sync.Map
+
+// findUploadSession returns the session with the given ID owned by the user, or nil if there is none
+func findUploadSession(id string, userID string) *UploadSession {
+	var sessions []UploadSession
+	DB.Where(&UploadSession{ID: id, UserID: userID}).Find(&sessions)
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	return &sessions[0]
+}
+
+// lockUploadSession locks the session with the given ID owned by the user and returns it as it is once locked, or nil if there is none
+// The session is looked up before a lock is created for it, so requests for sessions that do not exist leave nothing behind
+func lockUploadSession(id string, userID string) (*UploadSession, func()) {
+	if findUploadSession(id, userID) == nil {
+		return nil, nil
+	}
+
+	value, _ := uploadSessionLocks.LoadOrStore(id, &sync.Mutex{})
+	lock := value.(*sync.Mutex)
+	lock.Lock()
+
+	// The session may have been finalized or deleted while waiting for the lock
+	session := findUploadSession(id, userID)
+	if session == nil {
+		lock.Unlock()
+		return nil, nil
+	}
+
+	return session, lock.Unlock
+}
+
+func uploadSessionPath(id string) string {
+	return filepath.Join(UploadSessionDir, id)
+}
+
+// writeChunk writes the chunk read from r into the file at offset, returning how many bytes were written
+// Bytes written before a read error are kept so the client can resume after them
+func writeChunk(path string, offset int64, r io.Reader) (int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(file, r)
+	if syncErr := file.Sync(); err == nil {
+		err = syncErr
+	}
+
+	return written, err
+}
+
+// parseResumablePath splits the path of a resumable upload request into the session ID and the optional action
+func parseResumablePath(path string) (string, string, error) {
+	parts := strings.Split(strings.TrimPrefix(path, "/upload/resumable/"), "/")
+	if parts[0] == "" || len(parts) > 2 {
+		return "", "", fmt.Errorf("invalid upload path")
+	}
+
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// writeUploadSession responds with the state of the session, the offset is also returned in the Upload-Offset header
+func writeUploadSession(w http.ResponseWriter, status int, session UploadSession) {
+	response, err := json.Marshal(session)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Received, 10))
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+// CreateUploadSession starts a resumable upload of an image of the given size
+func CreateUploadSession(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var request uploadSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Malformed json"))
+		return
+	}
+
+	if request.Size < 1 || request.Size > MaxResumableUploadBytes {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("Size must be between 1 and %d bytes", MaxResumableUploadBytes)))
+		return
+	}
+
+	// Reject uploads that cannot fit in the quota before any chunk is sent, the quota is enforced again when the upload is finalized
+	var user User
+	if result := DB.Where(&User{ID: *userID}).First(&user); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	if err := checkQuota(user, request.Size, 1); err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	request.Title = strings.TrimSpace(request.Title)
+	request.Description = strings.TrimSpace(request.Description)
+	if err := validatePhotoText(request.Title, request.Description); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	tagNames, err := normalizeTags(request.Tags)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	session := UploadSession{
+		ID:          uuid.New().String(),
+		ExpiresAt:   time.Now().Add(UploadSessionTTL),
+		UserID:      *userID,
+		Size:        request.Size,
+		IsPublic:    request.IsPublic,
+		Title:       request.Title,
+		Description: request.Description,
+		Tags:        strings.Join(tagNames, ","),
+	}
+
+	file, err := os.OpenFile(uploadSessionPath(session.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	file.Close()
+
+	if result := DB.Create(&session); result.Error != nil {
+		os.Remove(uploadSessionPath(session.ID))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	writeUploadSession(w, http.StatusCreated, session)
+}
+
+// ResumableUpload handles requests on an existing upload session owned by the user
+// GET returns the session and how many bytes have been received, PUT appends the body at the offset given in the Upload-Offset header,
+// DELETE abandons the session and POST on /finalize turns the completely received image into a photo
+func ResumableUpload(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	id, action, err := parseResumablePath(r.URL.Path)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	session, unlock := lockUploadSession(id, *userID)
+	if session == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("upload session not found"))
+		return
+	}
+	defer unlock()
+
+	if time.Now().After(session.ExpiresAt) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("upload session not found"))
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeUploadSession(w, http.StatusOK, *session)
+	case action == "" && r.Method == http.MethodPut:
+		uploadChunk(w, r, *session)
+	case action == "" && r.Method == http.MethodDelete:
+		deleteUploadSession(session.ID)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("upload session deleted"))
+	case action == "finalize" && r.Method == http.MethodPost:
+		finalizeUploadSession(w, r, *session)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// uploadChunk appends the request body to the session, the offset must match the number of bytes received so far
+func uploadChunk(w http.ResponseWriter, r *http.Request, session UploadSession) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Upload-Offset header must be a number of bytes"))
+		return
+	}
+
+	// The client is out of sync, tell it where to resume from
+	if offset != session.Received {
+		writeUploadSession(w, http.StatusConflict, session)
+		return
+	}
+
+	written, err := writeChunk(uploadSessionPath(session.ID), offset, http.MaxBytesReader(w, r.Body, session.Size-offset))
+	if written > 0 {
+		session.Received += written
+		if result := DB.Model(&session).Update("received", session.Received); result.Error != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(result.Error.Error()))
+			return
+		}
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeUploadSession(w, http.StatusOK, session)
+}
+
+// finalizeUploadSession stores the received image as a photo and deletes the session
+func finalizeUploadSession(w http.ResponseWriter, r *http.Request, session UploadSession) {
+	if session.Received != session.Size {
+		writeUploadSession(w, http.StatusConflict, session)
+		return
+	}
+
+	tags, err := findOrCreateTags(parseTagList(session.Tags))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	file, err := os.Open(uploadSessionPath(session.ID))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer file.Close()
+
+	attributes := photoAttributes{IsPublic: session.IsPublic, Title: session.Title, Description: session.Description, Tags: tags}
+	photo, status, err := storePhoto(r.Context(), file, session.Size, MaxResumableUploadBytes, attributes, session.UserID)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	deleteUploadSession(session.ID)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(photo.ID))
+}
+
+// deleteUploadSession deletes the session, its buffered chunks and its lock, the caller must hold the lock
+func deleteUploadSession(id string) {
+	DB.Where(&UploadSession{ID: id}).Delete(&UploadSession{})
+	os.Remove(uploadSessionPath(id))
+	uploadSessionLocks.Delete(id)
+}
+
+// CleanupUploadSessions periodically deletes upload sessions that expired before being finalized
+func CleanupUploadSessions(interval time.Duration) {
+	for {
+		var sessions []UploadSession
+		if result := DB.Where("expires_at < ?", time.Now()).Find(&sessions); result.Error != nil {
+			fmt.Println("unable to list expired upload sessions:", result.Error)
+		}
+
+		for _, session := range sessions {
+			if locked, unlock := lockUploadSession(session.ID, session.UserID); locked != nil {
+				deleteUploadSession(session.ID)
+				unlock()
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/uuid"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_parseResumablePath(t *testing.T) {
+	id, action, err := parseResumablePath("/upload/resumable/abc")
+	if err != nil || id != "abc" || action != "" {
+		t.Errorf("unexpected %q %q %v", id, action, err)
+	}
+
+	id, action, err = parseResumablePath("/upload/resumable/abc/finalize")
+	if err != nil || id != "abc" || action != "finalize" {
+		t.Errorf("unexpected %q %q %v", id, action, err)
+	}
+
+	for _, path := range []string{"/upload/resumable/", "/upload/resumable//finalize", "/upload/resumable/abc/finalize/x"} {
+		if _, _, err := parseResumablePath(path); err == nil {
+			t.Errorf("%s should be rejected", path)
+		}
+	}
+}
+
+// failingReader returns data and then fails, like a connection dropping mid chunk
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func Test_writeChunk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := writeChunk(path, 0, bytes.NewReader([]byte("hello ")))
+	if err != nil || written != 6 {
+		t.Fatalf("unexpected %d %v", written, err)
+	}
+
+	// Bytes received before the connection dropped are kept
+	written, err = writeChunk(path, 6, &failingReader{data: []byte("wor")})
+	if err == nil || written != 3 {
+		t.Fatalf("unexpected %d %v", written, err)
+	}
+
+	written, err = writeChunk(path, 9, io.LimitReader(bytes.NewReader([]byte("ld!")), 3))
+	if err != nil || written != 3 {
+		t.Fatalf("unexpected %d %v", written, err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != "hello world!" {
+		t.Errorf("unexpected content %q %v", data, err)
+	}
+
+	if _, err := writeChunk(filepath.Join(t.TempDir(), "missing"), 0, bytes.NewReader(nil)); !os.IsNotExist(err) {
+		t.Errorf("missing session file should not be created, got %v", err)
+	}
+}
+
+func TestResumableUpload_locks(t *testing.T) {
+	useTestDB(t)
+	useTestStore(t)
+	defer func(dir string) { UploadSessionDir = dir }(UploadSessionDir)
+	UploadSessionDir = t.TempDir()
+
+	owner := createTestUser(t)
+	stranger := createTestUser(t)
+	session := UploadSession{ID: uuid.New().String(), UserID: owner.ID, Size: 10, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := DB.Create(&session).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(user User, method string, id string) int {
+		w := httptest.NewRecorder()
+		ResumableUpload(w, requestAs(t, &user, method, "/upload/resumable/"+id, nil))
+		return w.Code
+	}
+
+	// Requests for sessions that do not exist or belong to someone else leave no lock behind
+	missing := uuid.New().String()
+	if status := request(owner, "GET", missing); status != 404 {
+		t.Errorf("missing session should not be found, got %d", status)
+	}
+	if status := request(stranger, "GET", session.ID); status != 404 {
+		t.Errorf("session of another user should not be found, got %d", status)
+	}
+	for _, id := range []string{missing, session.ID} {
+		if _, ok := uploadSessionLocks.Load(id); ok {
+			t.Errorf("lock created for %s before the session was found", id)
+		}
+	}
+
+	if status := request(owner, "GET", session.ID); status != 200 {
+		t.Errorf("session not found, got %d", status)
+	}
+
+	// Deleting the session deletes its lock
+	if status := request(owner, "DELETE", session.ID); status != 200 {
+		t.Errorf("session not deleted, got %d", status)
+	}
+	if _, ok := uploadSessionLocks.Load(session.ID); ok {
+		t.Errorf("lock of deleted session not removed")
+	}
+	if status := request(owner, "GET", session.ID); status != 404 {
+		t.Errorf("deleted session should not be found, got %d", status)
+	}
+}
+
+func TestCreateUploadSession_size(t *testing.T) {
+	useTestDB(t)
+	defer func(dir string) { UploadSessionDir = dir }(UploadSessionDir)
+	UploadSessionDir = t.TempDir()
+	defer func(upload int64, resumable int64) { MaxUploadBytes, MaxResumableUploadBytes = upload, resumable }(MaxUploadBytes, MaxResumableUploadBytes)
+	MaxUploadBytes, MaxResumableUploadBytes = 100, 1000
+
+	owner := createTestUser(t)
+	t.Cleanup(func() { DB.Where(&UploadSession{UserID: owner.ID}).Delete(&UploadSession{}) })
+
+	// Resumable uploads are limited by their own maximum rather than the one of regular uploads
+	for size, expected := range map[int64]int{500: 201, 1001: 413} {
+		w := httptest.NewRecorder()
+		CreateUploadSession(w, requestAs(t, &owner, "POST", "/upload/resumable", uploadSessionRequest{Size: size}))
+		if w.Code != expected {
+			t.Errorf("session of %d bytes should be answered with %d, got %d %s", size, expected, w.Code, w.Body.String())
+		}
+	}
+}
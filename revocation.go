@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sync"
+	"time"
+)
+
+// Revocations made by other servers are picked up every RevocationSyncInterval, this is how long a revoked token may still be accepted by them
+var RevocationSyncInterval = 10 * time.Second
+
+// revocationSyncOverlap is how far back each sync looks before the previous one, so revocations committed late are not missed
+const revocationSyncOverlap = time.Minute
+
+var errTokenInvalid = fmt.Errorf("token is invalid")
+var errTokenRevoked = fmt.Errorf("token has been revoked")
+
+// AccessToken records an access token that was issued, so it can be revoked along with its session
+type AccessToken struct {
+	// ID is the jti claim of the token
+	ID        string    `gorm:"primaryKey"`
+	SessionID string    `gorm:"index"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// RevokedToken is an access token that must no longer be accepted, it is kept until the token would have expired anyway
+type RevokedToken struct {
+	ID        string    `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// revocationCache holds the IDs of every revoked access token that has not expired yet, so requests are authenticated without a query
+type revocationCache struct {
+	mu       sync.RWMutex
+	revoked  map[string]time.Time
+	syncedAt time.Time
+}
+
+var revokedTokens = newRevocationCache()
+
+func newRevocationCache() *revocationCache {
+	return &revocationCache{revoked: map[string]time.Time{}}
+}
+
+func (c *revocationCache) isRevoked(id string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.revoked[id]
+	return ok
+}
+
+func (c *revocationCache) add(tokens []RevokedToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, token := range tokens {
+		c.revoked[token.ID] = token.ExpiresAt
+	}
+}
+
+// prune forgets revoked tokens that have expired, they are rejected for being expired instead
+func (c *revocationCache) prune(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, expiresAt := range c.revoked {
+		if !expiresAt.After(now) {
+			delete(c.revoked, id)
+		}
+	}
+}
+
+// sync loads the revocations recorded since the previous sync, the first sync loads every revocation that has not expired
+func (c *revocationCache) sync(db *gorm.DB, now time.Time) error {
+	c.mu.RLock()
+	since := c.syncedAt.Add(-revocationSyncOverlap)
+	c.mu.RUnlock()
+
+	var tokens []RevokedToken
+	if err := db.Where("created_at >= ? AND expires_at > ?", since, now).Find(&tokens).Error; err != nil {
+		return err
+	}
+
+	c.add(tokens)
+	c.prune(now)
+
+	c.mu.Lock()
+	c.syncedAt = now
+	c.mu.Unlock()
+
+	return nil
+}
+
+// RunRevocationSync keeps the revocation cache in line with revocations made by other servers
+func RunRevocationSync(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if err := revokedTokens.sync(DB, time.Now()); err != nil {
+			fmt.Println("unable to sync revoked tokens:", err)
+		}
+	}
+}
+
+// parseAccessToken verifies the access token and returns its claims, tokens without an ID cannot be revoked and are rejected
+func parseAccessToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	tkn, err := jwt.ParseWithClaims(tokenString, claims, signingKeys.verificationKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if !tkn.Valid {
+		return nil, errTokenInvalid
+	}
+
+	if claims.Id == "" || revokedTokens.isRevoked(claims.Id) {
+		return nil, errTokenRevoked
+	}
+
+	return claims, nil
+}
+
+// revokeSessions revokes the active sessions matching the scope along with every access token issued for them
+// It returns the number of sessions revoked and the revoked access tokens, which must be added to revokedTokens once tx commits
+func revokeSessions(tx *gorm.DB, now time.Time, scope func(*gorm.DB) *gorm.DB) (int, []RevokedToken, error) {
+	var sessionIDs []string
+	if err := tx.Model(&Session{}).Scopes(scope).Where("revoked_at IS NULL").Pluck("id", &sessionIDs).Error; err != nil {
+		return 0, nil, err
+	}
+
+	if len(sessionIDs) == 0 {
+		return 0, nil, nil
+	}
+
+	var issued []AccessToken
+	if err := tx.Where("session_id IN ? AND expires_at > ?", sessionIDs, now).Find(&issued).Error; err != nil {
+		return 0, nil, err
+	}
+
+	var revoked []RevokedToken
+	for _, token := range issued {
+		revoked = append(revoked, RevokedToken{ID: token.ID, ExpiresAt: token.ExpiresAt})
+	}
+
+	if len(revoked) > 0 {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&revoked).Error; err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if err := tx.Model(&Session{}).Where("id IN ?", sessionIDs).Update("revoked_at", now).Error; err != nil {
+		return 0, nil, err
+	}
+
+	return len(sessionIDs), revoked, nil
+}
+
+// revokeSessionsNow revokes the active sessions matching the scope and their access tokens, and returns how many sessions were revoked
+func revokeSessionsNow(scope func(*gorm.DB) *gorm.DB) (int, error) {
+	var count int
+	var revoked []RevokedToken
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		count, revoked, err = revokeSessions(tx, time.Now(), scope)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	revokedTokens.add(revoked)
+	return count, nil
+}
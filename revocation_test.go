@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_revocationCache(t *testing.T) {
+	now := time.Now()
+	cache := newRevocationCache()
+	cache.add([]RevokedToken{{ID: "expired", ExpiresAt: now.Add(-time.Minute)}, {ID: "live", ExpiresAt: now.Add(time.Minute)}})
+
+	if !cache.isRevoked("expired") || !cache.isRevoked("live") || cache.isRevoked("other") {
+		t.Fatalf("unexpected revocations %v", cache.revoked)
+	}
+
+	cache.prune(now)
+	if cache.isRevoked("expired") || !cache.isRevoked("live") {
+		t.Errorf("expected only the expired token to be pruned, got %v", cache.revoked)
+	}
+}
+
+func Test_parseAccessToken(t *testing.T) {
+	useTestSigningKey(t, SigningAlgorithm)
+
+	tokenString, issued, err := newAccessToken("user", "session", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := parseAccessToken(tokenString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Username != "user" || claims.SessionID != "session" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	revokedTokens.add([]RevokedToken{{ID: issued.Id, ExpiresAt: time.Unix(issued.ExpiresAt, 0)}})
+	defer revokedTokens.prune(time.Unix(issued.ExpiresAt, 0))
+	if _, err := parseAccessToken(tokenString); err != errTokenRevoked {
+		t.Errorf("expected revoked token to be rejected, got %v", err)
+	}
+
+	// Tokens issued before they had an ID cannot be revoked, so they are not accepted either
+	withoutID, err := signingKeys.sign(&Claims{Username: "user"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseAccessToken(withoutID); err != errTokenRevoked {
+		t.Errorf("expected token without an ID to be rejected, got %v", err)
+	}
+}
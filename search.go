@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"strings"
+)
+
+// maxSearchQueryLength caps the length of the free text search query
+const maxSearchQueryLength = 200
+
+// migrateSearchIndex adds the full text search column and its GIN index to the photos table
+// The column combines title and tags (weight A), description (weight B) and uploader username (weight C)
+// It is not part of the Photo struct as GORM cannot manage tsvector columns, instead it is maintained by refreshSearchIndex
+func migrateSearchIndex(db *gorm.DB) error {
+	if err := db.Exec("ALTER TABLE photos ADD COLUMN IF NOT EXISTS search_vector tsvector").Error; err != nil {
+		return err
+	}
+
+	if err := db.Exec("CREATE INDEX IF NOT EXISTS idx_photos_search_vector ON photos USING GIN (search_vector)").Error; err != nil {
+		return err
+	}
+
+	// Index photos uploaded before search existed
+	return db.Exec(searchVectorUpdate + " AND photos.search_vector IS NULL").Error
+}
+
+const searchVectorUpdate = `UPDATE photos SET search_vector =
+	setweight(to_tsvector('english', coalesce(photos.title, '')), 'A') ||
+	setweight(to_tsvector('english', coalesce((SELECT string_agg(tags.name, ' ') FROM photo_tags JOIN tags ON tags.id = photo_tags.tag_id WHERE photo_tags.photo_id = photos.id), '')), 'A') ||
+	setweight(to_tsvector('english', coalesce(photos.description, '')), 'B') ||
+	setweight(to_tsvector('simple', coalesce(users.username, '')), 'C')
+FROM users WHERE users.id = photos.user_id`
+
+// refreshSearchIndex recomputes the search column of a photo, it must be called whenever its title, description or tags change
+func refreshSearchIndex(db *gorm.DB, photoID string) error {
+	return db.Exec(searchVectorUpdate+" AND photos.id = ?", photoID).Error
+}
+
+// parseSearchParams reads the q and tag query parameters of a search request, at least one of them must be provided
+// Multiple tag parameters may be passed, only photos carrying all of them match
+func parseSearchParams(r *http.Request) (string, []string, error) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len(query) > maxSearchQueryLength {
+		return "", nil, fmt.Errorf("q must be at most %d characters", maxSearchQueryLength)
+	}
+
+	tags, err := normalizeTags(r.URL.Query()["tag"])
+	if err != nil {
+		return "", nil, err
+	}
+
+	if query == "" && len(tags) == 0 {
+		return "", nil, fmt.Errorf("q or tag must be provided")
+	}
+
+	return query, tags, nil
+}
+
+// Search returns a page of photos matching a free text query and/or tags, newest first
+// The query is matched against titles, descriptions, tags and uploader username
+// Public photos are searched for everyone, private photos only for their owner and users they were shared with
+func Search(w http.ResponseWriter, r *http.Request) {
+	query, tags, err := parseSearchParams(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	limit, cursor, err := parseFeedParams(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Restrict results to what the user is allowed to see
+	search := DB.Preload("Renditions").Preload("Tags").Model(&Photo{}).Scopes(activePhotos)
+	if isAuthenticated, _ := r.Context().Value("IsAuthenticated").(bool); isAuthenticated {
+		userID, err := GetUserGUIDFromContext(r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		search = search.Where("photos.is_public = ? OR photos.user_id = ? OR photos.id IN (SELECT photo_grants.photo_id FROM photo_grants WHERE photo_grants.grantee_id = ?)", true, *userID, *userID)
+	} else {
+		search = search.Where("photos.is_public = ?", true)
+	}
+
+	// Titles, descriptions and tags are stemmed as english while usernames are not, so match the query both ways
+	if query != "" {
+		search = search.Where("photos.search_vector @@ websearch_to_tsquery('english', ?) OR photos.search_vector @@ websearch_to_tsquery('simple', ?)", query, query)
+	}
+
+	if len(tags) > 0 {
+		search = search.Where(`photos.id IN (SELECT photo_tags.photo_id FROM photo_tags JOIN tags ON tags.id = photo_tags.tag_id
+			WHERE tags.name IN ? GROUP BY photo_tags.photo_id HAVING COUNT(DISTINCT tags.name) = ?)`, tags, len(tags))
+	}
+
+	var photos []Photo
+	if result := paginatePhotos(search, limit, cursor).Find(&photos); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	writeFeedPage(w, photos, limit)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_parseSearchParams(t *testing.T) {
+	query, tags, err := parseSearchParams(httptest.NewRequest("GET", "/photo/search?q=+sunset+beach+&tag=Holiday&tag=holiday&tag=2021", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if query != "sunset beach" {
+		t.Errorf("query not trimmed, got %q", query)
+	}
+
+	if len(tags) != 2 || tags[0] != "holiday" || tags[1] != "2021" {
+		t.Errorf("tags not normalized, got %v", tags)
+	}
+
+	if _, tags, err := parseSearchParams(httptest.NewRequest("GET", "/photo/search?tag=holiday", nil)); err != nil || len(tags) != 1 {
+		t.Errorf("searching by tag only should be allowed, got %v %v", tags, err)
+	}
+
+	for _, invalid := range []string{"", "q=+", "tag=", "q=" + strings.Repeat("a", maxSearchQueryLength+1)} {
+		if _, _, err := parseSearchParams(httptest.NewRequest("GET", "/photo/search?"+invalid, nil)); err == nil {
+			t.Errorf("%q should be rejected", invalid)
+		}
+	}
+}
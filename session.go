@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"time"
+)
+
+// Access tokens are short lived JWTs, the session they belong to is kept alive by refresh tokens until it goes unused for SessionTTL
+var AccessTokenTTL = 5 * time.Minute
+var SessionTTL = 30 * 24 * time.Hour
+
+// refreshTokenCookie holds the refresh token, it is only sent to the user endpoints
+const refreshTokenCookie = "refresh_token"
+
+var errInvalidRefreshToken = fmt.Errorf("refresh token is invalid or expired")
+var errRefreshTokenReused = fmt.Errorf("refresh token has already been used, the session has been revoked")
+
+// Session is a login of a user on one device, it lasts until it is revoked or goes unused for SessionTTL
+type Session struct {
+	ID         string     `json:"SessionID" gorm:"primaryKey"`
+	CreatedAt  time.Time  `json:"CreatedAt"`
+	UserID     string     `json:"-" gorm:"index"`
+	User       User       `json:"-"`
+	UserAgent  string     `json:"UserAgent"`
+	IPAddress  string     `json:"IPAddress"`
+	LastUsedAt time.Time  `json:"LastUsedAt"`
+	ExpiresAt  time.Time  `json:"ExpiresAt" gorm:"index"`
+	RevokedAt  *time.Time `json:"-"`
+	// For client side use
+	IsCurrent bool `json:"IsCurrent" gorm:"-"`
+}
+
+// RefreshToken is an opaque token that can be exchanged once for a new access token and a new refresh token of the same session
+// Only a hash of the token is stored, used tokens are kept so presenting one again can be detected as theft
+type RefreshToken struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	SessionID string `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	UsedAt    *time.Time
+}
+
+// issueRefreshToken creates a new refresh token for the session and returns it
+func issueRefreshToken(tx *gorm.DB, sessionID string) (string, error) {
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Create(&RefreshToken{SessionID: sessionID, TokenHash: tokenHash}).Error; err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// createSession starts a session for the user logging in with the request and returns it along with its first refresh token
+func createSession(db *gorm.DB, userID string, r *http.Request, now time.Time) (*Session, string, error) {
+	session := Session{
+		ID:         uuid.New().String(),
+		UserID:     userID,
+		UserAgent:  r.UserAgent(),
+		IPAddress:  r.RemoteAddr,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(SessionTTL),
+	}
+
+	var token string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+
+		var err error
+		token, err = issueRefreshToken(tx, session.ID)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &session, token, nil
+}
+
+// startSession logs the user in on the device the request was made from, setting both the access and refresh token cookies
+func startSession(w http.ResponseWriter, r *http.Request, user User) error {
+	session, refreshToken, err := createSession(DB, user.ID, r, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if err := setAccessToken(w, user.Username, session.ID); err != nil {
+		return err
+	}
+	setRefreshToken(w, refreshToken, session.ExpiresAt)
+
+	return nil
+}
+
+// rotateRefreshToken uses up a refresh token and returns its session along with the refresh token replacing it
+// A token that has already been used was either stolen or replayed, so the whole session is revoked and errRefreshTokenReused returned
+func rotateRefreshToken(db *gorm.DB, token string, now time.Time) (*Session, string, error) {
+	var session Session
+	var newToken string
+	var revoked []RevokedToken
+	reused := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Lock the token so concurrent requests presenting it are handled one at a time, the second one being seen as reuse
+		var tokens []RefreshToken
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where(&RefreshToken{TokenHash: hashOpaqueToken(token)})
+		if err := query.Find(&tokens).Error; err != nil {
+			return err
+		}
+
+		if len(tokens) == 0 {
+			return errInvalidRefreshToken
+		}
+
+		if err := tx.Where(&Session{ID: tokens[0].SessionID}).First(&session).Error; err != nil {
+			return err
+		}
+
+		if session.RevokedAt != nil || !session.ExpiresAt.After(now) {
+			return errInvalidRefreshToken
+		}
+
+		if tokens[0].UsedAt != nil {
+			reused = true
+			var err error
+			_, revoked, err = revokeSessions(tx, now, func(db *gorm.DB) *gorm.DB {
+				return db.Where(&Session{ID: session.ID})
+			})
+			return err
+		}
+
+		if err := tx.Model(&tokens[0]).Update("used_at", now).Error; err != nil {
+			return err
+		}
+
+		session.LastUsedAt = now
+		session.ExpiresAt = now.Add(SessionTTL)
+		if err := tx.Model(&session).Select("LastUsedAt", "ExpiresAt").Updates(&session).Error; err != nil {
+			return err
+		}
+
+		var err error
+		newToken, err = issueRefreshToken(tx, session.ID)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if reused {
+		revokedTokens.add(revoked)
+		return nil, "", errRefreshTokenReused
+	}
+
+	return &session, newToken, nil
+}
+
+// revokeSessionByRefreshToken revokes the session a refresh token belongs to along with its access tokens, unknown tokens are ignored
+func revokeSessionByRefreshToken(token string) error {
+	_, err := revokeSessionsNow(func(db *gorm.DB) *gorm.DB {
+		sessionIDs := DB.Model(&RefreshToken{}).Select("session_id").Where(&RefreshToken{TokenHash: hashOpaqueToken(token)})
+		return db.Where("id IN (?)", sessionIDs)
+	})
+	return err
+}
+
+// newAccessToken signs a new access token for the user's session with the active signing key, its jti claim is what the token is revoked by
+func newAccessToken(username string, sessionID string, now time.Time) (string, *Claims, error) {
+	claims := &Claims{
+		Username:  username,
+		SessionID: sessionID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.New().String(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(AccessTokenTTL).Unix(),
+		},
+	}
+
+	tokenString, err := signingKeys.sign(claims, now)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return tokenString, claims, nil
+}
+
+// setAccessToken issues a new access token for the user's session and sets it as the token cookie
+// The token is recorded against the session so that revoking the session revokes it too
+func setAccessToken(w http.ResponseWriter, username string, sessionID string) error {
+	tokenString, claims, err := newAccessToken(username, sessionID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	expirationTime := time.Unix(claims.ExpiresAt, 0)
+	if err := DB.Create(&AccessToken{ID: claims.Id, SessionID: sessionID, ExpiresAt: expirationTime}).Error; err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Path:     "/",
+		Value:    tokenString,
+		HttpOnly: true,
+		Expires:  expirationTime,
+	})
+
+	return nil
+}
+
+// setRefreshToken sets the refresh token cookie, it is only sent to the user endpoints as that is the only place it is used
+func setRefreshToken(w http.ResponseWriter, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Path:     "/user",
+		Value:    token,
+		HttpOnly: true,
+		Expires:  expires,
+	})
+}
+
+// clearTokens removes both the access and refresh token cookies
+func clearTokens(w http.ResponseWriter) {
+	for _, cookie := range []http.Cookie{{Name: "token", Path: "/"}, {Name: refreshTokenCookie, Path: "/user"}} {
+		cookie.HttpOnly = true
+		cookie.Expires = time.Unix(0, 0)
+		http.SetCookie(w, &cookie)
+	}
+}
+
+// ListSessions returns the sessions of the user that are still active, marking the one the request was made with
+func ListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	sessions := []Session{}
+	result := DB.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", *userID, time.Now()).Order("last_used_at DESC").Find(&sessions)
+	if result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	currentSessionID, _ := r.Context().Value("sessionID").(string)
+	for i := range sessions {
+		sessions[i].IsCurrent = sessions[i].ID == currentSessionID
+	}
+
+	response, err := json.Marshal(sessions)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// RevokeSession logs the user out of one of their sessions, its refresh and access tokens stop working right away
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var request Session
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("SessionID not provided in request body"))
+		return
+	}
+
+	count, err := revokeSessionsNow(func(db *gorm.DB) *gorm.DB {
+		return db.Where(&Session{ID: request.ID, UserID: *userID})
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if count == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("session with id not found"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("session revoked"))
+}
+
+// LogoutAll logs the user out of every one of their sessions, including the one the request was made with
+func LogoutAll(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	count, err := revokeSessionsNow(func(db *gorm.DB) *gorm.DB {
+		return db.Where(&Session{UserID: *userID})
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	clearTokens(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("%d sessions revoked", count)))
+}
+
+// CleanupSessions periodically deletes sessions that expired or were revoked, along with their refresh tokens
+// Records of access tokens are deleted once the tokens expire, as expired tokens are rejected whether they were revoked or not
+func CleanupSessions(interval time.Duration) {
+	for {
+		now := time.Now()
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			ended := tx.Model(&Session{}).Select("id").Where("expires_at < ? OR revoked_at IS NOT NULL", now)
+			if err := tx.Where("session_id IN (?)", ended).Delete(&RefreshToken{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Where("expires_at < ?", now).Delete(&AccessToken{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Where("expires_at < ?", now).Delete(&RevokedToken{}).Error; err != nil {
+				return err
+			}
+
+			// OIDC logins the user never came back from
+			if err := tx.Where("expires_at < ?", now).Delete(&OIDCLoginAttempt{}).Error; err != nil {
+				return err
+			}
+
+			return tx.Where("expires_at < ? OR revoked_at IS NOT NULL", now).Delete(&Session{}).Error
+		})
+		if err != nil {
+			fmt.Println("unable to delete ended sessions:", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/golang-jwt/jwt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_newAccessToken(t *testing.T) {
+	useTestSigningKey(t, SigningAlgorithm)
+
+	now := time.Now()
+	tokenString, issued, err := newAccessToken("user", "session", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := &Claims{}
+	if _, err := jwt.ParseWithClaims(tokenString, claims, signingKeys.verificationKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Username != "user" || claims.SessionID != "session" || claims.Id == "" || claims.Id != issued.Id {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	if expires := time.Unix(claims.ExpiresAt, 0); expires.After(now.Add(AccessTokenTTL)) {
+		t.Errorf("access token should expire within %v, expires at %v", AccessTokenTTL, expires)
+	}
+
+	_, other, err := newAccessToken("user", "session", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if other.Id == issued.Id {
+		t.Errorf("access tokens should have distinct IDs, both are %s", issued.Id)
+	}
+}
+
+func Test_setRefreshToken(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	expires := time.Now().Add(SessionTTL)
+	setRefreshToken(recorder, "refresh", expires)
+
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != refreshTokenCookie || cookies[0].Value != "refresh" || cookies[0].Path != "/user" || !cookies[0].HttpOnly {
+		t.Errorf("expected an http only refresh token cookie scoped to the user endpoints, got %v", cookies)
+	}
+}
+
+func Test_clearTokens(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	clearTokens(recorder)
+
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 2 {
+		t.Fatalf("expected both cookies to be cleared, got %v", cookies)
+	}
+
+	for _, cookie := range cookies {
+		if cookie.Value != "" || cookie.Expires.After(time.Now()) {
+			t.Errorf("cookie %s not cleared", cookie.Name)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ShareLink grants anyone holding its token read access to a single photo, even a private one
+// Only a hash of the token is stored, the token itself is returned once when the link is created
+type ShareLink struct {
+	ID        string    `json:"ShareID" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	PhotoID   string    `json:"PhotoID" gorm:"index"`
+	Photo     Photo     `json:"-"`
+	TokenHash string    `json:"-" gorm:"uniqueIndex"`
+	// Optional limits, the link stops working once it expires or has been viewed MaxViews times
+	ExpiresAt *time.Time `json:"ExpiresAt,omitempty"`
+	MaxViews  *int       `json:"MaxViews,omitempty"`
+	Views     int        `json:"Views"`
+	RevokedAt *time.Time `json:"RevokedAt,omitempty"`
+}
+
+// shareRequest is the JSON request body of the share endpoints
+type shareRequest struct {
+	PhotoID   string     `json:"PhotoID"`
+	ShareID   string     `json:"ShareID"`
+	ExpiresAt *time.Time `json:"ExpiresAt"`
+	MaxViews  *int       `json:"MaxViews"`
+}
+
+// shareResponse is returned when a link is created, it is the only time the token is revealed
+type shareResponse struct {
+	ShareLink
+	Token string `json:"Token"`
+	Path  string `json:"Path"`
+}
+
+// validateShareLimits makes sure the optional expiry is in the future and the optional view limit is positive
+func validateShareLimits(request shareRequest, now time.Time) error {
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(now) {
+		return fmt.Errorf("ExpiresAt must be in the future")
+	}
+
+	if request.MaxViews != nil && *request.MaxViews < 1 {
+		return fmt.Errorf("MaxViews must be at least 1")
+	}
+
+	return nil
+}
+
+// CreateShareLink mints a share link for a photo owned by the user
+func CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var request shareRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Malformed json"))
+		return
+	}
+
+	if err := validateShareLimits(request, time.Now()); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	photo, status, err := getPhotoOwnedBy(request.PhotoID, *userID)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	link := ShareLink{
+		ID:        uuid.New().String(),
+		PhotoID:   photo.ID,
+		TokenHash: tokenHash,
+		ExpiresAt: request.ExpiresAt,
+		MaxViews:  request.MaxViews,
+	}
+	if result := DB.Create(&link); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	// The link exists before the photo is stripped, so versions uploaded in the meantime are stripped as they are stored
+	if err := stripSharedPhoto(r.Context(), *photo); err != nil {
+		DB.Delete(&link)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	response, err := json.Marshal(shareResponse{ShareLink: link, Token: token, Path: "/photo/shared/" + token})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// ListShareLinks returns every share link of a photo owned by the user, including expired and revoked ones
+func ListShareLinks(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var request shareRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Malformed json"))
+		return
+	}
+
+	photo, status, err := getPhotoOwnedBy(request.PhotoID, *userID)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	links := []ShareLink{}
+	if result := DB.Where(&ShareLink{PhotoID: photo.ID}).Order("created_at DESC").Find(&links); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	response, err := json.Marshal(links)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// RevokeShareLink stops a share link of a photo owned by the user from working
+func RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var request shareRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.ShareID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("ShareID not provided in request body"))
+		return
+	}
+
+	var link ShareLink
+	DB.Where(&ShareLink{ID: request.ShareID}).First(&link)
+	if link.ID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("share link with id not found"))
+		return
+	}
+
+	if _, status, err := getPhotoOwnedBy(link.PhotoID, *userID); err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if result := DB.Model(&link).Where("revoked_at IS NULL").Update("revoked_at", time.Now()); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("share link revoked"))
+}
+
+// isPhotoShared reports whether anyone other than its owner can see the photo, through a share link that has not been revoked or a grant
+func isPhotoShared(db *gorm.DB, photoID string) (bool, error) {
+	var links int64
+	if err := db.Model(&ShareLink{}).Where(&ShareLink{PhotoID: photoID}).Where("revoked_at IS NULL").Count(&links).Error; err != nil {
+		return false, err
+	}
+
+	var grants int64
+	if err := db.Model(&PhotoGrant{}).Where(&PhotoGrant{PhotoID: photoID}).Count(&grants).Error; err != nil {
+		return false, err
+	}
+
+	return links > 0 || grants > 0, nil
+}
+
+// consumeShareLink counts a view of the link with the given token and returns it, provided it is still usable
+// The check and the increment happen in a single statement so concurrent views cannot exceed MaxViews
+func consumeShareLink(db *gorm.DB, token string, now time.Time) (*ShareLink, error) {
+	tokenHash := hashOpaqueToken(token)
+	result := db.Model(&ShareLink{}).
+		Where("token_hash = ? AND revoked_at IS NULL", tokenHash).
+		Where("expires_at IS NULL OR expires_at > ?", now).
+		Where("max_views IS NULL OR views < max_views").
+		Update("views", gorm.Expr("views + 1"))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	var link ShareLink
+	if result := db.Where(&ShareLink{TokenHash: tokenHash}).First(&link); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &link, nil
+}
+
+// GetSharedPhoto returns the details of the photo a share link points to, to anyone holding its token
+// Expired, revoked and used up links are reported as not found so they reveal nothing about the photo
+func GetSharedPhoto(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/shared/")
+	if token == "" || strings.Contains(token, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	link, err := consumeShareLink(DB, token, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if link == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("share link not found"))
+		return
+	}
+
+	var photo Photo
+	DB.Preload("Renditions").Preload("Metadata").Preload("Tags").Where(&Photo{ID: link.PhotoID, State: PhotoStateActive}).First(&photo)
+	if photo.ID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("share link not found"))
+		return
+	}
+
+	writePhotoDetails(w, photo, false)
+}
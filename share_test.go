@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_validateShareLimits(t *testing.T) {
+	now := time.Now()
+	future := now.Add(time.Hour)
+	past := now.Add(-time.Hour)
+	one := 1
+	zero := 0
+
+	if err := validateShareLimits(shareRequest{ExpiresAt: &future, MaxViews: &one}, now); err != nil {
+		t.Errorf("valid limits rejected, got %v", err)
+	}
+
+	if err := validateShareLimits(shareRequest{}, now); err != nil {
+		t.Errorf("limits should be optional, got %v", err)
+	}
+
+	for _, request := range []shareRequest{{ExpiresAt: &past}, {ExpiresAt: &now}, {MaxViews: &zero}} {
+		if err := validateShareLimits(request, now); err == nil {
+			t.Errorf("%+v should be rejected", request)
+		}
+	}
+}
+
+func TestGetSharedPhoto_invalidPath(t *testing.T) {
+	for _, path := range []string{"/shared/", "/shared/a/b"} {
+		w := httptest.NewRecorder()
+		GetSharedPhoto(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 404 {
+			t.Errorf("%s should not be found, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestGetSharedPhoto_stripsLocation(t *testing.T) {
+	useTestDB(t)
+	store := useTestStore(t)
+	defer func(mode string) { ExifStripMode = mode }(ExifStripMode)
+	ExifStripMode = "public"
+
+	owner := createTestUser(t)
+	original := buildTestJPEG(t, buildTestExif())
+	photo := createTestPhoto(t, owner, original, false)
+
+	w := httptest.NewRecorder()
+	CreateShareLink(w, requestAs(t, &owner, "POST", "/photo/share", shareRequest{PhotoID: photo.ID}))
+	if w.Code != 200 {
+		t.Fatalf("share link not created, got %d %s", w.Code, w.Body.String())
+	}
+
+	var link shareResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &link); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	GetSharedPhoto(w, httptest.NewRequest("GET", "/shared/"+link.Token, nil))
+	if w.Code != 200 {
+		t.Fatalf("shared photo not returned, got %d %s", w.Code, w.Body.String())
+	}
+
+	var shared Photo
+	if err := json.Unmarshal(w.Body.Bytes(), &shared); err != nil {
+		t.Fatal(err)
+	}
+
+	image := store.fetch(t, shared.ImageURL)
+	metadata := extractMetadata(bytes.NewReader(image))
+	if metadata == nil || metadata.CameraMake != "Canon" {
+		t.Fatalf("non sensitive exif of the shared image should be kept")
+	}
+	if metadata.GPSLatitude != nil || metadata.GPSLongitude != nil || bytes.Contains(image, []byte("GPSLatitude")) {
+		t.Errorf("shared image reveals where the photo was taken")
+	}
+
+	// The quota of the owner only counts the stripped image
+	var stored Photo
+	DB.Preload("Versions").Preload("User").Where(&Photo{ID: photo.ID}).First(&stored)
+	if stored.Size != int64(len(image)) || stored.Versions[0].Size != int64(len(image)) || stored.User.UsedBytes != int64(len(image)) {
+		t.Errorf("size of the stripped image not recorded, got %d, %d and %d bytes used for %d bytes", stored.Size, stored.Versions[0].Size, stored.User.UsedBytes, len(image))
+	}
+}
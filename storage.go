@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrObjectNotExist is returned by a BlobStore when the requested object does not exist, regardless of backend
+var ErrObjectNotExist = errors.New("blobstore: object doesn't exist")
+
+// BlobStore is the object storage backend photos are stored in
+// Objects are grouped into buckets, there is one bucket for public photos and one bucket per user for their private photos
+type BlobStore interface {
+	// CreateBucket creates a new empty bucket
+	CreateBucket(ctx context.Context, bucket string) error
+	// BucketExists reports whether the bucket has been created
+	BucketExists(ctx context.Context, bucket string) (bool, error)
+	// Put writes the size bytes of r to the object, replacing the object if it already exists, size is -1 when unknown
+	Put(ctx context.Context, bucket string, object string, r io.Reader, size int64) error
+	// Get opens the object for reading, the caller must close the returned reader
+	Get(ctx context.Context, bucket string, object string) (io.ReadCloser, error)
+	// Delete removes the object from the bucket
+	Delete(ctx context.Context, bucket string, object string) error
+	// Copy copies the object from srcBucket to dstBucket keeping the same object name
+	Copy(ctx context.Context, srcBucket string, dstBucket string, object string) error
+	// Move copies the object from srcBucket to dstBucket and then deletes it from srcBucket
+	Move(ctx context.Context, srcBucket string, dstBucket string, object string) error
+	// List returns the names of all objects in the bucket, in lexical order
+	List(ctx context.Context, bucket string) ([]string, error)
+	// SignedURL returns a URL that grants read access to the object until expires
+	SignedURL(bucket string, object string, expires time.Time) (string, error)
+}
+
+// Store is the global storage backend selected at startup
+var Store BlobStore
+
+// NewBlobStore returns the storage backend with the given name, the backend is selected with STORAGE_BACKEND in .env
+func NewBlobStore(ctx context.Context, backend string) (BlobStore, error) {
+	switch backend {
+	case "", "gcs":
+		return newGCSStore(ctx)
+	case "fs":
+		signingKey := os.Getenv("BLOB_SIGNING_KEY")
+		if signingKey == "" {
+			return nil, fmt.Errorf("BLOB_SIGNING_KEY must be set to use the fs storage backend")
+		}
+		return newFSStore(getEnvOrDefault("FS_STORAGE_ROOT", "storage"), getEnvOrDefault("PUBLIC_URL", "http://localhost:8080"), []byte(signingKey))
+	case "s3":
+		return newS3Store(s3Config{
+			Endpoint:       os.Getenv("S3_ENDPOINT"),
+			PublicEndpoint: os.Getenv("S3_PUBLIC_ENDPOINT"),
+			AccessKey:      os.Getenv("S3_ACCESS_KEY"),
+			SecretKey:      os.Getenv("S3_SECRET_KEY"),
+			Region:         getEnvOrDefault("S3_REGION", "us-east-1"),
+			UseSSL:         os.Getenv("S3_USE_SSL") == "true",
+			BucketPrefix:   os.Getenv("S3_BUCKET_PREFIX"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// moveObject implements Move for backends that have no native move operation
+func moveObject(ctx context.Context, store BlobStore, srcBucket string, dstBucket string, object string) error {
+	if err := store.Copy(ctx, srcBucket, dstBucket, object); err != nil {
+		return err
+	}
+
+	return store.Delete(ctx, srcBucket, object)
+}
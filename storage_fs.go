@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fsStore is a BlobStore backed by the local filesystem, each bucket is a directory under root and each object a file within it
+// Objects are served by fsStore itself on /blob/, but only for URLs carrying a valid, unexpired HMAC signature
+type fsStore struct {
+	root string
+	// baseURL is the externally reachable address of this server, signed URLs are built relative to it
+	baseURL string
+	// signingKey is used to sign and verify download URLs
+	signingKey []byte
+}
+
+func newFSStore(root string, baseURL string, signingKey []byte) (BlobStore, error) {
+	if len(signingKey) == 0 {
+		return nil, fmt.Errorf("filesystem storage backend requires a signing key")
+	}
+
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, err
+	}
+
+	return &fsStore{root: root, baseURL: strings.TrimSuffix(baseURL, "/"), signingKey: signingKey}, nil
+}
+
+// validBlobName makes sure bucket and object names cannot be used to escape the storage root
+func validBlobName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+func (s *fsStore) bucketPath(bucket string) (string, error) {
+	if !validBlobName(bucket) {
+		return "", fmt.Errorf("invalid bucket name %q", bucket)
+	}
+
+	return filepath.Join(s.root, bucket), nil
+}
+
+func (s *fsStore) path(bucket string, object string) (string, error) {
+	dir, err := s.bucketPath(bucket)
+	if err != nil {
+		return "", err
+	}
+
+	if !validBlobName(object) {
+		return "", fmt.Errorf("invalid object name %q", object)
+	}
+
+	return filepath.Join(dir, object), nil
+}
+
+func (s *fsStore) CreateBucket(ctx context.Context, bucket string) error {
+	dir, err := s.bucketPath(bucket)
+	if err != nil {
+		return err
+	}
+
+	return os.Mkdir(dir, 0o750)
+}
+
+func (s *fsStore) BucketExists(ctx context.Context, bucket string) (bool, error) {
+	dir, err := s.bucketPath(bucket)
+	if err != nil {
+		return false, err
+	}
+
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return info.IsDir(), nil
+}
+
+// Put writes to a temporary file first and renames it into place so readers never see a partially written object
+func (s *fsStore) Put(ctx context.Context, bucket string, object string, r io.Reader, size int64) error {
+	dst, err := s.path(bucket, object)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (s *fsStore) Get(ctx context.Context, bucket string, object string) (io.ReadCloser, error) {
+	src, err := s.path(bucket, object)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotExist
+	}
+
+	return file, err
+}
+
+func (s *fsStore) Delete(ctx context.Context, bucket string, object string) error {
+	src, err := s.path(bucket, object)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(src)
+	if os.IsNotExist(err) {
+		return ErrObjectNotExist
+	}
+
+	return err
+}
+
+func (s *fsStore) Copy(ctx context.Context, srcBucket string, dstBucket string, object string) error {
+	src, err := s.Get(ctx, srcBucket, object)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return s.Put(ctx, dstBucket, object, src, -1)
+}
+
+// Move renames the file between bucket directories, which is atomic as long as both live on the same filesystem
+func (s *fsStore) Move(ctx context.Context, srcBucket string, dstBucket string, object string) error {
+	src, err := s.path(srcBucket, object)
+	if err != nil {
+		return err
+	}
+
+	dst, err := s.path(dstBucket, object)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(src, dst)
+	if os.IsNotExist(err) {
+		return ErrObjectNotExist
+	}
+
+	return err
+}
+
+// List skips files that are not objects, such as temporary files left behind by an interrupted Put
+func (s *fsStore) List(ctx context.Context, bucket string) ([]string, error) {
+	dir, err := s.bucketPath(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []string
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && validBlobName(entry.Name()) {
+			objects = append(objects, entry.Name())
+		}
+	}
+
+	return objects, nil
+}
+
+// SignedURL returns a URL to the /blob/ handler carrying an expiry and a signature over the object and expiry
+func (s *fsStore) SignedURL(bucket string, object string, expires time.Time) (string, error) {
+	if _, err := s.path(bucket, object); err != nil {
+		return "", err
+	}
+
+	expiresUnix := strconv.FormatInt(expires.Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expiresUnix)
+	query.Set("signature", s.sign(bucket, object, expiresUnix))
+
+	return s.baseURL + "/blob/" + url.PathEscape(bucket) + "/" + url.PathEscape(object) + "?" + query.Encode(), nil
+}
+
+func (s *fsStore) sign(bucket string, object string, expires string) string {
+	mac := hmac.New(sha256.New, s.signingKey)
+	mac.Write([]byte(bucket + "/" + object + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signature of a download URL and that it has not expired yet
+func (s *fsStore) verify(bucket string, object string, expires string, signature string, now time.Time) bool {
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > expiresUnix {
+		return false
+	}
+
+	expected, err := hex.DecodeString(s.sign(bucket, object, expires))
+	if err != nil {
+		return false
+	}
+
+	provided, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(expected, provided)
+}
+
+// ServeHTTP serves objects for URLs generated by SignedURL, it expects to be mounted with the /blob prefix stripped
+func (s *fsStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	bucket, object := parts[0], parts[1]
+
+	query := r.URL.Query()
+	if !s.verify(bucket, object, query.Get("expires"), query.Get("signature"), time.Now()) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid or expired signature"))
+		return
+	}
+
+	src, err := s.path(bucket, object)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(src)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private")
+	http.ServeContent(w, r, object, info.ModTime(), file)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestFSStore(t *testing.T) *fsStore {
+	store, err := newFSStore(t.TempDir(), "http://localhost:8080", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store.(*fsStore)
+}
+
+func TestNewBlobStore_fsRequiresSigningKey(t *testing.T) {
+	key, set := os.LookupEnv("BLOB_SIGNING_KEY")
+	os.Unsetenv("BLOB_SIGNING_KEY")
+	os.Setenv("FS_STORAGE_ROOT", t.TempDir())
+	t.Cleanup(func() {
+		os.Unsetenv("FS_STORAGE_ROOT")
+		os.Unsetenv("BLOB_SIGNING_KEY")
+		if set {
+			os.Setenv("BLOB_SIGNING_KEY", key)
+		}
+	})
+
+	if _, err := NewBlobStore(context.Background(), "fs"); err == nil {
+		t.Errorf("fs backend should not start without BLOB_SIGNING_KEY")
+	}
+
+	os.Setenv("BLOB_SIGNING_KEY", "secret")
+	if _, err := NewBlobStore(context.Background(), "fs"); err != nil {
+		t.Errorf("fs backend should start with BLOB_SIGNING_KEY, got %v", err)
+	}
+}
+
+func Test_fsStore(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFSStore(t)
+
+	exists, err := store.BucketExists(ctx, "user")
+	if err != nil || exists {
+		t.Fatalf("bucket should not exist before being created")
+	}
+
+	store.CreateBucket(ctx, "user")
+	store.CreateBucket(ctx, PUBLIC_BUCKET_NAME)
+
+	exists, err = store.BucketExists(ctx, "user")
+	if err != nil || !exists {
+		t.Fatalf("bucket should exist after being created")
+	}
+
+	if err := store.Put(ctx, "user", "photo", strings.NewReader("contents"), 8); err != nil {
+		t.Fatal(err)
+	}
+
+	// Temporary files of an interrupted Put are not objects
+	ioutil.WriteFile(filepath.Join(store.root, "user", ".tmp-123"), nil, 0o640)
+	objects, err := store.List(ctx, "user")
+	if err != nil || strings.Join(objects, ",") != "photo" {
+		t.Errorf("unexpected objects %v %v", objects, err)
+	}
+
+	if err := store.Move(ctx, "user", PUBLIC_BUCKET_NAME, "photo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get(ctx, "user", "photo"); err != ErrObjectNotExist {
+		t.Errorf("object still exists in source bucket after move")
+	}
+
+	reader, err := store.Get(ctx, PUBLIC_BUCKET_NAME, "photo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(data) != "contents" {
+		t.Errorf("object contents changed during move")
+	}
+
+	if err := store.Delete(ctx, PUBLIC_BUCKET_NAME, "photo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(ctx, PUBLIC_BUCKET_NAME, "photo"); err != ErrObjectNotExist {
+		t.Errorf("deleting a missing object should return ErrObjectNotExist, got %v", err)
+	}
+}
+
+func Test_fsStore_rejectsPathTraversal(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFSStore(t)
+
+	for _, name := range []string{"", "..", "../etc", "a/b", `a\\b`, ".hidden"} {
+		if err := store.Put(ctx, "user", name, strings.NewReader(""), 0); err == nil {
+			t.Errorf("object name %q should be rejected", name)
+		}
+
+		if err := store.CreateBucket(ctx, name); err == nil {
+			t.Errorf("bucket name %q should be rejected", name)
+		}
+	}
+}
+
+func Test_fsStore_ServeHTTP(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFSStore(t)
+	store.CreateBucket(ctx, "user")
+	store.Put(ctx, "user", "photo", strings.NewReader("contents"), 8)
+
+	serve := func(rawURL string) *httptest.ResponseRecorder {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		http.StripPrefix("/blob", store).ServeHTTP(w, httptest.NewRequest("GET", u.RequestURI(), nil))
+		return w
+	}
+
+	signedURL, err := store.SignedURL("user", "photo", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(signedURL)
+	if w.Code != http.StatusOK || w.Body.String() != "contents" {
+		t.Errorf("valid signed url not served, got %d", w.Code)
+	}
+
+	// signature for one object must not grant access to another
+	tampered := strings.Replace(signedURL, "/user/photo", "/user/other", 1)
+	if w := serve(tampered); w.Code != http.StatusForbidden {
+		t.Errorf("tampered url should be forbidden, got %d", w.Code)
+	}
+
+	unsigned := strings.Split(signedURL, "?")[0]
+	if w := serve(unsigned); w.Code != http.StatusForbidden {
+		t.Errorf("unsigned url should be forbidden, got %d", w.Code)
+	}
+
+	expiredURL, _ := store.SignedURL("user", "photo", time.Now().Add(-time.Minute))
+	if w := serve(expiredURL); w.Code != http.StatusForbidden {
+		t.Errorf("expired url should be forbidden, got %d", w.Code)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"strings"
+	"time"
+)
+
+// s3Store is a BlobStore backed by Amazon S3 or any S3 compatible API such as MinIO
+type s3Store struct {
+	client *minio.Client
+	// presignClient signs download URLs, it differs from client when the endpoint reachable by browsers is not the one the server talks to
+	presignClient *minio.Client
+	// bucketPrefix is prepended to every bucket name, as S3 bucket names are global across all accounts
+	bucketPrefix string
+	region       string
+}
+
+// s3MinPartSize is the smallest part S3 accepts in a multipart upload, other than the last part
+const s3MinPartSize = 5 << 20
+
+// s3Config holds the connection details for an S3 compatible endpoint, loaded from S3_* attributes in .env
+type s3Config struct {
+	Endpoint       string
+	PublicEndpoint string
+	AccessKey      string
+	SecretKey      string
+	Region         string
+	UseSSL         bool
+	BucketPrefix   string
+}
+
+func newS3Store(config s3Config) (BlobStore, error) {
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT must be set to use the s3 storage backend")
+	}
+
+	options := &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Region,
+	}
+
+	client, err := minio.New(config.Endpoint, options)
+	if err != nil {
+		return nil, err
+	}
+
+	presignClient := client
+	if config.PublicEndpoint != "" && config.PublicEndpoint != config.Endpoint {
+		// Presigning is done offline, the region must be known upfront so the client does not try to look it up via the public endpoint
+		presignClient, err = minio.New(config.PublicEndpoint, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &s3Store{client: client, presignClient: presignClient, bucketPrefix: config.BucketPrefix, region: config.Region}, nil
+}
+
+// bucketName maps a bucket name used by image-repo to a valid S3 bucket name
+// S3 only allows lowercase letters, numbers, dots and hyphens, so underscores (e.g. in PUBLIC_BUCKET_NAME) are replaced with hyphens
+func (s *s3Store) bucketName(bucket string) string {
+	return strings.ToLower(s.bucketPrefix + strings.ReplaceAll(bucket, "_", "-"))
+}
+
+// isNoSuchKey reports whether err means the object (or the bucket holding it) does not exist
+func isNoSuchKey(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NoSuchBucket"
+}
+
+func (s *s3Store) CreateBucket(ctx context.Context, bucket string) error {
+	return s.client.MakeBucket(ctx, s.bucketName(bucket), minio.MakeBucketOptions{Region: s.region})
+}
+
+func (s *s3Store) BucketExists(ctx context.Context, bucket string) (bool, error) {
+	return s.client.BucketExists(ctx, s.bucketName(bucket))
+}
+
+// Put uploads objects of a known size in as few requests as possible, objects of an unknown size are buffered one part at a time
+// minio buffers parts of up to 5TiB / 10000 (over 500MiB) for unknown sizes, so the part size is bounded to the smallest S3 allows
+func (s *s3Store) Put(ctx context.Context, bucket string, object string, r io.Reader, size int64) error {
+	options := minio.PutObjectOptions{}
+	if size < 0 {
+		options.PartSize = s3MinPartSize
+	}
+
+	if _, err := s.client.PutObject(ctx, s.bucketName(bucket), object, r, size, options); err != nil {
+		return fmt.Errorf("PutObject(%q): %v", object, err)
+	}
+
+	return nil
+}
+
+// Get stats the object first, as GetObject is lazy and would only report a missing object on the first read
+func (s *s3Store) Get(ctx context.Context, bucket string, object string) (io.ReadCloser, error) {
+	if _, err := s.client.StatObject(ctx, s.bucketName(bucket), object, minio.StatObjectOptions{}); err != nil {
+		if isNoSuchKey(err) {
+			return nil, ErrObjectNotExist
+		}
+		return nil, err
+	}
+
+	return s.client.GetObject(ctx, s.bucketName(bucket), object, minio.GetObjectOptions{})
+}
+
+// Delete stats the object first, as deleting a missing object is not an error in S3
+func (s *s3Store) Delete(ctx context.Context, bucket string, object string) error {
+	if _, err := s.client.StatObject(ctx, s.bucketName(bucket), object, minio.StatObjectOptions{}); err != nil {
+		if isNoSuchKey(err) {
+			return ErrObjectNotExist
+		}
+		return err
+	}
+
+	if err := s.client.RemoveObject(ctx, s.bucketName(bucket), object, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("RemoveObject(%q): %v", object, err)
+	}
+
+	return nil
+}
+
+func (s *s3Store) Copy(ctx context.Context, srcBucket string, dstBucket string, object string) error {
+	_, err := s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucketName(dstBucket), Object: object},
+		minio.CopySrcOptions{Bucket: s.bucketName(srcBucket), Object: object},
+	)
+	if isNoSuchKey(err) {
+		return ErrObjectNotExist
+	}
+	if err != nil {
+		return fmt.Errorf("CopyObject(%q, %q): %v", object, srcBucket, err)
+	}
+
+	return nil
+}
+
+func (s *s3Store) Move(ctx context.Context, srcBucket string, dstBucket string, object string) error {
+	return moveObject(ctx, s, srcBucket, dstBucket, object)
+}
+
+// List pages through the bucket with ListObjects, which returns keys in lexical order
+func (s *s3Store) List(ctx context.Context, bucket string) ([]string, error) {
+	var objects []string
+	for info := range s.client.ListObjects(ctx, s.bucketName(bucket), minio.ListObjectsOptions{Recursive: true}) {
+		if info.Err != nil {
+			return nil, fmt.Errorf("ListObjects(%q): %v", bucket, info.Err)
+		}
+
+		objects = append(objects, info.Key)
+	}
+
+	return objects, nil
+}
+
+// SignedURL returns a presigned GET URL, S3 limits the expiry of presigned URLs to at most 7 days
+func (s *s3Store) SignedURL(bucket string, object string, expires time.Time) (string, error) {
+	url, err := s.presignClient.PresignedGetObject(context.Background(), s.bucketName(bucket), object, time.Until(expires), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return url.String(), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/google/uuid"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_s3Store_bucketName(t *testing.T) {
+	store := &s3Store{bucketPrefix: "Image-Repo-"}
+
+	if name := store.bucketName(PUBLIC_BUCKET_NAME); name != "image-repo-shopify-image-repo-public" {
+		t.Errorf("public bucket name not mapped to a valid S3 bucket name, got %s", name)
+	}
+
+	userBucket := "6f2fd621-eeb6-4477-86b3-42d986697b43"
+	if name := store.bucketName(userBucket); name != "image-repo-"+userBucket {
+		t.Errorf("user bucket name not mapped to a valid S3 bucket name, got %s", name)
+	}
+}
+
+// fakeS3 records the size of every object and part uploaded to it, it implements just enough of the S3 API for PutObject
+type fakeS3 struct {
+	mu    sync.Mutex
+	puts  []int64
+	parts []int64
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Requests signed with a streaming signature carry the size of the payload in a separate header
+	size := r.ContentLength
+	if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" {
+		size, _ = strconv.ParseInt(decoded, 10, 64)
+	}
+	ioutil.ReadAll(r.Body)
+
+	query := r.URL.Query()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && query.Get("uploadId") == "":
+		w.Write([]byte("<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>photo</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>"))
+	case r.Method == http.MethodPost:
+		w.Write([]byte("<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>photo</Key><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>"))
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		f.parts = append(f.parts, size)
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == http.MethodPut:
+		f.puts = append(f.puts, size)
+		w.Header().Set("ETag", `"etag"`)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func Test_s3Store_Put(t *testing.T) {
+	fake := &fakeS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	store, err := newS3Store(s3Config{Endpoint: strings.TrimPrefix(server.URL, "http://"), AccessKey: "key", SecretKey: "secret", Region: "us-east-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("a"), s3MinPartSize+1024)
+
+	// Objects of a known size are uploaded in a single request of that size
+	if err := store.Put(ctx, "bucket", "photo", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.puts) != 1 || fake.puts[0] != int64(len(data)) || len(fake.parts) != 0 {
+		t.Errorf("object of known size not uploaded in one request of its size, got puts %v and parts %v", fake.puts, fake.parts)
+	}
+
+	// Objects of an unknown size are uploaded in parts of the smallest size S3 allows
+	fake.puts = nil
+	if err := store.Put(ctx, "bucket", "photo", bytes.NewReader(data), -1); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.puts) != 0 || len(fake.parts) != 2 || fake.parts[0] != s3MinPartSize || fake.parts[1] != 1024 {
+		t.Errorf("object of unknown size not uploaded in parts of %d bytes, got puts %v and parts %v", s3MinPartSize, fake.puts, fake.parts)
+	}
+}
+
+// Test_s3Store runs against a real S3 compatible endpoint, e.g. the minio service in docker-compose.yml:
+// S3_TEST_ENDPOINT=localhost:9000 S3_TEST_ACCESS_KEY=minioadmin S3_TEST_SECRET_KEY=minioadmin go test -run Test_s3Store
+func Test_s3Store(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+
+	ctx := context.Background()
+	store, err := newS3Store(s3Config{
+		Endpoint:     endpoint,
+		AccessKey:    os.Getenv("S3_TEST_ACCESS_KEY"),
+		SecretKey:    os.Getenv("S3_TEST_SECRET_KEY"),
+		Region:       "us-east-1",
+		BucketPrefix: "test-",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userBucket := uuid.New().String()
+	for _, bucket := range []string{userBucket, PUBLIC_BUCKET_NAME} {
+		exists, err := store.BucketExists(ctx, bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			if err := store.CreateBucket(ctx, bucket); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	photoID := uuid.New().String()
+	if err := store.Put(ctx, userBucket, photoID, strings.NewReader("contents"), 8); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Move(ctx, userBucket, PUBLIC_BUCKET_NAME, photoID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get(ctx, userBucket, photoID); err != ErrObjectNotExist {
+		t.Errorf("object still exists in source bucket after move, got %v", err)
+	}
+
+	objects, err := store.List(ctx, userBucket)
+	if err != nil || len(objects) != 0 {
+		t.Errorf("source bucket should be empty after move, got %v %v", objects, err)
+	}
+
+	signedURL, err := store.SignedURL(PUBLIC_BUCKET_NAME, photoID, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(signedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(data) != "contents" {
+		t.Errorf("presigned url did not return object, got %d", resp.StatusCode)
+	}
+
+	if err := store.Delete(ctx, PUBLIC_BUCKET_NAME, photoID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(ctx, PUBLIC_BUCKET_NAME, photoID); err != ErrObjectNotExist {
+		t.Errorf("deleting a missing object should return ErrObjectNotExist, got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is an in memory BlobStore for use in unit tests
+type memStore struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{buckets: map[string]map[string][]byte{}}
+}
+
+func (s *memStore) CreateBucket(ctx context.Context, bucket string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket] = map[string][]byte{}
+	return nil
+}
+
+func (s *memStore) BucketExists(ctx context.Context, bucket string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.buckets[bucket]
+	return ok, nil
+}
+
+func (s *memStore) Put(ctx context.Context, bucket string, object string, r io.Reader, size int64) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket][object] = data
+	return nil
+}
+
+func (s *memStore) Get(ctx context.Context, bucket string, object string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.buckets[bucket][object]
+	if !ok {
+		return nil, ErrObjectNotExist
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memStore) Delete(ctx context.Context, bucket string, object string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket][object]; !ok {
+		return ErrObjectNotExist
+	}
+
+	delete(s.buckets[bucket], object)
+	return nil
+}
+
+func (s *memStore) Copy(ctx context.Context, srcBucket string, dstBucket string, object string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.buckets[srcBucket][object]
+	if !ok {
+		return ErrObjectNotExist
+	}
+
+	s.buckets[dstBucket][object] = data
+	return nil
+}
+
+func (s *memStore) Move(ctx context.Context, srcBucket string, dstBucket string, object string) error {
+	return moveObject(ctx, s, srcBucket, dstBucket, object)
+}
+
+func (s *memStore) List(ctx context.Context, bucket string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var objects []string
+	for object := range s.buckets[bucket] {
+		objects = append(objects, object)
+	}
+
+	sort.Strings(objects)
+	return objects, nil
+}
+
+func (s *memStore) SignedURL(bucket string, object string, expires time.Time) (string, error) {
+	return "mem://" + bucket + "/" + object, nil
+}
+
+// useTestStore replaces Store with an empty memStore for the duration of the test
+func useTestStore(t *testing.T) *memStore {
+	previous := Store
+	store := newMemStore()
+	Store = store
+	t.Cleanup(func() { Store = previous })
+
+	store.CreateBucket(context.Background(), PUBLIC_BUCKET_NAME)
+	return store
+}
+
+// fetch returns the contents of the object a URL returned by SignedURL points to
+func (s *memStore) fetch(t *testing.T, url string) []byte {
+	path := strings.SplitN(strings.TrimPrefix(url, "mem://"), "/", 2)
+	if len(path) != 2 {
+		t.Fatalf("%q is not a memStore URL", url)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.buckets[path[0]][path[1]]
+	if !ok {
+		t.Fatalf("object of %q does not exist", url)
+	}
+
+	return data
+}
+
+func Test_moveObject(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+	store.CreateBucket(ctx, "src")
+	store.CreateBucket(ctx, "dst")
+
+	if err := store.Put(ctx, "src", "photo", strings.NewReader("contents"), 8); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := moveObject(ctx, store, "src", "dst", "photo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get(ctx, "src", "photo"); err != ErrObjectNotExist {
+		t.Errorf("object still exists in source bucket after move")
+	}
+
+	reader, err := store.Get(ctx, "dst", "photo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	data, _ := ioutil.ReadAll(reader)
+	if string(data) != "contents" {
+		t.Errorf("object contents changed during move")
+	}
+
+	// moving an object that does not exist should fail without touching the destination
+	if err := moveObject(ctx, store, "src", "dst", "missing"); err != ErrObjectNotExist {
+		t.Errorf("expected ErrObjectNotExist, got %v", err)
+	}
+}
+
+func TestGetURLForImage(t *testing.T) {
+	Store = newMemStore()
+
+	photo := Photo{ID: "f2dcddbf-576c-4816-b3dd-3b20e5faf716", IsPublic: true, UserID: "6f2fd621-eeb6-4477-86b3-42d986697b43"}
+	url, err := GetURLForImage(photo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if url != "mem://"+PUBLIC_BUCKET_NAME+"/"+photo.ID {
+		t.Errorf("url not generated from photo bucket and id, got %s", url)
+	}
+}
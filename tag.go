@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm/clause"
+	"strings"
+)
+
+// Limits on the free text attached to photos
+const maxTitleLength = 200
+const maxDescriptionLength = 5000
+const maxTagLength = 50
+const maxTagsPerPhoto = 20
+
+// Tag is a label photos can be tagged with, each tag is shared by every photo carrying it
+// Tags are represented in JSON by just their name
+type Tag struct {
+	ID   uint   `gorm:"primaryKey"`
+	Name string `gorm:"uniqueIndex"`
+}
+
+func (t Tag) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Name)
+}
+
+func (t *Tag) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &t.Name)
+}
+
+// parseTagList splits a comma separated list of tags, as accepted by Upload
+func parseTagList(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+
+	return strings.Split(value, ",")
+}
+
+// normalizeTags lowercases and trims tag names, dropping empty and duplicate tags
+func normalizeTags(names []string) ([]string, error) {
+	var normalized []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+
+		if len(name) > maxTagLength {
+			return nil, fmt.Errorf("tags must be at most %d characters", maxTagLength)
+		}
+
+		seen[name] = true
+		normalized = append(normalized, name)
+	}
+
+	if len(normalized) > maxTagsPerPhoto {
+		return nil, fmt.Errorf("photos can have at most %d tags", maxTagsPerPhoto)
+	}
+
+	return normalized, nil
+}
+
+// validatePhotoText makes sure a title and description are within the length limits
+func validatePhotoText(title string, description string) error {
+	if len(title) > maxTitleLength {
+		return fmt.Errorf("Title must be at most %d characters", maxTitleLength)
+	}
+
+	if len(description) > maxDescriptionLength {
+		return fmt.Errorf("Description must be at most %d characters", maxDescriptionLength)
+	}
+
+	return nil
+}
+
+// findOrCreateTags returns the tags with the given normalized names, creating any that do not exist yet
+// Creation ignores conflicts, so concurrent requests introducing the same tag both end up with the one row
+func findOrCreateTags(names []string) ([]Tag, error) {
+	tags := []Tag{}
+	for _, name := range names {
+		if result := DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&Tag{Name: name}); result.Error != nil {
+			return nil, result.Error
+		}
+
+		var tag Tag
+		if result := DB.Where(&Tag{Name: name}).First(&tag); result.Error != nil {
+			return nil, result.Error
+		}
+
+		tags = append(tags, tag)
+	}
+
+	return tags, nil
+}
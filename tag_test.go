@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func Test_normalizeTags(t *testing.T) {
+	tags, err := normalizeTags(parseTagList(" Sunset, beach,,sunset ,BEACH"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tags) != 2 || tags[0] != "sunset" || tags[1] != "beach" {
+		t.Errorf("tags not normalized, got %v", tags)
+	}
+
+	if tags := parseTagList("  "); tags != nil {
+		t.Errorf("blank tag list should have no tags, got %v", tags)
+	}
+
+	if _, err := normalizeTags([]string{strings.Repeat("a", maxTagLength+1)}); err == nil {
+		t.Errorf("overlong tag should be rejected")
+	}
+
+	var tooMany []string
+	for i := 0; i <= maxTagsPerPhoto; i++ {
+		tooMany = append(tooMany, strings.Repeat("a", i+1))
+	}
+	if _, err := normalizeTags(tooMany); err == nil {
+		t.Errorf("more than %d tags should be rejected", maxTagsPerPhoto)
+	}
+}
+
+func TestTag_JSON(t *testing.T) {
+	data, err := json.Marshal([]Tag{{ID: 1, Name: "sunset"}, {ID: 2, Name: "beach"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != `["sunset","beach"]` {
+		t.Errorf("tags should be represented by their name, got %s", data)
+	}
+
+	var tags []Tag
+	if err := json.Unmarshal(data, &tags); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tags) != 2 || tags[0].Name != "sunset" || tags[1].Name != "beach" {
+		t.Errorf("tags not parsed from their names, got %v", tags)
+	}
+}
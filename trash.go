@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+// Photos stay in the trash for TrashRetention before they are purged, the trash is checked every TrashPurgeInterval
+var TrashRetention = 30 * 24 * time.Hour
+var TrashPurgeInterval = time.Hour
+
+// trashedPhotos restricts a photo query to photos in the trash
+func trashedPhotos(db *gorm.DB) *gorm.DB {
+	return db.Where("photos.state = ?", PhotoStateTrashed)
+}
+
+// trashPurgeAt returns when a trashed photo will be purged, or nil if the photo is not in the trash
+func trashPurgeAt(photo Photo) *time.Time {
+	if photo.State != PhotoStateTrashed || photo.TrashedAt == nil {
+		return nil
+	}
+
+	purgeAt := photo.TrashedAt.Add(TrashRetention)
+	return &purgeAt
+}
+
+// trashPhoto moves an active photo owned by the user to the trash, it disappears right away but keeps its objects until it is purged
+// When an error is returned, status is the HTTP status code to respond with
+func trashPhoto(photoID string, userID string) (int, error) {
+	photo, status, err := getPhotoOwnedBy(photoID, userID)
+	if err != nil {
+		return status, err
+	}
+
+	result := DB.Model(photo).Where("state = ?", PhotoStateActive).Updates(map[string]interface{}{"state": PhotoStateTrashed, "trashed_at": time.Now()})
+	if result.Error != nil {
+		return http.StatusInternalServerError, result.Error
+	}
+
+	// The photo was trashed or deleted by a concurrent request
+	if result.RowsAffected == 0 {
+		return http.StatusNotFound, fmt.Errorf("No photos returned")
+	}
+
+	return http.StatusOK, nil
+}
+
+// restorePhoto brings a photo owned by the user back from the trash
+// When an error is returned, status is the HTTP status code to respond with
+func restorePhoto(photoID string, userID string) (int, error) {
+	photo, status, err := getPhotoInStateOwnedBy(photoID, userID, PhotoStateTrashed)
+	if err != nil {
+		return status, err
+	}
+
+	result := DB.Model(photo).Where("state = ?", PhotoStateTrashed).Updates(map[string]interface{}{"state": PhotoStateActive, "trashed_at": nil})
+	if result.Error != nil {
+		return http.StatusInternalServerError, result.Error
+	}
+
+	// The photo was purged in the meantime
+	if result.RowsAffected == 0 {
+		return http.StatusNotFound, fmt.Errorf("No photos returned")
+	}
+
+	return http.StatusOK, nil
+}
+
+// purgePhoto permanently deletes a photo in the trash, its objects and rows are removed by the outbox
+// Nothing happens if the photo has been restored or purged in the meantime
+func purgePhoto(ctx context.Context, photoID string) error {
+	var event *OutboxEvent
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Photo{}).Where("id = ? AND state = ?", photoID, PhotoStateTrashed).Update("state", PhotoStateDeleting)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return nil
+		}
+
+		var err error
+		event, err = enqueueOutboxEvent(tx, OutboxDeletePhoto, photoID, time.Now())
+		return err
+	})
+	if err != nil || event == nil {
+		return err
+	}
+
+	// Delete the objects and rows right away, if it fails the outbox worker will retry
+	if err := processOutboxEvent(ctx, event.ID); err != nil {
+		fmt.Println("unable to delete photo objects:", err)
+	}
+
+	return nil
+}
+
+// purgeTrash permanently deletes every trashed photo matching the scope and returns how many were purged
+func purgeTrash(ctx context.Context, scope func(*gorm.DB) *gorm.DB) (int, error) {
+	var photoIDs []string
+	if err := DB.Model(&Photo{}).Scopes(trashedPhotos, scope).Pluck("id", &photoIDs).Error; err != nil {
+		return 0, err
+	}
+
+	for i, photoID := range photoIDs {
+		if err := purgePhoto(ctx, photoID); err != nil {
+			return i, err
+		}
+	}
+
+	return len(photoIDs), nil
+}
+
+// GetTrash returns a page of the photos the user moved to the trash, along with when each one will be purged
+func GetTrash(w http.ResponseWriter, r *http.Request) {
+	limit, cursor, err := parseFeedParams(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var photos []Photo
+	result := paginatePhotos(DB.Preload("Renditions").Preload("Tags").Scopes(trashedPhotos).Where(&Photo{UserID: *userID}), limit, cursor).Find(&photos)
+	if result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	writeFeedPage(w, photos, limit)
+}
+
+// Restore allows users to bring photos back from the trash
+func Restore(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var requestedPhoto Photo
+	if err := json.NewDecoder(r.Body).Decode(&requestedPhoto); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Malformed json"))
+		return
+	}
+
+	if requestedPhoto.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("PhotoID not provided in request body"))
+		return
+	}
+
+	if status, err := restorePhoto(requestedPhoto.ID, *userID); err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("photo restored"))
+}
+
+// EmptyTrash allows users to permanently delete every photo in their trash without waiting for it to be purged
+func EmptyTrash(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	purged, err := purgeTrash(r.Context(), func(query *gorm.DB) *gorm.DB {
+		return query.Where("user_id = ?", *userID)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("%d photos permanently deleted", purged)))
+}
+
+// RunTrashPurger permanently deletes photos that have been in the trash for longer than retention, checking every interval
+func RunTrashPurger(interval time.Duration, retention time.Duration) {
+	ctx := context.Background()
+	for {
+		purged, err := purgeTrash(ctx, func(query *gorm.DB) *gorm.DB {
+			return query.Where("trashed_at <= ?", time.Now().Add(-retention))
+		})
+		if err != nil {
+			fmt.Println("trash:", err)
+		} else if purged > 0 {
+			fmt.Printf("trash: purged %d photos\n", purged)
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_trashPurgeAt(t *testing.T) {
+	trashedAt := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	if purgeAt := trashPurgeAt(Photo{State: PhotoStateActive}); purgeAt != nil {
+		t.Errorf("active photo should not be purged, got %v", purgeAt)
+	}
+
+	purgeAt := trashPurgeAt(Photo{State: PhotoStateTrashed, TrashedAt: &trashedAt})
+	if purgeAt == nil || !purgeAt.Equal(trashedAt.Add(TrashRetention)) {
+		t.Errorf("trashed photo should be purged %v after being trashed, got %v", TrashRetention, purgeAt)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Batch uploads accept up to MaxBatchUploadFiles files, which are stored by BatchUploadWorkers workers at a time
+var MaxBatchUploadFiles int64 = 50
+var BatchUploadWorkers int64 = 4
+
+// photoAttributes are the attributes given to photos on upload besides the image itself
+type photoAttributes struct {
+	IsPublic    bool
+	Title       string
+	Description string
+	Tags        []Tag
+}
+
+// parseUploadAttributes reads the IsPublic, Title, Description and comma separated Tags form values of an upload
+// When an error is returned, status is the HTTP status code to respond with
+func parseUploadAttributes(r *http.Request) (*photoAttributes, int, error) {
+	// Get isPublic attribute
+	IsPublicFromValue := r.FormValue("IsPublic")
+	if IsPublicFromValue == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("IsPublic not provided")
+	}
+
+	IsPublic, err := strconv.ParseBool(IsPublicFromValue)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("IsPublic must be true or false")
+	}
+
+	// Get optional Title, Description and comma separated Tags attributes
+	Title := strings.TrimSpace(r.FormValue("Title"))
+	Description := strings.TrimSpace(r.FormValue("Description"))
+	if err := validatePhotoText(Title, Description); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	tagNames, err := normalizeTags(parseTagList(r.FormValue("Tags")))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	tags, err := findOrCreateTags(tagNames)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return &photoAttributes{IsPublic: IsPublic, Title: Title, Description: Description, Tags: tags}, http.StatusOK, nil
+}
+
+// preparedImage is an uploaded image that has been validated and processed but not stored yet
+type preparedImage struct {
+	info       *imageInfo
+	metadata   *PhotoMetadata
+	renditions []renditionData
+	// original is the image to store, with sensitive EXIF tags stripped if requested
+	original io.Reader
+}
+
+// prepareImage validates an uploaded image of at most maxBytes, extracts its metadata, generates its renditions and strips sensitive EXIF tags if strip is set
+// When an error is returned, status is the HTTP status code to respond with
+func prepareImage(file io.ReadSeeker, size int64, maxBytes int64, strip bool) (*preparedImage, int, error) {
+	// Make sure the file is an image within the configured limits
+	info, err := validateImage(file, size, maxBytes)
+	if err != nil {
+		if validationErr, ok := err.(*ImageValidationError); ok {
+			return nil, validationErr.Status, validationErr
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// Extract EXIF metadata before any sensitive tags are stripped
+	metadata := extractMetadata(file)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// Generate downscaled renditions of the photo for grid views
+	orientation, err := imageOrientation(file, info.MimeType, metadata)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	renditions, err := generateRenditions(file, RenditionWidths, orientation)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// Strip GPS and other sensitive EXIF tags from the stored image
+	var original io.Reader = file
+	if strip {
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		stripped, err := stripSensitiveExif(data, info.MimeType)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("unable to strip metadata from image: %v", err)
+		}
+
+		original = bytes.NewReader(stripped)
+		info.Size = int64(len(stripped))
+	}
+
+	return &preparedImage{info: info, metadata: metadata, renditions: renditions, original: original}, http.StatusOK, nil
+}
+
+// newRenditionRows describes the renditions of a version of a photo, renditions that are not downscaled reuse the original of the version
+func newRenditionRows(photoID string, version int, renditions []renditionData) []Rendition {
+	var rows []Rendition
+	for _, rendition := range renditions {
+		objectName := versionObjectName(photoID, version)
+		if rendition.Data != nil {
+			objectName = renditionObjectName(objectName, rendition.Width)
+		}
+		rows = append(rows, Rendition{PhotoID: photoID, Width: rendition.Width, Height: rendition.Height, ObjectName: objectName, Version: version})
+	}
+
+	return rows
+}
+
+// storePhoto validates an uploaded image of at most maxBytes, registers it as a photo owned by the user and stores it and its renditions
+// When an error is returned, status is the HTTP status code to respond with
+func storePhoto(ctx context.Context, file io.ReadSeeker, size int64, maxBytes int64, attributes photoAttributes, userID string) (*Photo, int, error) {
+	prepared, status, err := prepareImage(file, size, maxBytes, shouldStripExif(attributes.IsPublic))
+	if err != nil {
+		return nil, status, err
+	}
+	info := prepared.info
+
+	// Generate a unique ID to identify the photo object
+	photoID := uuid.New().String()
+
+	// Register photo, its first version and its renditions in photos, photo_versions and renditions tables
+	photo := Photo{
+		ID:          photoID,
+		IsPublic:    attributes.IsPublic,
+		Title:       attributes.Title,
+		Description: attributes.Description,
+		Tags:        append([]Tag(nil), attributes.Tags...),
+		MimeType:    info.MimeType,
+		Width:       info.Width,
+		Height:      info.Height,
+		Size:        info.Size,
+		UserID:      userID,
+		Metadata:    prepared.metadata,
+		State:       PhotoStatePending,
+		Version:     1,
+		Versions:    []PhotoVersion{{Version: 1, MimeType: info.MimeType, Width: info.Width, Height: info.Height, Size: info.Size, State: PhotoStateActive}},
+		Renditions:  newRenditionRows(photoID, 1, prepared.renditions),
+	}
+
+	// The photo stays pending until its objects are written, if that does not happen in time the outbox removes it
+	// Its size is counted against the quota of the user from now on, until its rows are deleted
+	var abort *OutboxEvent
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := reserveQuota(tx, userID, photo.Size, 1); err != nil {
+			return err
+		}
+
+		if err := tx.Create(&photo).Error; err != nil {
+			return err
+		}
+
+		var err error
+		abort, err = enqueueOutboxEvent(tx, OutboxAbortUpload, photo.ID, time.Now().Add(PendingUploadTimeout))
+		return err
+	})
+	if quotaErr, ok := err.(*QuotaExceededError); ok {
+		return nil, http.StatusRequestEntityTooLarge, quotaErr
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if err := putPhotoObjects(ctx, photo, 1, prepared.original, prepared.info.Size, prepared.renditions); err != nil {
+		// Remove whatever was written right away instead of waiting for the timeout
+		if abortErr := processOutboxEvent(ctx, abort.ID); abortErr != nil {
+			fmt.Println("unable to abort upload:", abortErr)
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// Activate the photo unless the upload took so long it was aborted in the meantime
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Photo{}).Where(&Photo{ID: photo.ID, State: PhotoStatePending}).Update("state", PhotoStateActive)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("upload timed out")
+		}
+
+		// The photo only becomes searchable along with being activated
+		if err := refreshSearchIndex(tx, photo.ID); err != nil {
+			return err
+		}
+
+		return tx.Delete(abort).Error
+	})
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	photo.State = PhotoStateActive
+
+	return &photo, http.StatusOK, nil
+}
+
+// putPhotoObjects writes the original and the renditions of a version of a photo to its bucket
+func putPhotoObjects(ctx context.Context, photo Photo, version int, original io.Reader, size int64, renditions []renditionData) error {
+	// Verify existence of user's bucket
+	// TODO: Need more robust diaster recovery
+	exists, err := Store.BucketExists(ctx, getBucketForPhoto(photo))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("Bucket does not exist: %s", getBucketForPhoto(photo))
+	}
+
+	// Upload photo to bucket
+	objectName := versionObjectName(photo.ID, version)
+	if err := Store.Put(ctx, getBucketForPhoto(photo), objectName, original, size); err != nil {
+		return err
+	}
+
+	// Upload renditions next to the original
+	for _, rendition := range renditions {
+		if rendition.Data == nil {
+			continue
+		}
+
+		if err := Store.Put(ctx, getBucketForPhoto(photo), renditionObjectName(objectName, rendition.Width), bytes.NewReader(rendition.Data), int64(len(rendition.Data))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// batchUploadResult is the outcome of storing one file of a batch upload, either PhotoID or Error is set
+type batchUploadResult struct {
+	Filename string `json:"Filename"`
+	PhotoID  string `json:"PhotoID,omitempty"`
+	Error    string `json:"Error,omitempty"`
+}
+
+// storeBatch stores every file with at most workers files being stored at a time
+// Results are in the same order as files, a failing file does not stop the others from being stored
+func storeBatch(files []*multipart.FileHeader, workers int, store func(*multipart.FileHeader) (string, error)) []batchUploadResult {
+	results := make([]batchUploadResult, len(files))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(files); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				results[index].Filename = files[index].Filename
+				photoID, err := store(files[index])
+				if err != nil {
+					results[index].Error = err.Error()
+					continue
+				}
+				results[index].PhotoID = photoID
+			}
+		}()
+	}
+
+	for index := range files {
+		jobs <- index
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// BatchUpload allows users to upload many photos in one request, each uploadFile field of the form is stored as a photo
+// IsPublic, Title, Description and Tags apply to every photo of the batch
+func BatchUpload(w http.ResponseWriter, r *http.Request) {
+	// Leave some room above the maximum size of all files for the rest of the form
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadBytes*MaxBatchUploadFiles+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["uploadFile"]
+	if len(files) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("no uploadFile provided"))
+		return
+	}
+
+	if int64(len(files)) > MaxBatchUploadFiles {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("at most %d files can be uploaded at once", MaxBatchUploadFiles)))
+		return
+	}
+
+	attributes, status, err := parseUploadAttributes(r)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Identify who the user is
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	results := storeBatch(files, int(BatchUploadWorkers), func(fileHeader *multipart.FileHeader) (string, error) {
+		file, err := fileHeader.Open()
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+
+		photo, _, err := storePhoto(r.Context(), file, fileHeader.Size, MaxUploadBytes, *attributes, *userID)
+		if err != nil {
+			return "", err
+		}
+
+		return photo.ID, nil
+	})
+
+	response, err := json.Marshal(map[string][]batchUploadResult{"results": results})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"mime/multipart"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_storeBatch(t *testing.T) {
+	var files []*multipart.FileHeader
+	for i := 0; i < 10; i++ {
+		files = append(files, &multipart.FileHeader{Filename: fmt.Sprintf("%d.png", i)})
+	}
+
+	var running, maxRunning int32
+	results := storeBatch(files, 3, func(fileHeader *multipart.FileHeader) (string, error) {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			seen := atomic.LoadInt32(&maxRunning)
+			if current <= seen || atomic.CompareAndSwapInt32(&maxRunning, seen, current) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+
+		if fileHeader.Filename == "4.png" {
+			return "", fmt.Errorf("not an image")
+		}
+		return "id-" + fileHeader.Filename, nil
+	})
+
+	if maxRunning > 3 {
+		t.Errorf("at most 3 files should be stored at once, got %d", maxRunning)
+	}
+
+	for i, result := range results {
+		if result.Filename != files[i].Filename {
+			t.Errorf("result %d is for %s", i, result.Filename)
+		}
+
+		if i == 4 {
+			if result.Error != "not an image" || result.PhotoID != "" {
+				t.Errorf("failure not reported, got %+v", result)
+			}
+		} else if result.PhotoID != "id-"+files[i].Filename || result.Error != "" {
+			t.Errorf("unexpected result %+v", result)
+		}
+	}
+}
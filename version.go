@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// PhotoVersion is one revision of the image of a photo, the photo keeps its ID while its image is replaced
+// A new version is pending until its objects are written, like a new photo
+type PhotoVersion struct {
+	PhotoID   string    `json:"PhotoID" gorm:"primaryKey"`
+	Version   int       `json:"Version" gorm:"primaryKey;autoIncrement:false"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	State     string    `json:"-" gorm:"default:active"`
+	// Format, dimensions in pixels and size in bytes of the image
+	MimeType string `json:"MimeType"`
+	Width    int    `json:"Width"`
+	Height   int    `json:"Height"`
+	Size     int64  `json:"Size"`
+	// For client side use
+	IsCurrent     bool              `json:"IsCurrent" gorm:"-"`
+	ImageURL      string            `json:"ImageURL,omitempty" gorm:"-"`
+	RenditionURLs map[string]string `json:"Renditions,omitempty" gorm:"-"`
+}
+
+// errPhotoChanged is returned when a photo changes in a way that invalidates the version being uploaded
+var errPhotoChanged = fmt.Errorf("photo was changed while uploading, try again")
+
+// versionRequest is the JSON request body of the version endpoints
+type versionRequest struct {
+	PhotoID string `json:"PhotoID"`
+	Version int    `json:"Version"`
+}
+
+// versionObjectName returns the object name the original of a version of the photo is stored under
+// The first version is stored under the photo ID, so photos uploaded before versions were recorded keep working
+func versionObjectName(photoID string, version int) string {
+	if version <= 1 {
+		return photoID
+	}
+
+	return photoID + "_v" + strconv.Itoa(version)
+}
+
+// photoOriginals returns every version of the photo, Versions must be loaded on the photo
+// Photos uploaded before versions were recorded have none, their only version is described by the photo itself
+func photoOriginals(photo Photo) []PhotoVersion {
+	if len(photo.Versions) > 0 {
+		return photo.Versions
+	}
+
+	version := photo.Version
+	if version < 1 {
+		version = 1
+	}
+
+	return []PhotoVersion{{
+		PhotoID:   photo.ID,
+		Version:   version,
+		CreatedAt: photo.CreatedAt,
+		State:     PhotoStateActive,
+		MimeType:  photo.MimeType,
+		Width:     photo.Width,
+		Height:    photo.Height,
+		Size:      photo.Size,
+	}}
+}
+
+// photoStoredBytes is the size of every version of the photo, which is what it counts against the quota of its owner
+func photoStoredBytes(photo Photo) int64 {
+	var size int64
+	for _, version := range photoOriginals(photo) {
+		size += version.Size
+	}
+
+	return size
+}
+
+// versionObjectNames returns the names of the objects stored for a single version of the photo, Renditions must be loaded on the photo
+func versionObjectNames(photo Photo, version int) []string {
+	names := []string{versionObjectName(photo.ID, version)}
+	seen := map[string]bool{names[0]: true}
+	for _, rendition := range photo.Renditions {
+		if rendition.Version == version && !seen[rendition.ObjectName] {
+			seen[rendition.ObjectName] = true
+			names = append(names, rendition.ObjectName)
+		}
+	}
+
+	return names
+}
+
+// replacePhoto stores an uploaded image as a new version of a photo owned by the user and makes it the current version
+// When an error is returned, status is the HTTP status code to respond with
+func replacePhoto(ctx context.Context, photoID string, userID string, file io.ReadSeeker, size int64) (*PhotoVersion, int, error) {
+	photo, status, err := getPhotoOwnedBy(photoID, userID)
+	if err != nil {
+		return nil, status, err
+	}
+
+	strip, err := shouldStripPhoto(DB, *photo)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	prepared, status, err := prepareImage(file, size, MaxUploadBytes, strip)
+	if err != nil {
+		return nil, status, err
+	}
+
+	// The version stays pending until its objects are written, if that does not happen in time the outbox removes it
+	var version PhotoVersion
+	var abort OutboxEvent
+	var locked Photo
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		// Lock the photo so concurrent replacements are given different version numbers, and its visibility cannot change until the version is recorded
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Versions").Where(&Photo{ID: photo.ID, State: PhotoStateActive})
+		if err := query.First(&locked).Error; err != nil {
+			return err
+		}
+
+		// The photo was made public or shared after the image was prepared without stripping it
+		if !strip {
+			stripNow, err := shouldStripPhoto(tx, locked)
+			if err != nil {
+				return err
+			}
+			if stripNow {
+				return errPhotoChanged
+			}
+		}
+
+		// Photos uploaded before versions were recorded get a row for their first version
+		versions := photoOriginals(locked)
+		if len(locked.Versions) == 0 {
+			if err := tx.Create(&versions[0]).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := reserveQuota(tx, userID, prepared.info.Size, 0); err != nil {
+			return err
+		}
+
+		latest := 0
+		for _, v := range versions {
+			if v.Version > latest {
+				latest = v.Version
+			}
+		}
+
+		version = PhotoVersion{
+			PhotoID:  photo.ID,
+			Version:  latest + 1,
+			State:    PhotoStatePending,
+			MimeType: prepared.info.MimeType,
+			Width:    prepared.info.Width,
+			Height:   prepared.info.Height,
+			Size:     prepared.info.Size,
+		}
+		if err := tx.Create(&version).Error; err != nil {
+			return err
+		}
+
+		renditions := newRenditionRows(photo.ID, version.Version, prepared.renditions)
+		if len(renditions) > 0 {
+			if err := tx.Create(&renditions).Error; err != nil {
+				return err
+			}
+		}
+
+		abort = OutboxEvent{Kind: OutboxAbortVersion, PhotoID: photo.ID, Version: version.Version, NextAttemptAt: time.Now().Add(PendingUploadTimeout)}
+		return tx.Create(&abort).Error
+	})
+	if quotaErr, ok := err.(*QuotaExceededError); ok {
+		return nil, http.StatusRequestEntityTooLarge, quotaErr
+	}
+	if err == errPhotoChanged {
+		return nil, http.StatusConflict, err
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// The objects go into the bucket of the photo as it was when the version was recorded
+	if err := putPhotoObjects(ctx, locked, version.Version, prepared.original, prepared.info.Size, prepared.renditions); err != nil {
+		// Remove whatever was written right away instead of waiting for the timeout
+		if abortErr := processOutboxEvent(ctx, abort.ID); abortErr != nil {
+			fmt.Println("unable to abort upload:", abortErr)
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// Make the version current unless the upload took so long it was aborted in the meantime
+	var relocate *OutboxEvent
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		var current Photo
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where(&Photo{ID: photo.ID}).First(&current).Error; err != nil {
+			return err
+		}
+
+		result := tx.Model(&PhotoVersion{}).Where(&PhotoVersion{PhotoID: photo.ID, Version: version.Version, State: PhotoStatePending}).Update("state", PhotoStateActive)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("upload timed out")
+		}
+
+		if err := setCurrentVersion(tx, photo.ID, version, prepared.metadata); err != nil {
+			return err
+		}
+
+		// The visibility changed while the objects were written, they may have been missed when the other objects were moved
+		if current.IsPublic != locked.IsPublic {
+			var err error
+			if relocate, err = enqueueOutboxEvent(tx, OutboxRelocatePhoto, photo.ID, time.Now()); err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(&abort).Error
+	})
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	version.State = PhotoStateActive
+	version.IsCurrent = true
+
+	// Move the objects right away, if it fails the outbox worker will retry
+	if relocate != nil {
+		if err := processOutboxEvent(ctx, relocate.ID); err != nil {
+			fmt.Println("unable to move photo objects:", err)
+		}
+	}
+
+	return &version, http.StatusOK, nil
+}
+
+// setCurrentVersion makes the version the current one of the photo, replacing the EXIF metadata of the previous version
+func setCurrentVersion(tx *gorm.DB, photoID string, version PhotoVersion, metadata *PhotoMetadata) error {
+	current := Photo{Version: version.Version, MimeType: version.MimeType, Width: version.Width, Height: version.Height, Size: version.Size}
+	if err := tx.Model(&Photo{ID: photoID}).Select("Version", "MimeType", "Width", "Height", "Size").Updates(&current).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Where("photo_id = ?", photoID).Delete(&PhotoMetadata{}).Error; err != nil {
+		return err
+	}
+
+	if metadata == nil {
+		return nil
+	}
+
+	metadata.PhotoID = photoID
+	return tx.Create(metadata).Error
+}
+
+// revertPhoto makes a previous version of a photo owned by the user the current one again, the version that was current is kept
+// When an error is returned, status is the HTTP status code to respond with
+func revertPhoto(ctx context.Context, photoID string, userID string, number int) (int, error) {
+	photo, status, err := getPhotoOwnedBy(photoID, userID)
+	if err != nil {
+		return status, err
+	}
+
+	if number == photo.Version {
+		return http.StatusBadRequest, fmt.Errorf("version %d is already the current version", number)
+	}
+
+	var versions []PhotoVersion
+	if result := DB.Where(&PhotoVersion{PhotoID: photo.ID, Version: number, State: PhotoStateActive}).Find(&versions); result.Error != nil {
+		return http.StatusInternalServerError, result.Error
+	}
+
+	if len(versions) == 0 {
+		return http.StatusNotFound, fmt.Errorf("version %d of photo not found", number)
+	}
+
+	// EXIF metadata is only kept for the current version, so it is read back from the original of the version
+	// Originals of public photos may have been stripped of sensitive tags, in which case those stay missing
+	reader, err := Store.Get(ctx, getBucketForPhoto(*photo), versionObjectName(photo.ID, number))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	metadata := extractMetadata(bytes.NewReader(data))
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		// Make sure the photo was not changed in the meantime
+		var locked Photo
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where(&Photo{ID: photo.ID, State: PhotoStateActive, Version: photo.Version})
+		if err := query.First(&locked).Error; err != nil {
+			return err
+		}
+
+		return setCurrentVersion(tx, photo.ID, versions[0], metadata)
+	})
+	if err == gorm.ErrRecordNotFound {
+		return http.StatusConflict, fmt.Errorf("photo was changed while reverting, try again")
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// abortPhotoVersion removes a version that is still pending along with its objects and renditions
+// The version is taken out of the pending state first so its upload cannot complete while its objects are deleted
+// Renditions and Versions must be loaded on the photo
+func abortPhotoVersion(ctx context.Context, photo Photo, number int) error {
+	var version *PhotoVersion
+	for i := range photo.Versions {
+		if photo.Versions[i].Version == number {
+			version = &photo.Versions[i]
+		}
+	}
+
+	if version == nil {
+		return nil
+	}
+
+	if version.State == PhotoStatePending {
+		result := DB.Model(&PhotoVersion{}).Where(&PhotoVersion{PhotoID: photo.ID, Version: number, State: PhotoStatePending}).Update("state", PhotoStateDeleting)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 1 {
+			version.State = PhotoStateDeleting
+		}
+	}
+
+	// The upload completed in the meantime, unless a previous attempt started aborting it
+	if version.State != PhotoStateDeleting {
+		return nil
+	}
+
+	if err := deleteObjects(ctx, photo, versionObjectNames(photo, number)); err != nil {
+		return err
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("photo_id = ? AND version = ?", photo.ID, number).Delete(&Rendition{}).Error; err != nil {
+			return err
+		}
+
+		// A worker whose lease ran out may delete the version at the same time, only the one that deletes it releases its quota
+		result := tx.Where("photo_id = ? AND version = ?", photo.ID, number).Delete(&PhotoVersion{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		return releaseQuota(tx, photo.UserID, version.Size, 0)
+	})
+}
+
+// ReplacePhoto allows users to upload a new version of one of their photos, the photo keeps its ID so albums, shares and grants keep pointing to it
+func ReplacePhoto(w http.ResponseWriter, r *http.Request) {
+	// Get uploaded file, leaving some room above the maximum file size for the rest of the form
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadBytes+1<<20)
+	r.ParseMultipartForm(32 << 20)
+	file, fileHeader, err := r.FormFile("uploadFile")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Println(err)
+		return
+	}
+	defer file.Close()
+
+	photoID := r.FormValue("PhotoID")
+	if photoID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("PhotoID not provided"))
+		return
+	}
+
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	version, status, err := replacePhoto(r.Context(), photoID, *userID, file, fileHeader.Size)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeVersions(w, version)
+}
+
+// ListVersions returns every version of a photo owned by the user, oldest first
+func ListVersions(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var request versionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Malformed json"))
+		return
+	}
+
+	photo, status, err := getPhotoOwnedBy(request.PhotoID, *userID)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if result := DB.Where(&PhotoVersion{PhotoID: photo.ID, State: PhotoStateActive}).Order("version").Find(&photo.Versions); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	versions := photoOriginals(*photo)
+	for i := range versions {
+		versions[i].IsCurrent = versions[i].Version == photo.Version
+	}
+
+	writeVersions(w, versions)
+}
+
+// GetVersion returns a version of a photo owned by the user, along with URLs to its image and renditions
+func GetVersion(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var request versionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Malformed json"))
+		return
+	}
+
+	photo, status, err := getPhotoOwnedBy(request.PhotoID, *userID)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if result := DB.Where(&Rendition{PhotoID: photo.ID, Version: request.Version}).Find(&photo.Renditions); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	if result := DB.Where(&PhotoVersion{PhotoID: photo.ID, State: PhotoStateActive}).Find(&photo.Versions); result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(result.Error.Error()))
+		return
+	}
+
+	var version *PhotoVersion
+	versions := photoOriginals(*photo)
+	for i := range versions {
+		if versions[i].Version == request.Version {
+			version = &versions[i]
+		}
+	}
+
+	if version == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("version %d of photo not found", request.Version)))
+		return
+	}
+
+	// Sign URLs as if the version was the current one
+	versionPhoto := *photo
+	versionPhoto.Version = version.Version
+	version.IsCurrent = version.Version == photo.Version
+	version.ImageURL, err = GetURLForImage(versionPhoto)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	version.RenditionURLs, err = GetRenditionURLsForImage(versionPhoto)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeVersions(w, version)
+}
+
+// RevertVersion allows users to make a previous version of one of their photos the current one again
+func RevertVersion(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserGUIDFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var request versionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Malformed json"))
+		return
+	}
+
+	if request.PhotoID == "" || request.Version < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("PhotoID and Version not provided in request body"))
+		return
+	}
+
+	if status, err := revertPhoto(r.Context(), request.PhotoID, *userID, request.Version); err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("photo reverted to version %d", request.Version)))
+}
+
+// writeVersions responds with a single version or a list of versions as JSON
+func writeVersions(w http.ResponseWriter, versions interface{}) {
+	response, err := json.Marshal(versions)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
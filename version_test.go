@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+)
+
+func Test_versionObjectName(t *testing.T) {
+	if versionObjectName("p", 1) != "p" || versionObjectName("p", 0) != "p" {
+		t.Errorf("first version should be stored under the photo ID")
+	}
+
+	if versionObjectName("p", 3) != "p_v3" || renditionObjectName(versionObjectName("p", 3), 150) != "p_v3_150" {
+		t.Errorf("later versions should be stored next to the first one")
+	}
+}
+
+func Test_photoOriginals(t *testing.T) {
+	// Photos uploaded before versions were recorded only have the version described by the photo itself
+	legacy := Photo{ID: "p", MimeType: "image/png", Size: 10}
+	if versions := photoOriginals(legacy); len(versions) != 1 || versions[0].Version != 1 || versions[0].Size != 10 {
+		t.Errorf("unexpected versions of legacy photo %v", versions)
+	}
+
+	photo := Photo{ID: "p", Version: 2, Size: 20, Versions: []PhotoVersion{{Version: 1, Size: 10}, {Version: 2, Size: 20}, {Version: 3, Size: 30, State: PhotoStatePending}}}
+	if size := photoStoredBytes(photo); size != 60 {
+		t.Errorf("every version should count against the quota, got %d bytes", size)
+	}
+}
+
+func Test_versionObjectNames(t *testing.T) {
+	photo := Photo{
+		ID:       "p",
+		Version:  2,
+		Versions: []PhotoVersion{{Version: 1}, {Version: 2}},
+		Renditions: append(
+			newRenditionRows("p", 1, []renditionData{{Width: 150, Data: []byte{1}}, {Width: 640}}),
+			newRenditionRows("p", 2, []renditionData{{Width: 150, Data: []byte{1}}, {Width: 640, Data: []byte{1}}})...,
+		),
+	}
+
+	if names := fmt.Sprint(versionObjectNames(photo, 2)); names != "[p_v2 p_v2_150 p_v2_640]" {
+		t.Errorf("unexpected objects of version 2 %v", names)
+	}
+
+	if names := fmt.Sprint(photoObjectNames(photo)); names != "[p p_v2 p_150 p_v2_150 p_v2_640]" {
+		t.Errorf("unexpected objects of photo %v", names)
+	}
+}
+
+func Test_GetRenditionURLsForImage_currentVersion(t *testing.T) {
+	Store = newMemStore()
+	photo := Photo{
+		ID:     "p",
+		UserID: "user",
+		Renditions: append(
+			newRenditionRows("p", 1, []renditionData{{Width: 150, Data: []byte{1}}}),
+			newRenditionRows("p", 2, []renditionData{{Width: 150, Data: []byte{1}}})...,
+		),
+	}
+
+	for version, expected := range map[int]string{1: "mem://user/p_150", 2: "mem://user/p_v2_150"} {
+		photo.Version = version
+		urls, err := GetRenditionURLsForImage(photo)
+		if err != nil || len(urls) != 1 || urls["150"] != expected {
+			t.Errorf("version %d: expected only %s, got %v %v", version, expected, urls, err)
+		}
+	}
+}
+
+func Test_relocatePhotoObjects_versions(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+	Store = store
+	store.CreateBucket(ctx, PUBLIC_BUCKET_NAME)
+	store.CreateBucket(ctx, "user")
+
+	photo := Photo{ID: "p", UserID: "user", IsPublic: true, Version: 2, Versions: []PhotoVersion{{Version: 1, MimeType: "image/gif"}, {Version: 2, MimeType: "image/gif"}}}
+	store.Put(ctx, "user", "p", bytes.NewReader([]byte("first")), 5)
+	store.Put(ctx, "user", "p_v2", bytes.NewReader([]byte("second")), 6)
+
+	if err := relocatePhotoObjects(ctx, photo); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.buckets["user"]) != 0 || len(store.buckets[PUBLIC_BUCKET_NAME]) != 2 {
+		t.Errorf("previous versions should be relocated along with the current one, got %v", store.buckets)
+	}
+}
+
+func Test_replacePhoto(t *testing.T) {
+	useTestDB(t)
+	store := useTestStore(t)
+
+	owner := createTestUser(t)
+	photo := createTestPhoto(t, owner, buildTestJPEG(t, buildTestExif()), true)
+
+	image := encodeTestImage(t, 16, 16)
+	version, status, err := replacePhoto(context.Background(), photo.ID, owner.ID, bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatalf("photo not replaced, got %d %v", status, err)
+	}
+
+	// The new version is stored in the bucket matching the visibility of the photo
+	if !bytes.Equal(store.buckets[PUBLIC_BUCKET_NAME][versionObjectName(photo.ID, version.Version)], image) {
+		t.Errorf("new version not stored in the public bucket")
+	}
+
+	var stored Photo
+	DB.Where(&Photo{ID: photo.ID}).First(&stored)
+	if stored.Version != 2 || stored.MimeType != "image/png" || stored.Size != int64(len(image)) {
+		t.Errorf("new version not made current, got version %d of type %s", stored.Version, stored.MimeType)
+	}
+}